@@ -3,13 +3,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rsa"
 	"errors"
 	"flag"
 	"fmt"
 	"log/syslog"
 	"os"
 	"os/exec"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/pantheon-systems/pauditd/pkg/logger"
 	"github.com/pantheon-systems/pauditd/pkg/marshaller"
@@ -31,16 +39,41 @@ func loadConfig(configFile string) (*viper.Viper, error) {
 
 	config.SetDefault("events.min", 1300)
 	config.SetDefault("events.max", 1399)
+	config.SetDefault("events.flush_interval", "1s")
+	config.SetDefault("events.pending.max_groups", 16384)
+	config.SetDefault("events.pending.max_bytes", "64MB")
+	config.SetDefault("events.pending.eviction_policy", string(marshaller.EvictFlush))
 	config.SetDefault("message_tracking.enabled", true)
 	config.SetDefault("message_tracking.log_out_of_order", false)
 	config.SetDefault("message_tracking.max_out_of_order", 500)
+	config.SetDefault("message_tracking.lost_records", false)
 	config.SetDefault("output.syslog.enabled", false)
 	config.SetDefault("output.syslog.priority", int(syslog.LOG_LOCAL0|syslog.LOG_WARNING))
 	config.SetDefault("output.syslog.tag", "pauditd")
 	config.SetDefault("output.syslog.attempts", "3")
 	config.SetDefault("log.flags", 0)
+	config.SetDefault("shutdown.timeout", "30s")
+	config.SetDefault("reload.watch", false)
+	config.SetDefault("rate_limits.summary_interval", "60s")
+	config.SetDefault("aggregation.enabled", false)
+	config.SetDefault("aggregation.window", "10s")
+	config.SetDefault("aggregation.fields", []string{"key", "exe", "uid", "path"})
+	config.SetDefault("aggregation.max_groups", 10000)
+	config.SetDefault("redaction.enabled", false)
+	config.SetDefault("redaction.builtin", marshaller.RedactionRuleIDs())
+	config.SetDefault("redaction.builtin_mode", string(marshaller.RedactMask))
+	config.SetDefault("encryption.enabled", false)
+	config.SetDefault("pipeline.enabled", false)
+	config.SetDefault("pipeline.workers", 0)
+	config.SetDefault("pipeline.receive_buffer", 8192)
+	config.SetDefault("pipeline.work_buffer", 1024)
 	config.SetDefault("parser.enable_uid_caching", "false")
 	config.SetDefault("parser.password_file_path", "/etc/passwd")
+	config.SetDefault("parser.group_file_path", "/etc/group")
+	config.SetDefault("parser.uid_cache.max_size", 10000)
+	config.SetDefault("parser.uid_cache.ttl", "10m")
+	config.SetDefault("parser.uid_cache.negative_ttl", "1m")
+	config.SetDefault("parser.enable_namespace_resolution", false)
 
 	metric.SetConfigDefaults(config)
 
@@ -82,31 +115,77 @@ func setRules(config *viper.Viper, e executor) error {
 	return nil
 }
 
+// createOutput creates a writer for the enabled outputs. With more than one every output gets a
+// queue of its own, sized by output.<name>.queue_size. An output.<name>.match limits the groups
+// written to the output
 func createOutput(config *viper.Viper) (*output.AuditWriter, error) {
-	var writer *output.AuditWriter
-	var err error
-	enabledCount := 0
+	writers, err := createOutputWriters(config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(writers) {
+	case 0:
+		return nil, errors.New("no outputs were configured")
+	case 1:
+		return writers[0], nil
+	}
+
+	return output.NewFanOutAuditWriter(writers), nil
+}
+
+// createOutputWriters creates a writer for every enabled output, or only for the enabled outputs
+// in names when it is not nil
+func createOutputWriters(config *viper.Viper, names []string) ([]*output.AuditWriter, error) {
+	var writers []*output.AuditWriter
+	fail := func(err error) ([]*output.AuditWriter, error) {
+		for _, w := range writers {
+			closeWriter(w, config.GetDuration("shutdown.timeout"))
+		}
+		return nil, err
+	}
 
 	for _, auditWriterName := range output.GetAvailableAuditWriters() {
+		if names != nil && !slices.Contains(names, auditWriterName) {
+			continue
+		}
+
 		configName := "output." + auditWriterName + ".enabled"
-		if config.GetBool(configName) {
-			enabledCount++
-			writer, err = output.CreateAuditWriter(auditWriterName, config)
-			if err != nil {
-				return nil, err
-			}
+		if !config.GetBool(configName) {
+			continue
 		}
+
+		match, err := createOutputMatch(config, auditWriterName)
+		if err != nil {
+			return fail(err)
+		}
+
+		writer, err := output.CreateAuditWriter(auditWriterName, config)
+		if err != nil {
+			return fail(err)
+		}
+
+		if match != nil {
+			writer.SetMatcher(match)
+		}
+		writers = append(writers, writer)
 	}
 
-	if enabledCount > 1 {
-		return nil, errors.New("only one output can be enabled at a time")
+	return writers, nil
+}
+
+func createOutputMatch(config *viper.Viper, name string) (*marshaller.OutputMatch, error) {
+	m := config.Get("output." + name + ".match")
+	if m == nil {
+		return nil, nil
 	}
 
-	if writer == nil {
-		return nil, errors.New("no outputs were configured")
+	obj, ok := m.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("could not parse output.%s.match object", name)
 	}
 
-	return writer, nil
+	return marshaller.NewOutputMatch(name, obj)
 }
 
 func createFilters(config *viper.Viper) ([]marshaller.AuditFilter, error) {
@@ -133,13 +212,214 @@ func createFilters(config *viper.Viper) ([]marshaller.AuditFilter, error) {
 		if err != nil {
 			return filters, err
 		}
+		for j, other := range filters {
+			if other.ID == af.ID {
+				return filters[:0], fmt.Errorf("filter ids must be unique, `%s` is used by filter %d and %d", af.ID, j+1, i+1)
+			}
+		}
 		filters = append(filters, *af)
 	}
 
 	return filters, nil
 }
 
+func createRateLimits(config *viper.Viper) ([]marshaller.RateLimit, error) {
+	rl := config.Get("rate_limits.limits")
+	limits := []marshaller.RateLimit{}
+
+	if rl == nil {
+		return limits, nil
+	}
+
+	rt, ok := rl.([]interface{})
+	if !ok {
+		return limits, fmt.Errorf("could not parse rate_limits.limits object")
+	}
+
+	for i, r := range rt {
+		r2, ok := r.(map[string]interface{})
+		if !ok {
+			return limits, fmt.Errorf("could not parse rate limit %d; '%+v'", i+1, r)
+		}
+		limit, err := marshaller.NewRateLimit(i+1, r2)
+		if err != nil {
+			return limits, err
+		}
+		for j, other := range limits {
+			if other.ID == limit.ID {
+				return limits[:0], fmt.Errorf("rate limit ids must be unique, `%s` is used by rate limit %d and %d", limit.ID, j+1, i+1)
+			}
+		}
+		limits = append(limits, *limit)
+	}
+
+	return limits, nil
+}
+
+func createAggregation(config *viper.Viper) (*marshaller.AggregationConfig, error) {
+	if !config.GetBool("aggregation.enabled") {
+		return nil, nil
+	}
+
+	aggregation := &marshaller.AggregationConfig{
+		Window:    config.GetDuration("aggregation.window"),
+		Fields:    config.GetStringSlice("aggregation.fields"),
+		Keys:      config.GetStringSlice("aggregation.keys"),
+		MaxGroups: config.GetInt("aggregation.max_groups"),
+	}
+
+	if err := aggregation.Validate(); err != nil {
+		return nil, err
+	}
+
+	return aggregation, nil
+}
+
+func createRedactor(config *viper.Viper) (*marshaller.Redactor, error) {
+	if !config.GetBool("redaction.enabled") {
+		return nil, nil
+	}
+
+	builtinMode, err := marshaller.ParseRedactMode(config.GetString("redaction.builtin_mode"))
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []marshaller.RedactionRule{}
+	for _, id := range config.GetStringSlice("redaction.builtin") {
+		rule, ok := marshaller.BuiltinRedactionRules[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown built in redaction rule `%s`, expected one of %s", id, strings.Join(marshaller.RedactionRuleIDs(), ", "))
+		}
+		rule.Mode = builtinMode
+		rules = append(rules, rule)
+	}
+
+	if rs := config.Get("redaction.rules"); rs != nil {
+		rt, ok := rs.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("could not parse redaction.rules object")
+		}
+
+		for i, r := range rt {
+			r2, ok := r.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("could not parse redaction rule %d; '%+v'", i+1, r)
+			}
+			rule, err := marshaller.NewRedactionRule(i+1, r2)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, *rule)
+		}
+	}
+
+	var key []byte
+	if keyFile := config.GetString("redaction.hmac_key_file"); keyFile != "" {
+		if key, err = os.ReadFile(keyFile); err != nil {
+			return nil, fmt.Errorf("failed to read the redaction hmac key. Error: %s", err)
+		}
+		key = bytes.TrimSpace(key)
+	}
+
+	return marshaller.NewRedactor(rules, key)
+}
+
+func createEncryptor(config *viper.Viper) (*marshaller.Encryptor, error) {
+	if !config.GetBool("encryption.enabled") {
+		return nil, nil
+	}
+
+	var pub *rsa.PublicKey
+	var err error
+	if key := config.GetString("encryption.public_key"); key != "" {
+		pub, err = marshaller.ParsePublicKey([]byte(key))
+	} else if keyFile := config.GetString("encryption.public_key_file"); keyFile != "" {
+		pub, err = marshaller.LoadPublicKey(keyFile)
+	} else {
+		return nil, errors.New("encryption needs a `public_key` or `public_key_file`")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the encryption public key. Error: %s", err)
+	}
+
+	rs, ok := config.Get("encryption.rules").([]interface{})
+	if !ok || len(rs) == 0 {
+		return nil, fmt.Errorf("could not parse encryption.rules object")
+	}
+
+	rules := []marshaller.EncryptionRule{}
+	for i, r := range rs {
+		r2, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("could not parse encryption rule %d; '%+v'", i+1, r)
+		}
+		rule, err := marshaller.NewEncryptionRule(i+1, r2)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *rule)
+	}
+
+	return marshaller.NewEncryptor(pub, rules), nil
+}
+
+func createPipeline(config *viper.Viper, m *marshaller.AuditMarshaller) *marshaller.Pipeline {
+	pipelineConfig := marshaller.PipelineConfig{
+		Workers:       config.GetInt("pipeline.workers"),
+		ReceiveBuffer: config.GetInt("pipeline.receive_buffer"),
+		WorkBuffer:    config.GetInt("pipeline.work_buffer"),
+	}
+
+	logger.Info("Enabling the processing pipeline", "workers", pipelineConfig.Workers, "receive_buffer", pipelineConfig.ReceiveBuffer, "work_buffer", pipelineConfig.WorkBuffer)
+	return marshaller.NewPipeline(m, pipelineConfig)
+}
+
+func createPendingLimits(config *viper.Viper) (marshaller.PendingLimits, error) {
+	policy, err := marshaller.ParseEvictionPolicy(config.GetString("events.pending.eviction_policy"))
+	if err != nil {
+		return marshaller.PendingLimits{}, err
+	}
+
+	return marshaller.PendingLimits{
+		MaxGroups: config.GetInt("events.pending.max_groups"),
+		MaxBytes:  int(config.GetSizeInBytes("events.pending.max_bytes")),
+		Policy:    policy,
+	}, nil
+}
+
+// shutdown completes every event received before the shutdown started, drains the output
+// and releases the netlink socket. It returns the exit status for the process
+func shutdown(nlClient *NetlinkClient, m *marshaller.AuditMarshaller, p *marshaller.Pipeline, writer *output.AuditWriter, timeout time.Duration) int {
+	status := 0
+
+	logger.Info("Flushing pending events")
+	if p != nil {
+		p.Close()
+	} else {
+		m.Flush()
+	}
+
+	logger.Info("Draining output", "timeout", timeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := writer.Close(ctx); err != nil {
+		logger.Error("Failed to drain output", "error", err)
+		status = 1
+	}
+
+	nlClient.Close()
+	logger.Info("Shutdown complete")
+
+	return status
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		os.Exit(runDecrypt(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
 	showVersion := flag.Bool("version", false, "Print version and exit")
 	configFile := flag.String("config", "", "Config file location")
 
@@ -168,8 +448,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	defer metric.Shutdown()
-
 	// output needs to be created before anything that write to stdout
 	writer, err := createOutput(config)
 	if err != nil {
@@ -188,6 +466,36 @@ func main() {
 		os.Exit(1)
 	}
 
+	rateLimits, err := createRateLimits(config)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	aggregation, err := createAggregation(config)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	redactor, err := createRedactor(config)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	encryptor, err := createEncryptor(config)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	pendingLimits, err := createPendingLimits(config)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	nlClient, err := NewNetlinkClient(config.GetInt("socket_buffer.receive"))
 	if err != nil {
 		logger.Error(err.Error())
@@ -196,11 +504,21 @@ func main() {
 
 	if config.GetBool("parser.enable_uid_caching") {
 		logger.Info("Enabling uid/uname caching")
-		path := config.GetString("parser.password_file_path")
-		parser.ActiveUsernameResolver = parser.NewCachingUsernameResolver(path)
+		parser.ActiveUsernameResolver = parser.NewCachingUsernameResolver(parser.CachingUsernameResolverConfig{
+			PasswdPath:  config.GetString("parser.password_file_path"),
+			GroupPath:   config.GetString("parser.group_file_path"),
+			MaxSize:     config.GetInt("parser.uid_cache.max_size"),
+			TTL:         config.GetDuration("parser.uid_cache.ttl"),
+			NegativeTTL: config.GetDuration("parser.uid_cache.negative_ttl"),
+		})
+	}
+
+	if config.GetBool("parser.enable_namespace_resolution") {
+		logger.Info("Enabling mount namespace aware uid/uname resolution")
+		parser.ActiveUsernameResolver = parser.NewNamespaceUsernameResolver(parser.ActiveUsernameResolver)
 	}
 
-	marshaller := marshaller.NewAuditMarshaller(
+	auditMarshaller := marshaller.NewAuditMarshaller(
 		writer,
 		uint16(config.GetInt("events.min")),
 		uint16(config.GetInt("events.max")),
@@ -210,12 +528,65 @@ func main() {
 		filters,
 	)
 
+	if config.GetBool("message_tracking.lost_records") {
+		auditMarshaller.EnableLostRecords()
+	}
+
+	auditMarshaller.SetPendingLimits(pendingLimits)
+	auditMarshaller.SetRateLimits(rateLimits, config.GetDuration("rate_limits.summary_interval"))
+	auditMarshaller.SetAggregation(aggregation)
+	auditMarshaller.SetRedactor(redactor)
+	auditMarshaller.SetEncryptor(encryptor)
+
+	var pipeline *marshaller.Pipeline
+	consume := auditMarshaller.Consume
+	if config.GetBool("pipeline.enabled") {
+		pipeline = createPipeline(config, auditMarshaller)
+		consume = pipeline.Consume
+	}
+
+	// started once the pipeline is in place, the timer completes groups through it
+	auditMarshaller.StartFlushTimer(config.GetDuration("events.flush_interval"))
+
+	reloads := newReloader(*configFile, config, auditMarshaller, writer, lExec)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			logger.Info("Received SIGHUP, reloading config", "config", *configFile)
+			reloads.Reload()
+		}
+	}()
+
+	if config.GetBool("reload.watch") {
+		if _, err := watchConfig(*configFile, reloads.Reload); err != nil {
+			logger.Error("Failed to watch the config file, reload with SIGHUP instead", "error", err)
+		}
+	}
+
+	stopping := &atomic.Bool{}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logger.Info("Received signal, shutting down", "signal", sig.String())
+		stopping.Store(true)
+
+		sig = <-signals
+		logger.Error("Received a second signal, exiting without draining", "signal", sig.String())
+		os.Exit(1)
+	}()
+
 	logger.Info("Started processing events in the range [%d, %d]\n", config.GetInt("events.min"), config.GetInt("events.max"))
 
 	// Main loop. Get data from netlink and send it to the json lib for processing
-	for {
+	for !stopping.Load() {
 		msg, err := nlClient.Receive()
 		timing := metric.GetClient().NewTiming() // measure latency from recipt of message
+		if IsReceiveTimeout(err) {
+			continue
+		}
+
 		if err != nil {
 			if err.Error() == "no buffer space available" {
 				metric.GetClient().Increment("messages.netlink_dropped")
@@ -229,7 +600,20 @@ func main() {
 			continue
 		}
 
-		marshaller.Consume(msg)
+		if msg.Header.Type == AuditGet {
+			// Reply to the periodic status request, only the lost counter is of interest
+			if status, err := ParseAuditStatus(msg.Data); err == nil {
+				auditMarshaller.SetKernelLost(status.Lost)
+			}
+			continue
+		}
+
+		consume(msg)
 		timing.Send("latency")
 	}
+
+	signal.Stop(hangups)
+	status := shutdown(nlClient, auditMarshaller, pipeline, reloads.Stop(), config.GetDuration("shutdown.timeout"))
+	metric.Shutdown()
+	os.Exit(status)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,13 +11,17 @@ import (
 	"os/user"
 	"path"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/pantheon-systems/pauditd/pkg/logger"
 	"github.com/pantheon-systems/pauditd/pkg/marshaller"
 	"github.com/pantheon-systems/pauditd/pkg/metric"
 	"github.com/pantheon-systems/pauditd/pkg/output"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -113,6 +119,12 @@ func Test_setRules(t *testing.T) {
 }
 
 func Test_createOutput(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
 	// no outputs
 	c := viper.New()
 	w, err := createOutput(c)
@@ -154,9 +166,37 @@ func Test_createOutput(t *testing.T) {
 	c.Set("output.file.user", u.Username)
 	c.Set("output.file.group", g.Name)
 
+	c.Set("output.file.queue_size", 0)
+	w, err = createOutput(c)
+	assert.EqualError(t, err, "output queue_size for file must be at least 1, 0 provided")
+	assert.Nil(t, w)
+
+	c.Set("output.file.queue_size", 10)
+	c.Set("output.file.match", "passwd-write-log")
 	w, err = createOutput(c)
-	assert.EqualError(t, err, "only one output can be enabled at a time")
+	assert.EqualError(t, err, "could not parse output.file.match object")
 	assert.Nil(t, w)
+
+	c.Set("output.file.match", map[string]interface{}{"key": "passwd-write-log"})
+	w, err = createOutput(c)
+	assert.EqualError(t, err, "unknown entry `key` in the match of output file")
+	assert.Nil(t, w)
+
+	// every enabled output is written to, the file only gets the groups it matches
+	c.Set("output.file.match", map[string]interface{}{"keys": []interface{}{"passwd-write-log"}})
+	w, err = createOutput(c)
+	assert.Nil(t, err)
+	if assert.NotNil(t, w) {
+		assert.Equal(t, "file,syslog", w.Name())
+		assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1, RuleKey: "passwd-write-log", Outputs: []string{"file"}}))
+		assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 2, RuleKey: "execve", Outputs: []string{"file"}}))
+		assert.Nil(t, w.Close(context.Background()))
+
+		contents, err := os.ReadFile(path.Join(os.TempDir(), "pauditd.test.log"))
+		assert.Nil(t, err)
+		assert.Contains(t, string(contents), `"sequence":1,`)
+		assert.NotContains(t, string(contents), `"sequence":2,`)
+	}
 }
 
 func Test_createFilters(t *testing.T) {
@@ -352,6 +392,390 @@ func Test_createFilters(t *testing.T) {
 	}
 
 	assert.Equal(t, "droping messages with key `testkey` matching string `1`\n", logline.Msg)
+
+	// Bad expression - un-parse-able
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "exe =="})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`expression` in filter 1 could not be parsed; Value: `exe ==`; Error: expected a string or number at offset 6, got end of expression")
+	assert.Empty(t, f)
+
+	// Expression combined with a regex
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "exe == \"/bin/sh\"", "regex": "1"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "filter 1 can not combine `expression` with `regex`, `key`, `syscall` or `message_type`")
+	assert.Empty(t, f)
+
+	// Good expression
+	lb.Reset()
+	elb.Reset()
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "auid != 4294967295", "action": "keep"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, f)
+	assert.Equal(t, "auid != 4294967295", f[0].Expression.String())
+	assert.Nil(t, f[0].Regex)
+	assert.Empty(t, elb.String())
+
+	perr = json.Unmarshal([]byte(lb.Bytes()), &logline)
+	if perr != nil {
+		fmt.Println("Error unmarshaling logger output JSON:", perr)
+	}
+
+	assert.Equal(t, "keeping messages matching expression `auid != 4294967295`\n", logline.Msg)
+
+	// Bad action
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"key": "testkey", "regex": "1", "action": "explode"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`action` in filter 1 could not be parsed; Value: `explode`")
+	assert.Empty(t, f)
+
+	// Tag without tags
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"key": "testkey", "regex": "1", "action": "tag"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "filter 1 has the `tag` action but neither `tags` nor `severity`")
+	assert.Empty(t, f)
+
+	// Redact expression without a redact regex
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "exe", "action": "redact"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "filter 1 has the `redact` action but is missing the `redact` entry")
+	assert.Empty(t, f)
+
+	// Sample rate out of range
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "exe", "action": "sample", "sample_rate": 101})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`sample_rate` in filter 1 must be between 0 and 100; Value: `101`")
+	assert.Empty(t, f)
+
+	// Route to an unknown output
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"expression": "exe", "action": "route", "output": "nowhere"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`output` in filter 1 is not a known output; Value: `nowhere`")
+	assert.Empty(t, f)
+
+	// Good actions
+	lb.Reset()
+	elb.Reset()
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"key": "testkey", "regex": "password=\\S+", "action": "redact"})
+	rf = append(rf, map[string]interface{}{"expression": "exe", "action": "tag", "tags": []interface{}{"a", "b"}, "severity": "low"})
+	rf = append(rf, map[string]interface{}{"expression": "exe", "action": "sample", "sample_rate": "12.5%"})
+	rf = append(rf, map[string]interface{}{"expression": "exe", "action": "route", "output": "syslog"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.Nil(t, err)
+	assert.Len(t, f, 4)
+	assert.Equal(t, marshaller.Redact, f[0].Action)
+	assert.Equal(t, f[0].Regex, f[0].RedactRegex)
+	assert.Equal(t, []string{"a", "b"}, f[1].Tags)
+	assert.Equal(t, "low", f[1].Severity)
+	assert.Equal(t, 12.5, f[2].SampleRate)
+	assert.Equal(t, []string{"syslog"}, f[3].Outputs)
+	assert.Empty(t, elb.String())
+
+	// Bad id
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"id": "has.dots", "key": "testkey", "regex": "1"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`id` in filter 1 could not be parsed, only letters, digits, _ and - are allowed; Value: `has.dots`")
+	assert.Empty(t, f)
+
+	// Bad mode
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"mode": "maybe", "key": "testkey", "regex": "1"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "`mode` in filter 1 could not be parsed; Value: `maybe`")
+	assert.Empty(t, f)
+
+	// Duplicate ids
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"key": "testkey", "regex": "1"})
+	rf = append(rf, map[string]interface{}{"id": "filter_1", "key": "testkey", "regex": "2"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.EqualError(t, err, "filter ids must be unique, `filter_1` is used by filter 1 and 2")
+	assert.Empty(t, f)
+
+	// Ids and modes
+	c = viper.New()
+	rf = make([]interface{}, 0)
+	rf = append(rf, map[string]interface{}{"key": "testkey", "regex": "1"})
+	rf = append(rf, map[string]interface{}{"id": "new-filter", "mode": "dry_run", "key": "testkey", "regex": "2"})
+	c.Set("filters", rf)
+	f, err = createFilters(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "filter_1", f[0].ID)
+	assert.Equal(t, marshaller.Enforce, f[0].Mode)
+	assert.Equal(t, "new-filter", f[1].ID)
+	assert.Equal(t, marshaller.DryRun, f[1].Mode)
+}
+
+func Test_createPendingLimits(t *testing.T) {
+	c := viper.New()
+	c.Set("events.pending.max_groups", 100)
+	c.Set("events.pending.max_bytes", "1MB")
+	c.Set("events.pending.eviction_policy", "drop")
+	limits, err := createPendingLimits(c)
+	assert.Nil(t, err)
+	assert.Equal(t, marshaller.PendingLimits{MaxGroups: 100, MaxBytes: 1 << 20, Policy: marshaller.EvictDrop}, limits)
+
+	c.Set("events.pending.eviction_policy", "nope")
+	_, err = createPendingLimits(c)
+	assert.EqualError(t, err, `unknown eviction policy "nope", expected "flush" or "drop"`)
+}
+
+func Test_createRateLimits(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	// none configured
+	c := viper.New()
+	limits, err := createRateLimits(c)
+	assert.Nil(t, err)
+	assert.Empty(t, limits)
+
+	c.Set("rate_limits.limits", "bad")
+	_, err = createRateLimits(c)
+	assert.EqualError(t, err, "could not parse rate_limits.limits object")
+
+	c.Set("rate_limits.limits", []interface{}{"bad"})
+	_, err = createRateLimits(c)
+	assert.EqualError(t, err, "could not parse rate limit 1; 'bad'")
+
+	c.Set("rate_limits.limits", []interface{}{map[string]interface{}{"by": "key"}})
+	_, err = createRateLimits(c)
+	assert.EqualError(t, err, "rate limit 1 is missing the `rate` entry")
+
+	c.Set("rate_limits.limits", []interface{}{
+		map[string]interface{}{"id": "exec", "by": "key", "value": "exec", "rate": 5},
+		map[string]interface{}{"id": "exec", "by": "uid", "rate": 5},
+	})
+	_, err = createRateLimits(c)
+	assert.EqualError(t, err, "rate limit ids must be unique, `exec` is used by rate limit 1 and 2")
+
+	c.Set("rate_limits.limits", []interface{}{
+		map[string]interface{}{"id": "exec", "by": "key", "value": "exec", "rate": 5},
+		map[string]interface{}{"by": "uid", "rate": "60/m", "burst": 10},
+	})
+	limits, err = createRateLimits(c)
+	assert.Nil(t, err)
+	if assert.Len(t, limits, 2) {
+		assert.Equal(t, "exec", limits[0].ID)
+		assert.Equal(t, "rate_limit_2", limits[1].ID)
+		assert.Equal(t, float64(1), limits[1].Rate)
+		assert.Equal(t, 10, limits[1].Burst)
+	}
+}
+
+func Test_createAggregation(t *testing.T) {
+	file := createTempFile(t, "aggregation.test.yaml", "")
+	defer func() {
+		if err := os.Remove(file); err != nil {
+			t.Errorf("Failed to remove file: %v", err)
+		}
+	}()
+
+	c, err := loadConfig(file)
+	assert.Nil(t, err)
+
+	// off by default
+	aggregation, err := createAggregation(c)
+	assert.Nil(t, err)
+	assert.Nil(t, aggregation)
+
+	c.Set("aggregation.enabled", true)
+	c.Set("aggregation.keys", []string{"cron"})
+	aggregation, err = createAggregation(c)
+	assert.Nil(t, err)
+	assert.Equal(t, &marshaller.AggregationConfig{
+		Window:    10 * time.Second,
+		Fields:    []string{"key", "exe", "uid", "path"},
+		Keys:      []string{"cron"},
+		MaxGroups: 10000,
+	}, aggregation)
+
+	c.Set("aggregation.window", "0s")
+	_, err = createAggregation(c)
+	assert.EqualError(t, err, "aggregation window must be above 0, 0s provided")
+}
+
+func Test_createRedactor(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	file := createTempFile(t, "redaction.test.yaml", "")
+	keyFile := createTempFile(t, "redaction.test.key", "0123456789abcdef\n")
+	defer func() {
+		for _, f := range []string{file, keyFile} {
+			if err := os.Remove(f); err != nil {
+				t.Errorf("Failed to remove file: %v", err)
+			}
+		}
+	}()
+
+	c, err := loadConfig(file)
+	assert.Nil(t, err)
+
+	// off by default
+	r, err := createRedactor(c)
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+
+	c.Set("redaction.enabled", true)
+	r, err = createRedactor(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, r)
+
+	c.Set("redaction.builtin", []string{"ssn"})
+	_, err = createRedactor(c)
+	assert.EqualError(t, err, "unknown built in redaction rule `ssn`, expected one of aws_access_key, aws_secret_key, bearer_token, password_flag")
+
+	c.Set("redaction.builtin", []string{"password_flag"})
+	c.Set("redaction.builtin_mode", "hmac")
+	_, err = createRedactor(c)
+	assert.EqualError(t, err, "redaction rule `password_flag` uses hmac but the hmac key is shorter than 16 bytes")
+
+	c.Set("redaction.hmac_key_file", keyFile)
+	c.Set("redaction.rules", []interface{}{map[string]interface{}{"fields": []interface{}{"a2"}}})
+	r, err = createRedactor(c)
+	assert.Nil(t, err)
+	group := &parser.AuditMessageGroup{Msgs: []*parser.AuditMessage{{Data: `a0="mysql" a1="-psecret" a2="db"`}}}
+	r.Redact(group)
+	assert.Regexp(t, `^a0="mysql" a1="-p\[HMAC:[0-9a-f]{32}\]" a2="\[REDACTED\]"$`, group.Msgs[0].Data)
+
+	c.Set("redaction.rules", []interface{}{"bad"})
+	_, err = createRedactor(c)
+	assert.EqualError(t, err, "could not parse redaction rule 1; 'bad'")
+
+	c.Set("redaction.rules", nil)
+	c.Set("redaction.hmac_key_file", "/does/not/exist")
+	_, err = createRedactor(c)
+	assert.EqualError(t, err, "failed to read the redaction hmac key. Error: open /does/not/exist: no such file or directory")
+}
+
+func Test_createEncryptor(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	file := createTempFile(t, "encryption.test.yaml", "")
+	pubFile, privFile := createKeyPair(t, "encryption.test")
+	defer func() {
+		for _, f := range []string{file, pubFile, privFile} {
+			if err := os.Remove(f); err != nil {
+				t.Errorf("Failed to remove file: %v", err)
+			}
+		}
+	}()
+
+	c, err := loadConfig(file)
+	assert.Nil(t, err)
+
+	// off by default
+	e, err := createEncryptor(c)
+	assert.Nil(t, err)
+	assert.Nil(t, e)
+
+	c.Set("encryption.enabled", true)
+	_, err = createEncryptor(c)
+	assert.EqualError(t, err, "encryption needs a `public_key` or `public_key_file`")
+
+	c.Set("encryption.public_key_file", "/does/not/exist")
+	_, err = createEncryptor(c)
+	assert.EqualError(t, err, "failed to load the encryption public key. Error: open /does/not/exist: no such file or directory")
+
+	c.Set("encryption.public_key_file", pubFile)
+	_, err = createEncryptor(c)
+	assert.EqualError(t, err, "could not parse encryption.rules object")
+
+	c.Set("encryption.rules", []interface{}{"bad"})
+	_, err = createEncryptor(c)
+	assert.EqualError(t, err, "could not parse encryption rule 1; 'bad'")
+
+	c.Set("encryption.rules", []interface{}{map[string]interface{}{"key": "db", "fields": []interface{}{"a1"}}})
+	e, err = createEncryptor(c)
+	assert.Nil(t, err)
+	group := &parser.AuditMessageGroup{RuleKey: "db", Msgs: []*parser.AuditMessage{{Data: `a0="mysql" a1="-psecret"`}}}
+	assert.Nil(t, e.Encrypt(group))
+	assert.Regexp(t, `^a0="mysql" a1=enc:\S+$`, group.Msgs[0].Data)
+
+	// the key can be given inline as well
+	pem, err := os.ReadFile(pubFile)
+	assert.Nil(t, err)
+	c.Set("encryption.public_key_file", "")
+	c.Set("encryption.public_key", string(pem))
+	e, err = createEncryptor(c)
+	assert.Nil(t, err)
+	assert.NotNil(t, e)
+}
+
+func Test_shutdown(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	n := makeNelinkClient(t)
+	n.cancelKeepConnection = make(chan struct{})
+
+	w := &bytes.Buffer{}
+	m := marshaller.NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1300), uint16(1399), false, false, 1, []marshaller.AuditFilter{})
+	m.StartFlushTimer(time.Hour)
+
+	// A group without an end of event message is still written on shutdown
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+
+	assert.Equal(t, 0, shutdown(n, m, nil, output.NewAuditWriter(w, 1), time.Second))
+	assert.Contains(t, w.String(), "\"sequence\":1")
+
+	// The netlink socket was closed
+	_, err := n.Receive()
+	assert.EqualError(t, err, "bad file descriptor")
 }
 
 func Benchmark_MultiPacketMessage(b *testing.B) {
@@ -383,6 +807,7 @@ func Benchmark_MultiPacketMessage(b *testing.B) {
 	//&{1320,,,1222763,1459376866.885}
 	data[5] = []byte{31, 0, 0, 0, 40, 5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 97, 117, 100, 105, 116, 40, 49, 52, 53, 57, 51, 55, 54, 56, 54, 54, 46, 56, 56, 53, 58, 49, 50, 50, 50, 55, 54, 51, 41, 58, 32}
 
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		for n := 0; n < len(data); n++ {
 			nlen := len(data[n])
@@ -399,6 +824,89 @@ func Benchmark_MultiPacketMessage(b *testing.B) {
 			marshaller.Consume(msg)
 		}
 	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+}
+
+// endToEndRecords is an execve event as the kernel sends it, %d is replaced by the sequence
+var endToEndRecords = []struct {
+	mtype uint16
+	data  string
+}{
+	{1300, `audit(1459376866.885:%d): arch=c000003e syscall=59 success=yes exit=0 a0=cc4e68 a1=d10bc8 a2=c69808 a3=7fff2a700900 items=2 ppid=11552 pid=11623 auid=1000 uid=1000 gid=1000 euid=1000 suid=1000 fsuid=1000 egid=1000 sgid=1000 fsgid=1000 tty=pts0 ses=35 comm="ls" exe="/bin/ls" key="exec"`},
+	{1309, `audit(1459376866.885:%d): argc=3 a0="ls" a1="--color=auto" a2="-alF"`},
+	{1307, `audit(1459376866.885:%d):  cwd="/home/ubuntu/src/pauditd"`},
+	{1302, `audit(1459376866.885:%d): item=0 name="/bin/ls" inode=262316 dev=ca:01 mode=0100755 ouid=0 ogid=0 rdev=00:00 nametype=NORMAL`},
+	{1302, `audit(1459376866.885:%d): item=1 name="/lib64/ld-linux-x86-64.so.2" inode=396037 dev=ca:01 mode=0100755 ouid=0 ogid=0 rdev=00:00 nametype=NORMAL`},
+	{1320, `audit(1459376866.885:%d): `},
+}
+
+// countingWriter counts the groups written to it
+type countingWriter struct {
+	groups atomic.Int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.groups.Add(1)
+	return len(p), nil
+}
+
+// Benchmark_EndToEnd parses, groups, marshals and writes a complete execve event per
+// iteration, every event with a sequence of its own. events/s is the throughput of the
+// whole path from the netlink message to the output
+func Benchmark_EndToEnd(b *testing.B) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		b.Fatalf("Failed to configure metric: %v", err)
+	}
+
+	resolver := parser.ActiveUsernameResolver
+	parser.ActiveUsernameResolver = parser.NewCachingUsernameResolver(parser.CachingUsernameResolverConfig{})
+	defer func() { parser.ActiveUsernameResolver = resolver }()
+
+	run := func(b *testing.B, consume func(*syscall.NetlinkMessage)) {
+		prefixes := make([]string, len(endToEndRecords))
+		suffixes := make([]string, len(endToEndRecords))
+		for i, r := range endToEndRecords {
+			prefixes[i], suffixes[i], _ = strings.Cut(r.data, "%d")
+		}
+		buf := make([]byte, 0, 512)
+		msg := &syscall.NetlinkMessage{}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for n, r := range endToEndRecords {
+				// the data is copied by consume, the buffer is reused like the netlink receive buffer
+				buf = append(buf[:0], prefixes[n]...)
+				buf = strconv.AppendInt(buf, int64(i+1), 10)
+				buf = append(buf, suffixes[n]...)
+				msg.Header.Type = r.mtype
+				msg.Data = buf
+				consume(msg)
+			}
+		}
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		w := &countingWriter{}
+		m := marshaller.NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1300), uint16(1399), false, false, 1, []marshaller.AuditFilter{})
+
+		run(b, m.Consume)
+		b.ReportMetric(float64(w.groups.Load())/b.Elapsed().Seconds(), "events/s")
+		assert.Equal(b, int64(b.N), w.groups.Load())
+	})
+
+	b.Run("pipeline", func(b *testing.B) {
+		w := &countingWriter{}
+		m := marshaller.NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1300), uint16(1399), false, false, 1, []marshaller.AuditFilter{})
+		p := marshaller.NewPipeline(m, marshaller.PipelineConfig{})
+
+		run(b, p.Consume)
+		p.Close()
+		b.ReportMetric(float64(w.groups.Load())/b.Elapsed().Seconds(), "events/s")
+		assert.Equal(b, int64(b.N), w.groups.Load())
+	})
 }
 
 type noopWriter struct{}
@@ -18,6 +18,12 @@ var Endianness = binary.LittleEndian
 const (
 	// MaxAuditMessageLength see http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L398
 	MaxAuditMessageLength = 8970
+	// AuditGet is the message type used to request, and reply with, the kernel audit status
+	AuditGet = 1000
+	// AuditSet is the message type used to change the kernel audit status
+	AuditSet = 1001
+	// ReceiveTimeout bounds how long Receive blocks so the caller can notice it is time to shut down
+	ReceiveTimeout = time.Second
 )
 
 // AuditStatusPayload represents the payload for audit status
@@ -77,6 +83,12 @@ func NewNetlinkClient(recvSize int) (*NetlinkClient, error) {
 		}
 	}
 
+	// Wake up Receive periodically, a blocked recvfrom is not interrupted by closing the socket
+	timeout := syscall.NsecToTimeval(ReceiveTimeout.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		logger.Error("Failed to set receive timeout", err)
+	}
+
 	// Print the current receive buffer size
 	if v, err := syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
 		logger.Info("Socket receive buffer size:", v)
@@ -89,6 +101,7 @@ func NewNetlinkClient(recvSize int) (*NetlinkClient, error) {
 				return
 			default:
 				n.KeepConnection()
+				n.RequestStatus()
 				time.Sleep(time.Second * 5)
 			}
 		}
@@ -128,7 +141,8 @@ func (n *NetlinkClient) Send(np *NetlinkPacket, a *AuditStatusPayload) error {
 	return nil
 }
 
-// Receive will receive a packet from a netlink socket
+// Receive will receive a packet from a netlink socket. If nothing arrives within ReceiveTimeout
+// the error satisfies IsReceiveTimeout
 func (n *NetlinkClient) Receive() (*syscall.NetlinkMessage, error) {
 	nlen, _, err := syscall.Recvfrom(n.fd, n.buf, 0)
 	if err != nil {
@@ -163,7 +177,7 @@ func (n *NetlinkClient) KeepConnection() {
 	}
 
 	packet := &NetlinkPacket{
-		Type:  uint16(1001),
+		Type:  uint16(AuditSet),
 		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
 		Pid:   uint32(syscall.Getpid()),
 	}
@@ -174,6 +188,39 @@ func (n *NetlinkClient) KeepConnection() {
 	}
 }
 
+// RequestStatus asks the kernel for its audit status, the reply arrives through Receive
+// as a message of type AuditGet
+func (n *NetlinkClient) RequestStatus() {
+	packet := &NetlinkPacket{
+		Type:  uint16(AuditGet),
+		Flags: syscall.NLM_F_REQUEST,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	if err := n.Send(packet, &AuditStatusPayload{}); err != nil {
+		logger.Error("Error occurred while requesting the audit status:", err)
+	}
+}
+
+// ParseAuditStatus decodes the payload of an AuditGet reply. Older kernels send a shorter
+// struct, the missing trailing fields are left at zero
+func ParseAuditStatus(data []byte) (*AuditStatusPayload, error) {
+	status := &AuditStatusPayload{}
+	size := binary.Size(status)
+	// Everything up to and including Lost is required
+	if len(data) < 7*4 {
+		return nil, fmt.Errorf("audit status payload too short: %d bytes", len(data))
+	}
+
+	buf := make([]byte, size)
+	copy(buf, data)
+	if err := binary.Read(bytes.NewReader(buf), Endianness, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
 // Close will stop running goroutines
 func (n *NetlinkClient) Close() {
 	close(n.cancelKeepConnection)
@@ -181,3 +228,8 @@ func (n *NetlinkClient) Close() {
 		logger.Error("failed to close syscall fd:", err)
 	}
 }
+
+// IsReceiveTimeout reports whether err is Receive giving up after ReceiveTimeout without a packet
+func IsReceiveTimeout(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK)
+}
@@ -48,6 +48,38 @@ func TestNetlinkClient_KeepConnection(t *testing.T) {
 	assert.Equal(t, "Error occurred while trying to keep the connection:", logline.Msg, "Figured we would have an error")
 }
 
+func TestNetlinkClient_RequestStatus(t *testing.T) {
+	n := makeNelinkClient(t)
+
+	n.RequestStatus()
+	msg, err := n.Receive()
+	if err != nil {
+		t.Fatal("Did not expect an error", err)
+	}
+
+	assert.Equal(t, uint16(1000), msg.Header.Type, "Header.Type mismatch")
+	assert.Equal(t, uint16(1), msg.Header.Flags, "Header.Flags mismatch")
+}
+
+func TestParseAuditStatus(t *testing.T) {
+	data := make([]byte, 48)
+	binary.LittleEndian.PutUint32(data[0:4], 4)
+	binary.LittleEndian.PutUint32(data[24:28], 42)
+	status, err := ParseAuditStatus(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4), status.Mask)
+	assert.Equal(t, uint32(42), status.Lost)
+
+	// Older kernels do not send the trailing fields
+	status, err = ParseAuditStatus(data[:32])
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(42), status.Lost)
+	assert.Equal(t, uint32(0), status.BacklogWaitTime)
+
+	_, err = ParseAuditStatus(data[:20])
+	assert.EqualError(t, err, "audit status payload too short: 20 bytes")
+}
+
 func TestNetlinkClient_SendReceive(t *testing.T) {
 	var err error
 	var msg *syscall.NetlinkMessage
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pantheon-systems/pauditd/pkg/marshaller"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+// maxRecordSize is the longest line decrypt reads, groups with many messages get long
+const maxRecordSize = 16 * 1024 * 1024
+
+// runDecrypt is the decrypt command. It reads the JSON records pauditd wrote from the files in
+// args, or stdin without any, and writes them with their encrypted fields restored. Records
+// that can not be decrypted are written as they are and reported, the exit status is 1 then
+func runDecrypt(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: pauditd decrypt -key <private key file> [file ...]")
+		flags.PrintDefaults()
+	}
+	keyFile := flags.String("key", "", "PEM encoded RSA private key matching the encryption public key")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *keyFile == "" {
+		fmt.Fprintln(stderr, "A private key must be provided")
+		flags.Usage()
+		return 2
+	}
+
+	priv, err := marshaller.LoadPrivateKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	d := marshaller.NewDecryptor(priv)
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+
+	if flags.NArg() == 0 {
+		return decryptRecords(d, "stdin", stdin, out, stderr)
+	}
+
+	status := 0
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			status = 1
+			continue
+		}
+		status = max(status, decryptRecords(d, name, f, out, stderr))
+		f.Close()
+	}
+
+	return status
+}
+
+func decryptRecords(d *marshaller.Decryptor, name string, in io.Reader, out io.Writer, stderr io.Writer) int {
+	status := 0
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		record, err := decryptRecord(d, scanner.Bytes())
+		if err != nil {
+			fmt.Fprintf(stderr, "%s:%d: %s\n", name, line, err)
+			record = scanner.Bytes()
+			status = 1
+		}
+
+		if _, err := out.Write(append(record, '\n')); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+		return 1
+	}
+
+	return status
+}
+
+// decryptRecord decrypts a single record, records without encrypted fields come back unchanged
+func decryptRecord(d *marshaller.Decryptor, record []byte) ([]byte, error) {
+	group := &parser.AuditMessageGroup{}
+	if err := json.Unmarshal(record, group); err != nil {
+		return nil, err
+	}
+
+	if group.Encryption == nil {
+		return record, nil
+	}
+
+	if err := d.Decrypt(group); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(group)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pantheon-systems/pauditd/pkg/marshaller"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// createKeyPair writes a new RSA key pair to temp files and returns the public and private key files
+func createKeyPair(t *testing.T, name string) (string, string) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("Failed to generate key", err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal("Failed to marshal public key", err)
+	}
+
+	pubFile := createTempFile(t, name+".pub.pem", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})))
+	privFile := createTempFile(t, name+".pem", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})))
+	return pubFile, privFile
+}
+
+func encryptedRecord(t *testing.T, e *marshaller.Encryptor, seq int, data string) string {
+	group := &parser.AuditMessageGroup{
+		Seq:       seq,
+		AuditTime: "10000001.000",
+		RuleKey:   "db",
+		Msgs:      []*parser.AuditMessage{{Type: 1309, Data: data}},
+		UIDMap:    map[string]string{},
+	}
+	if err := e.Encrypt(group); err != nil {
+		t.Fatal("Failed to encrypt", err)
+	}
+
+	record, err := json.Marshal(group)
+	if err != nil {
+		t.Fatal("Failed to marshal", err)
+	}
+	return string(record)
+}
+
+func Test_runDecrypt(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	pubFile, privFile := createKeyPair(t, "decrypt.test")
+	otherPub, otherPriv := createKeyPair(t, "decrypt.other.test")
+	defer func() {
+		for _, f := range []string{pubFile, privFile, otherPub, otherPriv} {
+			if err := os.Remove(f); err != nil {
+				t.Errorf("Failed to remove file: %v", err)
+			}
+		}
+	}()
+
+	pub, err := marshaller.LoadPublicKey(pubFile)
+	assert.Nil(t, err)
+	rules := []marshaller.EncryptionRule{{Key: "db", Fields: []string{"a1"}}}
+	e := marshaller.NewEncryptor(pub, rules)
+
+	plain := `{"sequence":3,"timestamp":"10000001.000","messages":[{"type":1309,"data":"a0=\"ls\""}],"uid_map":{},"rule_key":"ls"}`
+	in := strings.Join([]string{
+		encryptedRecord(t, e, 1, `argc=2 a0="mysql" a1="-pSECRET"`),
+		encryptedRecord(t, e, 2, `argc=2 a0="mysql" a1="-pOTHER"`),
+		plain,
+	}, "\n") + "\n"
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Equal(t, 0, runDecrypt([]string{"-key", privFile}, strings.NewReader(in), stdout, stderr))
+	assert.Empty(t, stderr.String())
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, `{"sequence":1,"timestamp":"10000001.000","messages":[{"type":1309,"data":"argc=2 a0=\"mysql\" a1=\"-pSECRET\""}],"uid_map":{},"rule_key":"db"}`, lines[0])
+		assert.Contains(t, lines[1], `a1=\"-pOTHER\"`)
+		assert.Equal(t, plain, lines[2])
+	}
+
+	// the wrong key leaves the records encrypted and fails
+	stdout.Reset()
+	assert.Equal(t, 1, runDecrypt([]string{"-key", otherPriv}, strings.NewReader(in), stdout, stderr))
+	assert.Contains(t, stderr.String(), "stdin:1: group 1 was encrypted with key")
+	assert.Contains(t, stderr.String(), "stdin:2: group 2 was encrypted with key")
+	assert.Equal(t, in, stdout.String())
+
+	stderr.Reset()
+	assert.Equal(t, 2, runDecrypt(nil, strings.NewReader(in), stdout, stderr))
+	assert.Contains(t, stderr.String(), "A private key must be provided")
+
+	stderr.Reset()
+	assert.Equal(t, 1, runDecrypt([]string{"-key", privFile, "/does/not/exist"}, strings.NewReader(in), stdout, stderr))
+	assert.Equal(t, "open /does/not/exist: no such file or directory\n", stderr.String())
+}
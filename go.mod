@@ -1,6 +1,8 @@
 module github.com/pantheon-systems/pauditd
 
 require (
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/klauspost/compress v1.18.0
 	github.com/pantheon-systems/certinel v1.2.9
 	github.com/satori/go.uuid v1.2.0
 	github.com/spf13/viper v1.20.1
@@ -11,7 +13,6 @@ require (
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/fsnotify/fsnotify v1.8.0 // indirect
 	github.com/go-viper/mapstructure/v2 v2.2.1 // indirect
 	github.com/pelletier/go-toml/v2 v2.2.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
@@ -0,0 +1,210 @@
+package marshaller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+// aggregationPathField fingerprints on the paths of the PATH records, they are logged as name
+const aggregationPathField = "path"
+
+// AggregationConfig configures collapsing identical groups. Groups with the same values for
+// Fields within Window are written once, with the number of groups and their sequences
+type AggregationConfig struct {
+	Window    time.Duration
+	Fields    []string
+	Keys      []string // only groups with one of these rule keys are aggregated, every group when empty
+	MaxGroups int      // groups held at once, any more are written right away
+}
+
+// Validate checks the config can be used for aggregation
+func (c AggregationConfig) Validate() error {
+	if c.Window <= 0 {
+		return fmt.Errorf("aggregation window must be above 0, %v provided", c.Window)
+	}
+
+	if len(c.Fields) == 0 {
+		return fmt.Errorf("aggregation needs at least one field to fingerprint groups on")
+	}
+
+	for _, field := range c.Fields {
+		if !isFieldName(field) {
+			return fmt.Errorf("aggregation field `%s` is not a valid field name", field)
+		}
+	}
+
+	if c.MaxGroups < 1 {
+		return fmt.Errorf("aggregation max_groups must be at least 1, %d provided", c.MaxGroups)
+	}
+
+	return nil
+}
+
+// isFieldName reports whether s can be the name of an audit field
+func isFieldName(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if c != '_' && c != '.' && c != '-' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+type aggregate struct {
+	group   *parser.AuditMessageGroup // copy of the first group, counts the ones collapsed into it
+	expires time.Time
+}
+
+// aggregator holds the first group of every fingerprint until its window ends, it is shared by
+// the pipeline workers
+type aggregator struct {
+	lock    sync.Mutex
+	config  AggregationConfig
+	fields  []string        // config.Fields as they are read from the groups
+	want    map[string]bool // data fields to collect for the fingerprint
+	pending map[string]*aggregate
+}
+
+func newAggregator(config AggregationConfig) *aggregator {
+	a := &aggregator{
+		config:  config,
+		want:    make(map[string]bool, len(config.Fields)),
+		pending: make(map[string]*aggregate),
+	}
+
+	for _, field := range config.Fields {
+		if field == aggregationPathField {
+			field = "name"
+		}
+		a.fields = append(a.fields, field)
+		a.want[field] = true
+	}
+
+	return a
+}
+
+// add collapses the group into the aggregate with the same fingerprint, or starts a new one with
+// a copy of it. It returns false when the group is not aggregated and has to be written as is
+func (a *aggregator) add(msg *parser.AuditMessageGroup, now time.Time) bool {
+	if len(a.config.Keys) > 0 && !slices.ContainsFunc(a.config.Keys, msg.HasRuleKey) {
+		return false
+	}
+
+	fp := a.fingerprint(msg)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if agg, ok := a.pending[fp]; ok {
+		agg.group.Count++
+		agg.group.LastSeen = strings.Clone(msg.AuditTime)
+		agg.group.Seqs = append(agg.group.Seqs, msg.Seq)
+		metric.GetClient().Increment("aggregation.collapsed")
+		return true
+	}
+
+	if len(a.pending) >= a.config.MaxGroups {
+		metric.GetClient().Increment("aggregation.overflow")
+		return false
+	}
+
+	group := msg.Clone()
+	group.Aggregated = true
+	group.Count = 1
+	group.FirstSeen = group.AuditTime
+	group.LastSeen = group.AuditTime
+	group.Seqs = []int{group.Seq}
+	a.pending[fp] = &aggregate{group: group, expires: now.Add(a.config.Window)}
+
+	return true
+}
+
+// fingerprint joins the values of the configured fields, a field missing from the group counts
+// as a value of its own
+func (a *aggregator) fingerprint(msg *parser.AuditMessageGroup) string {
+	fields := collectFields(msg, a.want)
+
+	var b strings.Builder
+	for _, field := range a.fields {
+		for _, value := range fields.get(field) {
+			b.WriteString(value)
+			b.WriteByte(0)
+		}
+		b.WriteByte(1)
+	}
+
+	return b.String()
+}
+
+// expired removes the aggregates whose window ended, or all of them when force is set, and
+// returns their groups in sequence order. A group nothing was collapsed into is returned as it was
+func (a *aggregator) expired(now time.Time, force bool) []*parser.AuditMessageGroup {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var groups []*parser.AuditMessageGroup
+	for fp, agg := range a.pending {
+		if !force && agg.expires.After(now) {
+			continue
+		}
+
+		delete(a.pending, fp)
+		if agg.group.Count == 1 {
+			agg.group.Count = 0
+			agg.group.FirstSeen = ""
+			agg.group.LastSeen = ""
+			agg.group.Seqs = nil
+		}
+		groups = append(groups, agg.group)
+	}
+	metric.GetClient().Gauge("aggregation.pending", len(a.pending))
+
+	slices.SortFunc(groups, func(x, y *parser.AuditMessageGroup) int {
+		return x.Seq - y.Seq
+	})
+
+	return groups
+}
+
+// SetAggregation replaces the aggregation config of the marshaller, nil turns aggregation off.
+// Groups held by the previous config are written right away
+func (a *AuditMarshaller) SetAggregation(config *AggregationConfig) {
+	var agg *aggregator
+	if config != nil {
+		agg = newAggregator(*config)
+	}
+
+	if old := a.aggregator.Swap(agg); old != nil {
+		a.lock.Lock()
+		a.flushAggregates(old, true)
+		a.lock.Unlock()
+	}
+}
+
+// aggregate hands the group to the aggregator, it returns true when the group was taken and must
+// not be written
+func (a *AuditMarshaller) aggregate(msg *parser.AuditMessageGroup) bool {
+	agg := a.aggregator.Load()
+	return agg != nil && agg.add(msg, time.Now())
+}
+
+// flushAggregates writes the aggregates whose window ended. Must be called with the lock held
+func (a *AuditMarshaller) flushAggregates(agg *aggregator, force bool) {
+	if agg == nil {
+		return
+	}
+
+	for _, group := range agg.expired(time.Now(), force) {
+		a.complete(group)
+	}
+}
@@ -0,0 +1,143 @@
+package marshaller
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/output"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregationConfig_Validate(t *testing.T) {
+	valid := AggregationConfig{Window: time.Second, Fields: []string{"key", "exe", "saddr.port"}, MaxGroups: 1}
+	assert.Nil(t, valid.Validate())
+
+	c := valid
+	c.Window = 0
+	assert.EqualError(t, c.Validate(), "aggregation window must be above 0, 0s provided")
+
+	c = valid
+	c.Fields = nil
+	assert.EqualError(t, c.Validate(), "aggregation needs at least one field to fingerprint groups on")
+
+	c = valid
+	c.Fields = []string{"exe name"}
+	assert.EqualError(t, c.Validate(), "aggregation field `exe name` is not a valid field name")
+
+	c = valid
+	c.MaxGroups = 0
+	assert.EqualError(t, c.Validate(), "aggregation max_groups must be at least 1, 0 provided")
+}
+
+func aggregationGroup(seq int, auditTime string, key string, data string) *parser.AuditMessageGroup {
+	return &parser.AuditMessageGroup{
+		Seq:       seq,
+		AuditTime: auditTime,
+		RuleKey:   key,
+		Msgs: []*parser.AuditMessage{
+			{Type: 1300, Data: data},
+			{Type: 1302, Data: `item=0 name="/etc/cron.d/job" inode=1`},
+		},
+		UIDMap: map[string]string{},
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	now := time.Unix(10000000, 0)
+	a := newAggregator(AggregationConfig{Window: 10 * time.Second, Fields: []string{"key", "exe", "uid", "path"}, Keys: []string{"cron"}, MaxGroups: 2})
+
+	// only the configured keys are aggregated
+	assert.False(t, a.add(aggregationGroup(1, "10000000.000", "other", `uid=0 exe="/usr/bin/true"`), now))
+
+	assert.True(t, a.add(aggregationGroup(2, "10000000.000", "cron", `uid=0 exe="/usr/bin/true"`), now))
+	assert.True(t, a.add(aggregationGroup(3, "10000001.000", "cron", `uid=0 exe="/usr/bin/true"`), now.Add(time.Second)))
+	assert.True(t, a.add(aggregationGroup(5, "10000002.000", "cron", `uid=0 exe="/usr/bin/true"`), now.Add(2*time.Second)))
+
+	// a different value starts another aggregate, the table is full after that
+	assert.True(t, a.add(aggregationGroup(4, "10000002.000", "cron", `uid=1000 exe="/usr/bin/true"`), now.Add(2*time.Second)))
+	assert.False(t, a.add(aggregationGroup(6, "10000002.000", "cron", `uid=1001 exe="/usr/bin/true"`), now.Add(2*time.Second)))
+
+	assert.Empty(t, a.expired(now.Add(9*time.Second), false))
+
+	groups := a.expired(now.Add(10*time.Second), false)
+	if assert.Len(t, groups, 1) {
+		assert.Equal(t, 2, groups[0].Seq)
+		assert.Equal(t, 3, groups[0].Count)
+		assert.Equal(t, "10000000.000", groups[0].FirstSeen)
+		assert.Equal(t, "10000002.000", groups[0].LastSeen)
+		assert.Equal(t, []int{2, 3, 5}, groups[0].Seqs)
+		assert.True(t, groups[0].Aggregated)
+	}
+
+	// a group that nothing was collapsed into looks like it was never held
+	groups = a.expired(now, true)
+	if assert.Len(t, groups, 1) {
+		assert.Equal(t, 4, groups[0].Seq)
+		assert.Equal(t, 0, groups[0].Count)
+		assert.Equal(t, "", groups[0].FirstSeen)
+		assert.Nil(t, groups[0].Seqs)
+	}
+	assert.Empty(t, a.pending)
+}
+
+func TestAuditMarshaller_aggregation(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+	m.SetAggregation(&AggregationConfig{Window: time.Hour, Fields: []string{"key", "exe"}, MaxGroups: 10})
+
+	for seq := 1; seq <= 3; seq++ {
+		s := strconv.Itoa(seq)
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(1000000" + s + ".000:" + s + `): syscall=59 exe="/usr/bin/health" key="check"`),
+		})
+		m.Consume(new1320(s))
+	}
+	assert.Equal(t, 0, w.Len(), "groups are held until the window ends")
+
+	// flushing writes the aggregate and it is not aggregated again
+	m.Flush()
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	if assert.Len(t, lines, 1) {
+		group := parser.AuditMessageGroup{}
+		assert.Nil(t, json.Unmarshal([]byte(lines[0]), &group))
+		assert.Equal(t, 1, group.Seq)
+		assert.Equal(t, 3, group.Count)
+		assert.Equal(t, "10000001.000", group.FirstSeen)
+		assert.Equal(t, "10000003.000", group.LastSeen)
+		assert.Equal(t, []int{1, 2, 3}, group.Seqs)
+	}
+	assert.Contains(t, lines[0], `"count":3,"first_seen":"10000001.000","last_seen":"10000003.000","seqs":[1,2,3]`)
+
+	// turning aggregation off writes whatever is held
+	w.Reset()
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte(`audit(10000004.000:4): syscall=59 exe="/usr/bin/health" key="check"`),
+	})
+	m.Consume(new1320("4"))
+	assert.Equal(t, 0, w.Len())
+	m.SetAggregation(nil)
+	assert.Contains(t, w.String(), `"sequence":4`)
+	assert.NotContains(t, w.String(), `"count"`)
+}
@@ -5,35 +5,90 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/output"
 )
 
-// FilterAction represents the action to take on an audit message (keep or drop).
-type FilterAction bool
+// FilterAction represents the action to take on a matching audit message group. Keep and drop
+// decide the outcome, the other actions change the group and let the following filters run
+type FilterAction int
 
 // Constants defining possible filter actions.
 const (
-	Keep FilterAction = false // Keep the audit message.
-	Drop FilterAction = true  // Drop the audit message.
+	Keep   FilterAction = iota // Keep the audit message.
+	Drop                       // Drop the audit message.
+	Tag                        // Add tags and a severity to the audit message.
+	Redact                     // Replace matching text in the audit message.
+	Sample                     // Keep a percentage of the matching audit messages, drop the rest.
+	Route                      // Only write the audit message to the named outputs.
 )
 
+var filterActionNames = map[FilterAction]string{
+	Keep:   "keep",
+	Drop:   "drop",
+	Tag:    "tag",
+	Redact: "redact",
+	Sample: "sample",
+	Route:  "route",
+}
+
+// FilterMode decides whether the action of a matching filter is applied
+type FilterMode string
+
+// Constants defining possible filter modes.
+const (
+	Enforce FilterMode = "enforce" // Apply the action of the filter.
+	DryRun  FilterMode = "dry_run" // Only annotate matching audit messages with the filter ID.
+)
+
+var filterIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// RedactedText replaces the text matched by a redact filter
+const RedactedText = "[REDACTED]"
+
 func (f FilterAction) String() string {
-	if f == Keep {
-		return "keep"
+	return filterActionNames[f]
+}
+
+// verb is used when logging the configured filters
+func (f FilterAction) verb() string {
+	switch f {
+	case Keep:
+		return "keeping"
+	case Drop:
+		return "droping"
+	case Tag:
+		return "tagging"
+	case Redact:
+		return "redacting"
+	case Sample:
+		return "sampling"
 	}
 
-	return "drop"
+	return "routing"
 }
 
 // AuditFilter represents a filter for audit messages.
 type AuditFilter struct {
+	ID          string // names the filter in metrics and dry run annotations
+	Mode        FilterMode
 	MessageType uint16
 	Regex       *regexp.Regexp
 	Syscall     string
 	Key         string
+	Expression  *Expression // evaluated over the parsed fields of the group instead of Regex
 	Action      FilterAction
+	Tags        []string       // added by Tag
+	Severity    string         // set by Tag
+	RedactRegex *regexp.Regexp // text replaced by Redact, defaults to Regex
+	SampleRate  float64        // percentage of the matching groups kept by Sample
+	Outputs     []string       // outputs the matching groups are written to by Route
+
+	matchedMetric string
 }
 
 // NewAuditFilter creates a new AuditFilter based on the provided rule number and configuration object.
@@ -45,24 +100,75 @@ func NewAuditFilter(ruleNumber int, obj map[string]interface{}) (*AuditFilter, e
 		return nil, err
 	}
 
+	if af.ID == "" {
+		af.ID = defaultFilterID(ruleNumber)
+	}
+
+	if err = validateAction(ruleNumber, af); err != nil {
+		return nil, err
+	}
+
+	if af.Expression != nil {
+		if af.Regex != nil || af.Key != "" || af.Syscall != "" || af.MessageType != 0 {
+			return nil, fmt.Errorf("filter %d can not combine `expression` with `regex`, `key`, `syscall` or `message_type`", ruleNumber)
+		}
+
+		logger.Info(fmt.Sprintf("%s messages matching expression `%s`\n", af.Action.verb(), af.Expression), "id", af.ID, "mode", af.Mode)
+		return af, nil
+	}
+
 	if af.Regex == nil {
 		return nil, fmt.Errorf("filter %d is missing the `regex` entry", ruleNumber)
 	}
 
-	logMsg := fmt.Sprintf("%sing messages with key `%s` matching string `%s`\n", af.Action, af.Key, af.Regex.String())
+	if af.Action == Redact && af.RedactRegex == nil {
+		af.RedactRegex = af.Regex
+	}
+
+	logMsg := fmt.Sprintf("%s messages with key `%s` matching string `%s`\n", af.Action.verb(), af.Key, af.Regex.String())
 	if af.Key == "" {
 		if af.MessageType == 0 {
 			return nil, fmt.Errorf("filter %d is missing either the `key` entry or `syscall` and `message_type` entry", ruleNumber)
 		}
 
-		logMsg = fmt.Sprintf("%sing syscall `%v` containing message type `%v` matching string `%s`\n", af.Action, af.Syscall, af.MessageType, af.Regex.String())
+		logMsg = fmt.Sprintf("%s syscall `%v` containing message type `%v` matching string `%s`\n", af.Action.verb(), af.Syscall, af.MessageType, af.Regex.String())
 	}
-	logger.Info(logMsg)
+	logger.Info(logMsg, "id", af.ID, "mode", af.Mode)
 	return af, nil
 }
 
+// validateAction checks the entries the action needs are there
+func validateAction(ruleNumber int, af *AuditFilter) error {
+	switch af.Action {
+	case Tag:
+		if len(af.Tags) == 0 && af.Severity == "" {
+			return fmt.Errorf("filter %d has the `tag` action but neither `tags` nor `severity`", ruleNumber)
+		}
+	case Redact:
+		if af.RedactRegex == nil && af.Expression != nil {
+			return fmt.Errorf("filter %d has the `redact` action but is missing the `redact` entry", ruleNumber)
+		}
+	case Sample:
+		if af.SampleRate < 0 || af.SampleRate > 100 {
+			return fmt.Errorf("`sample_rate` in filter %d must be between 0 and 100; Value: `%v`", ruleNumber, af.SampleRate)
+		}
+	case Route:
+		if len(af.Outputs) == 0 {
+			return fmt.Errorf("filter %d has the `route` action but is missing the `output` entry", ruleNumber)
+		}
+		for _, name := range af.Outputs {
+			if !slices.Contains(output.GetAvailableAuditWriters(), name) {
+				return fmt.Errorf("`output` in filter %d is not a known output; Value: `%s`", ruleNumber, name)
+			}
+		}
+	}
+
+	return nil
+}
+
 func parse(ruleNumber int, obj map[string]interface{}) (*AuditFilter, error) {
 	af := &AuditFilter{
+		Mode:   Enforce,
 		Action: Drop,
 	}
 
@@ -73,12 +179,28 @@ func parse(ruleNumber int, obj map[string]interface{}) (*AuditFilter, error) {
 			err = parseMessageType(ruleNumber, v, af)
 		case "regex":
 			err = parseRegex(ruleNumber, v, af)
+		case "expression":
+			err = parseExpression(ruleNumber, v, af)
 		case "syscall":
 			err = parseSyscall(ruleNumber, v, af)
 		case "key":
 			err = parseKey(ruleNumber, v, af)
+		case "id":
+			err = parseID(ruleNumber, v, af)
+		case "mode":
+			err = parseMode(ruleNumber, v, af)
 		case "action":
 			err = parseAction(ruleNumber, v, af)
+		case "tags":
+			af.Tags, err = parseStrings(ruleNumber, k, v)
+		case "severity":
+			af.Severity, err = parseString(ruleNumber, k, v)
+		case "redact":
+			err = parseRedact(ruleNumber, v, af)
+		case "sample_rate":
+			err = parseSampleRate(ruleNumber, v, af)
+		case "output":
+			af.Outputs, err = parseStrings(ruleNumber, k, v)
 		}
 		if err != nil {
 			return nil, err
@@ -117,6 +239,18 @@ func parseRegex(ruleNumber int, v interface{}, af *AuditFilter) error {
 	return nil
 }
 
+func parseExpression(ruleNumber int, v interface{}, af *AuditFilter) error {
+	expr, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("`expression` in filter %d could not be parsed; Value: `%+v`", ruleNumber, v)
+	}
+	var err error
+	if af.Expression, err = CompileExpression(expr); err != nil {
+		return fmt.Errorf("`expression` in filter %d could not be parsed; Value: `%+v`; Error: %s", ruleNumber, v, err)
+	}
+	return nil
+}
+
 func parseSyscall(ruleNumber int, v interface{}, af *AuditFilter) error {
 	if syscall, ok := v.(string); ok {
 		af.Syscall = syscall
@@ -141,12 +275,94 @@ func parseKey(ruleNumber int, v interface{}, af *AuditFilter) error {
 
 func parseAction(ruleNumber int, v interface{}, af *AuditFilter) error {
 	action, ok := v.(string)
-	if !ok || (action != "keep" && action != "drop") {
-		return fmt.Errorf("`action` in filter %d could not be parsed; Value: `%+v`", ruleNumber, v)
+	if ok {
+		for fa, name := range filterActionNames {
+			if name == action {
+				af.Action = fa
+				return nil
+			}
+		}
 	}
-	af.Action = Drop
-	if action == "keep" {
-		af.Action = Keep
+	return fmt.Errorf("`action` in filter %d could not be parsed; Value: `%+v`", ruleNumber, v)
+}
+
+func parseID(ruleNumber int, v interface{}, af *AuditFilter) error {
+	id, ok := v.(string)
+	if !ok || !filterIDPattern.MatchString(id) {
+		return fmt.Errorf("`id` in filter %d could not be parsed, only letters, digits, _ and - are allowed; Value: `%+v`", ruleNumber, v)
+	}
+	af.ID = id
+	return nil
+}
+
+func parseMode(ruleNumber int, v interface{}, af *AuditFilter) error {
+	mode, ok := v.(string)
+	if !ok || (FilterMode(mode) != Enforce && FilterMode(mode) != DryRun) {
+		return fmt.Errorf("`mode` in filter %d could not be parsed; Value: `%+v`", ruleNumber, v)
 	}
+	af.Mode = FilterMode(mode)
 	return nil
 }
+
+// defaultFilterID names filters configured without an id by their position
+func defaultFilterID(ruleNumber int) string {
+	return "filter_" + strconv.Itoa(ruleNumber)
+}
+
+func parseRedact(ruleNumber int, v interface{}, af *AuditFilter) error {
+	re, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("`redact` in filter %d could not be parsed; Value: `%+v`", ruleNumber, v)
+	}
+	var err error
+	if af.RedactRegex, err = regexp.Compile(re); err != nil {
+		return fmt.Errorf("`redact` in filter %d could not be parsed; Value: `%+v`; Error: %s", ruleNumber, v, err)
+	}
+	return nil
+}
+
+func parseSampleRate(ruleNumber int, v interface{}, af *AuditFilter) error {
+	switch rate := v.(type) {
+	case int:
+		af.SampleRate = float64(rate)
+	case float64:
+		af.SampleRate = rate
+	case string:
+		var err error
+		if af.SampleRate, err = strconv.ParseFloat(strings.TrimSuffix(rate, "%"), 64); err != nil {
+			return fmt.Errorf("`sample_rate` in filter %d could not be parsed; Value: `%+v`; Error: %s", ruleNumber, v, err)
+		}
+	default:
+		return fmt.Errorf("`sample_rate` in filter %d could not be parsed; Value: `%+v`", ruleNumber, v)
+	}
+	return nil
+}
+
+func parseString(ruleNumber int, name string, v interface{}) (string, error) {
+	value, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("`%s` in filter %d could not be parsed; Value: `%+v`", name, ruleNumber, v)
+	}
+	return value, nil
+}
+
+// parseStrings accepts a single string or a list of strings
+func parseStrings(ruleNumber int, name string, v interface{}) ([]string, error) {
+	switch value := v.(type) {
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("`%s` in filter %d could not be parsed; Value: `%+v`", name, ruleNumber, v)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	case []string:
+		return value, nil
+	}
+	return nil, fmt.Errorf("`%s` in filter %d could not be parsed; Value: `%+v`", name, ruleNumber, v)
+}
@@ -0,0 +1,385 @@
+package marshaller
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+const (
+	// EncryptedPrefix starts every encrypted field value
+	EncryptedPrefix = "enc:"
+	// dataKeySize is the size of the AES-256 key every record is encrypted with
+	dataKeySize = 32
+)
+
+// dataKeyLabel binds the wrapped data keys to their use
+var dataKeyLabel = []byte("pauditd data key")
+
+// EncryptionRule selects the fields encrypted in the groups with a rule key. Fields are names,
+// glob patterns like `a*` or ExecveArgsField for every execve argument
+type EncryptionRule struct {
+	Key    string
+	Fields []string
+}
+
+// NewEncryptionRule creates an encryption rule from a config entry
+func NewEncryptionRule(ruleNumber int, obj map[string]interface{}) (*EncryptionRule, error) {
+	er := &EncryptionRule{}
+
+	for k, v := range obj {
+		switch k {
+		case "key":
+			key, ok := v.(string)
+			if !ok || key == "" {
+				return nil, fmt.Errorf("`key` in encryption rule %d could not be parsed; Value: `%+v`", ruleNumber, v)
+			}
+			er.Key = key
+		case "fields":
+			fields, err := parseFieldList(fmt.Sprintf("encryption rule %d", ruleNumber), v)
+			if err != nil {
+				return nil, err
+			}
+			er.Fields = fields
+		}
+	}
+
+	if er.Key == "" {
+		return nil, fmt.Errorf("encryption rule %d is missing the `key` entry", ruleNumber)
+	}
+
+	if len(er.Fields) == 0 {
+		return nil, fmt.Errorf("encryption rule %d is missing the `fields` entry", ruleNumber)
+	}
+
+	return er, nil
+}
+
+// Encryptor encrypts selected fields of a group with a data key of its own. The data key is
+// encrypted with the public key and travels with the group
+type Encryptor struct {
+	pub    *rsa.PublicKey
+	keyID  string
+	rules  []EncryptionRule
+	fields []fieldSelector // the fields of every rule
+}
+
+// NewEncryptor creates an encryptor for the rules
+func NewEncryptor(pub *rsa.PublicKey, rules []EncryptionRule) *Encryptor {
+	e := &Encryptor{pub: pub, keyID: KeyID(pub), rules: rules}
+	for _, rule := range rules {
+		e.fields = append(e.fields, newFieldSelector(rule.Fields))
+		logger.Info("Encrypting message fields", "key", rule.Key, "fields", rule.Fields, "key_id", e.keyID)
+	}
+	return e
+}
+
+// KeyID identifies a public key, it is the start of the SHA-256 of the key
+func KeyID(pub *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Encrypt encrypts the fields the rules select for the rule keys of the group. Nothing is added
+// to the group when none of the fields are in it
+func (e *Encryptor) Encrypt(msg *parser.AuditMessageGroup) error {
+	var fields []fieldSelector
+	for i, rule := range e.rules {
+		if msg.HasRuleKey(rule.Key) {
+			fields = append(fields, e.fields[i])
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	selected := func(name string) bool {
+		for _, f := range fields {
+			if f.has(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var aead cipher.AEAD
+	var dataKey []byte
+	for _, am := range msg.Msgs {
+		var b strings.Builder
+		var err error
+		last := 0
+		walkFields(am.Data, func(name string, start, end int, quoted bool) {
+			if err != nil || !selected(name) {
+				return
+			}
+
+			if aead == nil {
+				if dataKey, aead, err = newDataKey(); err != nil {
+					return
+				}
+			}
+
+			// the value is kept with its quotes so decrypting restores the message as it was
+			if quoted {
+				start, end = start-1, end+1
+			}
+			b.WriteString(am.Data[last:start])
+			b.WriteString(seal(aead, name, am.Data[start:end]))
+			last = end
+		})
+		if err != nil {
+			return err
+		}
+
+		if last > 0 {
+			b.WriteString(am.Data[last:])
+			am.Data = b.String()
+		}
+	}
+
+	if dataKey == nil {
+		return nil
+	}
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, e.pub, dataKey, dataKeyLabel)
+	if err != nil {
+		return err
+	}
+
+	msg.Encryption = &parser.Envelope{
+		KeyID:   e.keyID,
+		DataKey: base64.StdEncoding.EncodeToString(wrapped),
+	}
+	metric.GetClient().Increment("encryption.encrypted")
+
+	return nil
+}
+
+func newDataKey() ([]byte, cipher.AEAD, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newAEAD(key)
+	return key, aead, err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the raw value of a field, the field name is authenticated with it so values
+// can not be moved between fields
+func seal(aead cipher.AEAD, name string, value string) string {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	_, _ = rand.Read(nonce)
+
+	return EncryptedPrefix + base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(value), []byte(name)))
+}
+
+// Decryptor restores the fields encrypted by an Encryptor with the matching private key
+type Decryptor struct {
+	priv  *rsa.PrivateKey
+	keyID string
+}
+
+// NewDecryptor creates a decryptor for the groups encrypted with the public part of priv
+func NewDecryptor(priv *rsa.PrivateKey) *Decryptor {
+	return &Decryptor{priv: priv, keyID: KeyID(&priv.PublicKey)}
+}
+
+// Decrypt restores the encrypted fields of the group and removes its envelope, groups without an
+// envelope are left alone
+func (d *Decryptor) Decrypt(msg *parser.AuditMessageGroup) error {
+	if msg.Encryption == nil {
+		return nil
+	}
+
+	if msg.Encryption.KeyID != d.keyID {
+		return fmt.Errorf("group %d was encrypted with key %s, not %s", msg.Seq, msg.Encryption.KeyID, d.keyID)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(msg.Encryption.DataKey)
+	if err != nil {
+		return fmt.Errorf("group %d has an invalid data key: %w", msg.Seq, err)
+	}
+
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, d.priv, wrapped, dataKeyLabel)
+	if err != nil {
+		return fmt.Errorf("group %d has a data key that can not be decrypted: %w", msg.Seq, err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	for _, am := range msg.Msgs {
+		var b strings.Builder
+		last := 0
+		walkFields(am.Data, func(name string, start, end int, quoted bool) {
+			value := am.Data[start:end]
+			if err != nil || quoted || !strings.HasPrefix(value, EncryptedPrefix) {
+				return
+			}
+
+			var plain string
+			if plain, err = open(aead, name, value); err != nil {
+				err = fmt.Errorf("group %d field %s could not be decrypted: %w", msg.Seq, name, err)
+				return
+			}
+			b.WriteString(am.Data[last:start])
+			b.WriteString(plain)
+			last = end
+		})
+		if err != nil {
+			return err
+		}
+
+		if last > 0 {
+			b.WriteString(am.Data[last:])
+			am.Data = b.String()
+		}
+	}
+
+	msg.Encryption = nil
+	return nil
+}
+
+func open(aead cipher.AEAD, name string, value string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, EncryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("value is too short")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// LoadPublicKey reads a PEM encoded RSA public key file, see ParsePublicKey
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pub, nil
+}
+
+// ParsePublicKey parses a PEM encoded RSA public key, either PKIX, PKCS #1 or a certificate
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return pub, nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key file, either PKCS #8 or PKCS #1
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded private key found", path)
+	}
+
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to parse private key: %w", path, err)
+	}
+
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key is not an RSA key", path)
+	}
+	return priv, nil
+}
+
+// SetEncryptor replaces the encryptor of the marshaller, nil turns encryption off
+func (a *AuditMarshaller) SetEncryptor(e *Encryptor) {
+	a.encryptor.Store(e)
+}
+
+// encrypt encrypts the selected fields of the group when encryption is on. A group that can not
+// be encrypted is not written
+func (a *AuditMarshaller) encrypt(msg *parser.AuditMessageGroup) bool {
+	e := a.encryptor.Load()
+	if e == nil {
+		return true
+	}
+
+	if err := e.Encrypt(msg); err != nil {
+		logger.Error("Failed to encrypt message, dropping it", "error", err, "seq", msg.Seq)
+		metric.GetClient().Increment("encryption.failed")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,255 @@
+package marshaller
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/output"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// encryptionKey returns a key shared by the tests, generating one for every test is slow
+func encryptionKey(t *testing.T) *rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+	})
+	return testKey
+}
+
+func encryptionGroup(key string, data ...string) *parser.AuditMessageGroup {
+	group := &parser.AuditMessageGroup{Seq: 1, RuleKey: key, RuleKeys: []string{key}}
+	for _, d := range data {
+		group.Msgs = append(group.Msgs, &parser.AuditMessage{Type: 1309, Data: d})
+	}
+	return group
+}
+
+func TestEncryptor(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	priv := encryptionKey(t)
+	e := NewEncryptor(&priv.PublicKey, []EncryptionRule{
+		{Key: "db", Fields: []string{"a1"}},
+		{Key: "db", Fields: []string{"proctitle"}},
+		{Key: "other", Fields: []string{"a0"}},
+	})
+
+	data := []string{
+		`argc=3 a0="mysql" a1="-pSECRET" a2="db"`,
+		`proctitle=6D7973716C002D70534543524554`,
+		`pid=1 msg='op=login a1=x res=1'`,
+	}
+	group := encryptionGroup("db", data...)
+	assert.Nil(t, e.Encrypt(group))
+
+	if assert.NotNil(t, group.Encryption) {
+		assert.Equal(t, KeyID(&priv.PublicKey), group.Encryption.KeyID)
+		assert.NotEmpty(t, group.Encryption.DataKey)
+	}
+	assert.Regexp(t, `^argc=3 a0="mysql" a1=enc:[A-Za-z0-9_-]+ a2="db"$`, group.Msgs[0].Data)
+	assert.Regexp(t, `^proctitle=enc:[A-Za-z0-9_-]+$`, group.Msgs[1].Data)
+	assert.Regexp(t, `^pid=1 msg='op=login a1=enc:[A-Za-z0-9_-]+ res=1'$`, group.Msgs[2].Data)
+
+	// decrypting restores the messages exactly as they were
+	d := NewDecryptor(priv)
+	assert.Nil(t, d.Decrypt(group))
+	assert.Nil(t, group.Encryption)
+	for i, am := range group.Msgs {
+		assert.Equal(t, data[i], am.Data)
+	}
+
+	// groups without a selected field get no envelope
+	group = encryptionGroup("db", `argc=1 a0="ls"`)
+	assert.Nil(t, e.Encrypt(group))
+	assert.Nil(t, group.Encryption)
+	assert.Equal(t, `argc=1 a0="ls"`, group.Msgs[0].Data)
+
+	group = encryptionGroup("unrelated", `argc=2 a0="mysql" a1="-pSECRET"`)
+	assert.Nil(t, e.Encrypt(group))
+	assert.Nil(t, group.Encryption)
+}
+
+func TestEncryptor_fieldPatterns(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	priv := encryptionKey(t)
+	// an execve record with more arguments than a list of names would have covered
+	data := `argc=6 a0="mysql" a1="-u" a2="root" a3="-pSECRET" a4=2D2D65786563757465 a5_len=3 a5[0]="USE"`
+
+	for _, fields := range [][]string{{ExecveArgsField}, {"a[0-9]*"}} {
+		e := NewEncryptor(&priv.PublicKey, []EncryptionRule{{Key: "db", Fields: fields}})
+		group := encryptionGroup("db", data)
+		assert.Nil(t, e.Encrypt(group))
+		assert.Regexp(t, `^argc=6 a0=enc:\S+ a1=enc:\S+ a2=enc:\S+ a3=enc:\S+ a4=enc:\S+ a5_len=\S+ a5\[0\]=enc:\S+$`, group.Msgs[0].Data, fields)
+		assert.NotContains(t, group.Msgs[0].Data, "SECRET")
+
+		assert.Nil(t, NewDecryptor(priv).Decrypt(group))
+		assert.Equal(t, data, group.Msgs[0].Data)
+	}
+
+	// argc is not an argument
+	e := NewEncryptor(&priv.PublicKey, []EncryptionRule{{Key: "db", Fields: []string{ExecveArgsField}}})
+	group := encryptionGroup("db", data)
+	assert.Nil(t, e.Encrypt(group))
+	assert.Contains(t, group.Msgs[0].Data, "argc=6 ")
+}
+
+func TestDecryptor_errors(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	priv := encryptionKey(t)
+	e := NewEncryptor(&priv.PublicKey, []EncryptionRule{{Key: "db", Fields: []string{"a1", "a2"}}})
+	d := NewDecryptor(priv)
+
+	group := encryptionGroup("db", `a1="one" a2="two"`)
+	assert.Nil(t, e.Encrypt(group))
+
+	// another key is refused before anything is tried
+	other := *group.Encryption
+	other.KeyID = "0000000000000000"
+	group.Encryption = &other
+	assert.EqualError(t, d.Decrypt(group), "group 1 was encrypted with key 0000000000000000, not "+KeyID(&priv.PublicKey))
+
+	// values moved to another field do not decrypt
+	group = encryptionGroup("db", `a1="one" a2="two"`)
+	assert.Nil(t, e.Encrypt(group))
+	var a1, a2 string
+	walkFields(group.Msgs[0].Data, func(name string, start, end int, quoted bool) {
+		if name == "a1" {
+			a1 = group.Msgs[0].Data[start:end]
+		} else {
+			a2 = group.Msgs[0].Data[start:end]
+		}
+	})
+	group.Msgs[0].Data = "a1=" + a2 + " a2=" + a1
+	assert.ErrorContains(t, d.Decrypt(group), "group 1 field a1 could not be decrypted")
+}
+
+func TestNewEncryptionRule(t *testing.T) {
+	er, err := NewEncryptionRule(1, map[string]interface{}{"key": "exec", "fields": []interface{}{"a1", "proctitle"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "exec", er.Key)
+	assert.Equal(t, []string{"a1", "proctitle"}, er.Fields)
+
+	er, err = NewEncryptionRule(1, map[string]interface{}{"key": "exec", "fields": []interface{}{"execve.args", "a*"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"execve.args", "a*"}, er.Fields)
+
+	tests := []struct {
+		obj map[string]interface{}
+		err string
+	}{
+		{map[string]interface{}{"fields": "a1"}, "encryption rule 1 is missing the `key` entry"},
+		{map[string]interface{}{"key": "exec"}, "encryption rule 1 is missing the `fields` entry"},
+		{map[string]interface{}{"key": 1, "fields": "a1"}, "`key` in encryption rule 1 could not be parsed; Value: `1`"},
+		{map[string]interface{}{"key": "exec", "fields": []interface{}{"a 1"}}, "`fields` in encryption rule 1 could not be parsed, `a 1` is not a field name"},
+		{map[string]interface{}{"key": "exec", "fields": []interface{}{"a[0-9"}}, "`fields` in encryption rule 1 could not be parsed, `a[0-9` is not a field name"},
+	}
+	for _, tt := range tests {
+		_, err := NewEncryptionRule(1, tt.obj)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	priv := encryptionKey(t)
+	dir := t.TempDir()
+
+	write := func(name string, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+
+	pkix, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	assert.Nil(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(priv)
+	assert.Nil(t, err)
+
+	for _, path := range []string{
+		write("pkix.pem", "PUBLIC KEY", pkix),
+		write("pkcs1.pem", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&priv.PublicKey)),
+	} {
+		pub, err := LoadPublicKey(path)
+		assert.Nil(t, err, path)
+		assert.True(t, priv.PublicKey.Equal(pub), path)
+	}
+
+	for _, path := range []string{
+		write("pkcs8.pem", "PRIVATE KEY", pkcs8),
+		write("pkcs1-private.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv)),
+	} {
+		key, err := LoadPrivateKey(path)
+		assert.Nil(t, err, path)
+		assert.True(t, priv.Equal(key), path)
+	}
+
+	_, err = ParsePublicKey([]byte("not a key"))
+	assert.EqualError(t, err, "no PEM encoded public key found")
+
+	_, err = LoadPrivateKey(write("garbage.pem", "PRIVATE KEY", []byte("garbage")))
+	assert.ErrorContains(t, err, "garbage.pem: failed to parse private key")
+}
+
+func TestAuditMarshaller_encryption(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	priv := encryptionKey(t)
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+	m.SetEncryptor(NewEncryptor(&priv.PublicKey, []EncryptionRule{{Key: "db", Fields: []string{"a1"}}}))
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte(`audit(10000001.000:1): syscall=59 key="db"`),
+	})
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1309)},
+		Data:   []byte(`audit(10000001.000:1): argc=2 a0="mysql" a1="-pSECRET"`),
+	})
+	m.Consume(new1320("1"))
+
+	assert.NotContains(t, w.String(), "SECRET")
+	assert.Contains(t, w.String(), `"encryption":{"key_id":"`+KeyID(&priv.PublicKey)+`","data_key":"`)
+
+	group := &parser.AuditMessageGroup{}
+	assert.Nil(t, json.Unmarshal(w.Bytes(), group))
+	assert.Nil(t, NewDecryptor(priv).Decrypt(group))
+	assert.Equal(t, `argc=2 a0="mysql" a1="-pSECRET"`, group.Msgs[1].Data)
+}
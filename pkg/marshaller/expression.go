@@ -0,0 +1,664 @@
+package marshaller
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+// Expression is a filter expression over the parsed fields of a message group, e.g.
+//
+//	syscall == "connect" && saddr.port == 443 && auid != 4294967295
+//	exe in ["/usr/bin/curl", "/usr/bin/wget"]
+//
+// Fields are the name=value pairs found in any message of the group plus a few derived ones:
+// key (every rule key of the group), syscall (names are translated to the local syscall number),
+// type (the message types in the group) and saddr.family, saddr.port, saddr.addr and saddr.path
+// decoded from the SOCKADDR record. A field can appear more than once in a group, a comparison is
+// true when any occurrence satisfies it and a field missing from the group never matches.
+// Operators are ==, !=, <, <=, >, >=, =~ and !~ (regular expressions), in, !, && and ||.
+// A bare field name tests whether the field is present
+type Expression struct {
+	source string
+	root   exprNode
+	fields map[string]bool // data fields the expression reads, collected in a single pass
+}
+
+// Fields that are not read from the message data as is
+const (
+	exprFieldKey     = "key"
+	exprFieldSyscall = "syscall"
+	exprFieldType    = "type"
+	exprFieldSaddr   = "saddr"
+)
+
+// encodedFields may be hex encoded by the kernel when the value contains spaces or control characters
+var encodedFields = map[string]bool{
+	"acct":      true,
+	"cmd":       true,
+	"comm":      true,
+	"cwd":       true,
+	"data":      true,
+	"exe":       true,
+	"name":      true,
+	"path":      true,
+	"proctitle": true,
+}
+
+var saddrFields = map[string]bool{
+	"saddr.family": true,
+	"saddr.port":   true,
+	"saddr.addr":   true,
+	"saddr.path":   true,
+}
+
+// CompileExpression parses an expression, it is compiled once and can be matched concurrently
+func CompileExpression(source string) (*Expression, error) {
+	p := &exprParser{lexer: &exprLexer{src: source}, fields: make(map[string]bool)}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at offset %d", p.tok, p.tok.pos)
+	}
+
+	return &Expression{source: source, root: root, fields: p.fields}, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Match reports whether the message group satisfies the expression
+func (e *Expression) Match(msg *parser.AuditMessageGroup) bool {
+	return e.root.eval(collectFields(msg, e.fields))
+}
+
+// fieldSet holds the values of the fields read by a set of expressions for one message group.
+// Values may point into the group's pooled buffers and must not outlive the evaluation
+type fieldSet struct {
+	group  *parser.AuditMessageGroup
+	values map[string][]string
+}
+
+func (f *fieldSet) get(name string) []string {
+	switch name {
+	case exprFieldKey:
+		keys := f.group.RuleKeys
+		if len(keys) == 0 && f.group.RuleKey != "" && f.group.RuleKey != parser.NullRuleKey {
+			keys = []string{f.group.RuleKey}
+		}
+		return keys
+	case exprFieldSyscall:
+		if f.group.Syscall == "" {
+			return nil
+		}
+		return []string{f.group.Syscall}
+	case exprFieldType:
+		types := make([]string, len(f.group.Msgs))
+		for i, am := range f.group.Msgs {
+			types[i] = strconv.Itoa(int(am.Type))
+		}
+		return types
+	}
+
+	return f.values[name]
+}
+
+// collectFields reads the wanted fields out of every message of the group
+func collectFields(msg *parser.AuditMessageGroup, want map[string]bool) *fieldSet {
+	f := &fieldSet{group: msg, values: make(map[string][]string, len(want))}
+	if len(want) == 0 {
+		return f
+	}
+
+	for _, am := range msg.Msgs {
+		scanFields(am.Data, want, f.values)
+	}
+
+	if want[exprFieldSaddr] {
+		for _, saddr := range f.values[exprFieldSaddr] {
+			decodeSockaddr(saddr, f.values)
+		}
+	}
+
+	return f
+}
+
+// scanFields appends the values of the wanted name=value pairs in data to out. Single quoted
+// values, like msg='...' in user space messages, are scanned for nested fields as well
+func scanFields(data string, want map[string]bool, out map[string][]string) {
+	isSep := func(c byte) bool {
+		// 0x1d separates the enriched fields when auditd's log_format is ENRICHED
+		return c == ' ' || c == '\x1d'
+	}
+
+	for i := 0; i < len(data); {
+		if isSep(data[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(data) && data[i] != '=' && !isSep(data[i]) {
+			i++
+		}
+		if i >= len(data) || data[i] != '=' {
+			// a word without a value
+			continue
+		}
+		name := data[start:i]
+		i++
+
+		var value string
+		var quote byte
+		if i < len(data) && (data[i] == '"' || data[i] == '\'') {
+			quote = data[i]
+			end := strings.IndexByte(data[i+1:], quote)
+			if end < 0 {
+				value, i = data[i+1:], len(data)
+			} else {
+				value, i = data[i+1:i+1+end], i+2+end
+			}
+		} else {
+			start = i
+			for i < len(data) && !isSep(data[i]) {
+				i++
+			}
+			value = data[start:i]
+		}
+
+		if quote == '\'' {
+			scanFields(value, want, out)
+		}
+
+		if want[name] {
+			if quote == 0 {
+				value = decodeField(name, value)
+			}
+			out[name] = append(out[name], value)
+		}
+	}
+}
+
+// decodeField decodes an unquoted value of a field the kernel hex encodes
+func decodeField(name string, value string) string {
+	if !encodedFields[name] || len(value) == 0 || len(value)%2 != 0 {
+		return value
+	}
+
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+
+	// proctitle separates the arguments with NUL
+	return strings.ReplaceAll(string(decoded), "\x00", " ")
+}
+
+// decodeSockaddr adds the saddr.* fields for a hex encoded struct sockaddr
+func decodeSockaddr(saddr string, out map[string][]string) {
+	raw, err := hex.DecodeString(saddr)
+	if err != nil || len(raw) < 2 {
+		return
+	}
+
+	family := binary.LittleEndian.Uint16(raw)
+	switch family {
+	case 1:
+		out["saddr.family"] = append(out["saddr.family"], "unix")
+		path := raw[2:]
+		if len(path) > 0 && path[0] == 0 {
+			// abstract socket
+			out["saddr.path"] = append(out["saddr.path"], "@"+strings.TrimRight(string(path[1:]), "\x00"))
+		} else if end := strings.IndexByte(string(path), 0); end >= 0 {
+			out["saddr.path"] = append(out["saddr.path"], string(path[:end]))
+		} else {
+			out["saddr.path"] = append(out["saddr.path"], string(path))
+		}
+	case 2:
+		out["saddr.family"] = append(out["saddr.family"], "inet")
+		if len(raw) >= 8 {
+			out["saddr.port"] = append(out["saddr.port"], strconv.Itoa(int(binary.BigEndian.Uint16(raw[2:4]))))
+			out["saddr.addr"] = append(out["saddr.addr"], net.IP(raw[4:8]).String())
+		}
+	case 10:
+		out["saddr.family"] = append(out["saddr.family"], "inet6")
+		if len(raw) >= 24 {
+			out["saddr.port"] = append(out["saddr.port"], strconv.Itoa(int(binary.BigEndian.Uint16(raw[2:4]))))
+			out["saddr.addr"] = append(out["saddr.addr"], net.IP(raw[8:24]).String())
+		}
+	case 16:
+		out["saddr.family"] = append(out["saddr.family"], "netlink")
+	default:
+		out["saddr.family"] = append(out["saddr.family"], strconv.Itoa(int(family)))
+	}
+}
+
+type exprNode interface {
+	eval(f *fieldSet) bool
+}
+
+type andNode struct{ left, right exprNode }
+
+func (n *andNode) eval(f *fieldSet) bool { return n.left.eval(f) && n.right.eval(f) }
+
+type orNode struct{ left, right exprNode }
+
+func (n *orNode) eval(f *fieldSet) bool { return n.left.eval(f) || n.right.eval(f) }
+
+type notNode struct{ node exprNode }
+
+func (n *notNode) eval(f *fieldSet) bool { return !n.node.eval(f) }
+
+type existsNode struct{ field string }
+
+func (n *existsNode) eval(f *fieldSet) bool { return len(f.get(n.field)) > 0 }
+
+type compareNode struct {
+	field string
+	op    string
+	value exprLiteral
+	regex *regexp.Regexp
+}
+
+func (n *compareNode) eval(f *fieldSet) bool {
+	for _, v := range f.get(n.field) {
+		if n.compare(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *compareNode) compare(v string) bool {
+	switch n.op {
+	case "=~":
+		return n.regex.MatchString(v)
+	case "!~":
+		return !n.regex.MatchString(v)
+	}
+
+	c, ok := n.value.compare(v)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return false
+}
+
+type inNode struct {
+	field  string
+	values []exprLiteral
+}
+
+func (n *inNode) eval(f *fieldSet) bool {
+	for _, v := range f.get(n.field) {
+		for _, l := range n.values {
+			if c, ok := l.compare(v); ok && c == 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type exprLiteral struct {
+	text  string
+	num   int64
+	isNum bool
+}
+
+// compare orders the field value against the literal. Numbers are compared numerically and
+// a value that is not a number can not be compared with one
+func (l exprLiteral) compare(v string) (int, bool) {
+	if !l.isNum {
+		return strings.Compare(v, l.text), true
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return cmp.Compare(n, l.num), true
+}
+
+type exprParser struct {
+	lexer  *exprLexer
+	tok    exprToken
+	fields map[string]bool
+}
+
+func (p *exprParser) next() error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+
+	p.tok = tok
+	return nil
+}
+
+func (p *exprParser) expect(kind tokenKind, text string) error {
+	if p.tok.kind != kind || p.tok.text != text {
+		return fmt.Errorf("expected %q at offset %d, got %s", text, p.tok.pos, p.tok)
+	}
+
+	return p.next()
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokOp && p.tok.text == "||" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind == tokOp && p.tok.text == "&&" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.tok.kind == tokOp && p.tok.text == "!" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node}, nil
+	}
+
+	if p.tok.kind == tokPunct && p.tok.text == "(" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(tokPunct, ")")
+	}
+
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	if p.tok.kind != tokIdent {
+		return nil, fmt.Errorf("expected a field name at offset %d, got %s", p.tok.pos, p.tok)
+	}
+
+	field := p.tok.text
+	if err := p.useField(field, p.tok.pos); err != nil {
+		return nil, err
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.tok.kind == tokIdent && p.tok.text == "in":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return p.parseList(field)
+	case p.tok.kind == tokOp && isComparison(p.tok.text):
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		return p.parseCompare(field, op)
+	}
+
+	return &existsNode{field}, nil
+}
+
+func (p *exprParser) parseCompare(field string, op string) (exprNode, error) {
+	pos := p.tok.pos
+	value, err := p.parseLiteral(field)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &compareNode{field: field, op: op, value: value}
+	if op == "=~" || op == "!~" {
+		if value.isNum {
+			return nil, fmt.Errorf("%s expects a string at offset %d", op, pos)
+		}
+		if node.regex, err = regexp.Compile(value.text); err != nil {
+			return nil, fmt.Errorf("invalid regular expression at offset %d: %s", pos, err)
+		}
+	}
+
+	return node, nil
+}
+
+func (p *exprParser) parseList(field string) (exprNode, error) {
+	if err := p.expect(tokPunct, "["); err != nil {
+		return nil, err
+	}
+
+	node := &inNode{field: field}
+	for {
+		value, err := p.parseLiteral(field)
+		if err != nil {
+			return nil, err
+		}
+		node.values = append(node.values, value)
+
+		if p.tok.kind == tokPunct && p.tok.text == "," {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		return node, p.expect(tokPunct, "]")
+	}
+}
+
+func (p *exprParser) parseLiteral(field string) (exprLiteral, error) {
+	tok := p.tok
+	var l exprLiteral
+
+	switch tok.kind {
+	case tokString:
+		l = exprLiteral{text: tok.text}
+		if field == exprFieldSyscall {
+			// the kernel reports syscalls by number, translate names up front
+			if _, err := strconv.Atoi(tok.text); err != nil {
+				num, ok := syscallNumbers[tok.text]
+				if !ok {
+					return l, fmt.Errorf("unknown syscall %q at offset %d", tok.text, tok.pos)
+				}
+				l = exprLiteral{text: strconv.Itoa(num), num: int64(num), isNum: true}
+			}
+		}
+	case tokNumber:
+		num, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return l, fmt.Errorf("invalid number %q at offset %d", tok.text, tok.pos)
+		}
+		l = exprLiteral{text: tok.text, num: num, isNum: true}
+	default:
+		return l, fmt.Errorf("expected a string or number at offset %d, got %s", tok.pos, tok)
+	}
+
+	return l, p.next()
+}
+
+// useField records a data field the expression reads
+func (p *exprParser) useField(field string, pos int) error {
+	switch {
+	case field == exprFieldKey || field == exprFieldSyscall || field == exprFieldType:
+	case strings.HasPrefix(field, exprFieldSaddr+"."):
+		if !saddrFields[field] {
+			return fmt.Errorf("unknown field %q at offset %d", field, pos)
+		}
+		p.fields[exprFieldSaddr] = true
+	default:
+		p.fields[field] = true
+	}
+
+	return nil
+}
+
+func isComparison(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "=~", "!~":
+		return true
+	}
+
+	return false
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokPunct
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+
+	return strconv.Quote(t.text)
+}
+
+type exprLexer struct {
+	src string
+	pos int
+}
+
+func (l *exprLexer) next() (exprToken, error) {
+	for l.pos < len(l.src) && strings.IndexByte(" \t\r\n", l.src[l.pos]) >= 0 {
+		l.pos++
+	}
+
+	start := l.pos
+	if start >= len(l.src) {
+		return exprToken{kind: tokEOF, pos: start}, nil
+	}
+
+	c := l.src[start]
+	switch {
+	case c == '"':
+		// find the closing quote, skipping escaped characters
+		end := start + 1
+		for end < len(l.src) && l.src[end] != '"' {
+			if l.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(l.src) {
+			return exprToken{}, fmt.Errorf("unterminated string at offset %d", start)
+		}
+		text, err := strconv.Unquote(l.src[start : end+1])
+		if err != nil {
+			return exprToken{}, fmt.Errorf("invalid string at offset %d: %s", start, err)
+		}
+		l.pos = end + 1
+		return exprToken{kind: tokString, text: text, pos: start}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+		return exprToken{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+	case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos]) {
+			l.pos++
+		}
+		return exprToken{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	case strings.IndexByte("()[],", c) >= 0:
+		l.pos++
+		return exprToken{kind: tokPunct, text: l.src[start:l.pos], pos: start}, nil
+	}
+
+	for _, op := range []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||", "<", ">", "!"} {
+		if strings.HasPrefix(l.src[start:], op) {
+			l.pos += len(op)
+			return exprToken{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+
+	return exprToken{}, fmt.Errorf("unexpected %q at offset %d", c, start)
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || (c >= '0' && c <= '9') || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
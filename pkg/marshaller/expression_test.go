@@ -0,0 +1,137 @@
+package marshaller
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func newExpressionGroup(t *testing.T, data ...string) *parser.AuditMessageGroup {
+	types := []uint16{1300, 1306, 1327, 1302}
+
+	var group *parser.AuditMessageGroup
+	for i, d := range data {
+		am := parser.NewAuditMessage(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: types[i%len(types)]},
+			Data:   []byte("audit(10000001.000:1): " + d),
+		})
+		if group == nil {
+			group = parser.NewUnmappedAuditMessageGroup(am)
+		} else {
+			group.AppendMessage(am)
+		}
+	}
+	t.Cleanup(group.Release)
+
+	return group
+}
+
+func TestCompileExpression(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		err  string
+	}{
+		{`auid != 4294967295`, ""},
+		{`exe in ["/usr/bin/curl", "/usr/bin/wget"] && !(uid == 0 || key == "x")`, ""},
+		{`saddr.port >= 1024 && exe =~ "^/tmp/"`, ""},
+		{`comm`, ""},
+		{``, "expected a field name at offset 0, got end of expression"},
+		{`auid ==`, "expected a string or number at offset 7, got end of expression"},
+		{`auid == 1 &&`, "expected a field name at offset 12, got end of expression"},
+		{`(auid == 1`, `expected ")" at offset 10, got end of expression`},
+		{`exe in "/bin/sh"`, `expected "[" at offset 7, got "/bin/sh"`},
+		{`exe =~ "["`, "invalid regular expression at offset 7: error parsing regexp: missing closing ]: `[`"},
+		{`exe =~ 1`, "=~ expects a string at offset 7"},
+		{`exe == "/bin/sh`, "unterminated string at offset 7"},
+		{`syscall == "not_a_syscall"`, `unknown syscall "not_a_syscall" at offset 11`},
+		{`saddr.nope == 1`, `unknown field "saddr.nope" at offset 0`},
+		{`auid == 1 auid`, `unexpected "auid" at offset 10`},
+		{`auid = 1`, `unexpected '=' at offset 5`},
+	} {
+		_, err := CompileExpression(tc.expr)
+		if tc.err == "" {
+			assert.Nil(t, err, tc.expr)
+		} else {
+			assert.EqualError(t, err, tc.err, tc.expr)
+		}
+	}
+}
+
+func TestExpression_Match(t *testing.T) {
+	group := newExpressionGroup(
+		t,
+		`arch=c000003e syscall=42 success=yes exit=0 a0=3 items=0 ppid=1 pid=1234 auid=1000 uid=0 gid=0 tty=(none) ses=2 comm="curl" exe="/usr/bin/curl" key="egress"`,
+		`saddr=020001BB5DB8D8220000000000000000`,
+		`proctitle=6375726C0068747470733A2F2F6578616D706C652E636F6D`,
+	)
+
+	for _, tc := range []struct {
+		expr  string
+		match bool
+	}{
+		{`syscall == 42`, true},
+		{`auid != 4294967295`, true},
+		{`auid == 4294967295`, false},
+		{`auid > 999 && auid < 1001`, true},
+		{`uid <= 0 && uid >= 0`, true},
+		{`exe in ["/usr/bin/curl", "/usr/bin/wget"]`, true},
+		{`exe in ["/usr/bin/wget"]`, false},
+		{`exe =~ "^/usr/bin/" && comm !~ "wget"`, true},
+		{`key == "egress"`, true},
+		{`type == 1306`, true},
+		{`saddr.family == "inet" && saddr.port == 443 && saddr.addr == "93.184.216.34"`, true},
+		{`saddr.port == 80`, false},
+		{`proctitle == "curl https://example.com"`, true},
+		{`tty == "(none)"`, true},
+		{`comm`, true},
+		{`!cwd`, true},
+		{`cwd != "/"`, false},
+		{`exe > 1`, false},
+		{`uid == 1 || (ses == 2 && !(pid == 1))`, true},
+	} {
+		expr, err := CompileExpression(tc.expr)
+		if !assert.Nil(t, err, tc.expr) {
+			continue
+		}
+		assert.Equal(t, tc.match, expr.Match(group), tc.expr)
+	}
+
+	if runtime.GOARCH == "amd64" {
+		expr, err := CompileExpression(`syscall == "connect" && saddr.port == 443 && auid != 4294967295`)
+		assert.Nil(t, err)
+		assert.True(t, expr.Match(group))
+	}
+}
+
+func TestExpression_MatchNestedAndEncoded(t *testing.T) {
+	group := newExpressionGroup(
+		t,
+		"arch=c000003e syscall=59 success=yes exit=0 items=2 ppid=1 pid=99 auid=4294967295 uid=0 key=(null) comm=\"sshd\" exe=\"/usr/sbin/sshd\"\x1dARCH=x86_64 SYSCALL=execve AUID=\"unset\"",
+		`saddr=01002F72756E2F73797374656D642F6A6F75726E616C2F736F636B657400`,
+		`pid=99 uid=0 auid=1000 ses=3 msg='op=PAM:session_open acct="root" exe="/usr/sbin/sshd" hostname=? res=success'`,
+		`item=0 name=2F746D702F612062 inode=12 name="/etc/passwd"`,
+	)
+
+	for _, tc := range []struct {
+		expr  string
+		match bool
+	}{
+		// auid shows up twice, any occurrence can match
+		{`auid == 4294967295 && auid == 1000`, true},
+		{`acct == "root" && res == "success"`, true},
+		{`SYSCALL == "execve" && AUID == "unset"`, true},
+		{`name == "/tmp/a b" && name == "/etc/passwd"`, true},
+		{`saddr.family == "unix" && saddr.path == "/run/systemd/journal/socket"`, true},
+		{`key`, false},
+		{`key == "(null)"`, false},
+	} {
+		expr, err := CompileExpression(tc.expr)
+		if !assert.Nil(t, err, tc.expr) {
+			continue
+		}
+		assert.Equal(t, tc.match, expr.Match(group), tc.expr)
+	}
+}
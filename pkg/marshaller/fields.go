@@ -0,0 +1,64 @@
+package marshaller
+
+import (
+	"path"
+	"strings"
+)
+
+// ExecveArgsField selects every argument of an EXECVE record, a0, a1, ... including the pieces
+// of arguments too long for a single field like a1[0]
+const ExecveArgsField = "execve.args"
+
+// fieldSelector selects fields by name, by glob pattern like `a*` or with ExecveArgsField
+type fieldSelector struct {
+	names      map[string]bool
+	patterns   []string
+	execveArgs bool
+}
+
+func newFieldSelector(fields []string) fieldSelector {
+	f := fieldSelector{names: make(map[string]bool, len(fields))}
+	for _, field := range fields {
+		switch {
+		case field == ExecveArgsField:
+			f.execveArgs = true
+		case isFieldPattern(field):
+			f.patterns = append(f.patterns, field)
+		default:
+			f.names[field] = true
+		}
+	}
+	return f
+}
+
+// has reports whether the field with the given name is selected
+func (f fieldSelector) has(name string) bool {
+	if f.names[name] || (f.execveArgs && execveArgRegex.MatchString(name)) {
+		return true
+	}
+
+	for _, pattern := range f.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isFieldPattern reports whether s is a glob pattern over field names
+func isFieldPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// isFieldSelector reports whether s can select fields in a fieldSelector
+func isFieldSelector(s string) bool {
+	if s == ExecveArgsField || isFieldName(s) {
+		return true
+	}
+	if !isFieldPattern(s) {
+		return false
+	}
+
+	_, err := path.Match(s, "")
+	return err == nil && isFieldName(strings.NewReplacer("*", "", "?", "", "[", "", "]", "").Replace(s)+"x")
+}
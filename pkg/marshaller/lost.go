@@ -0,0 +1,162 @@
+package marshaller
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+const (
+	// LostRecordKey is the rule key of the synthetic records written when sequences were lost
+	LostRecordKey = "pauditd_lost"
+	// EventLost is the message type of a lost record. It is not a kernel message type,
+	// lost records are identified by their rule key
+	EventLost = 0
+)
+
+// sequenceGap is shared by every sequence skipped over at once
+type sequenceGap struct {
+	windowStart string // audit time of the last message before the gap
+	windowEnd   string // audit time of the message that revealed the gap
+}
+
+// EnableLostRecords makes the marshaller write a pauditd_lost record to the output for every
+// range of sequences presumed lost, only applies when message tracking is enabled
+func (a *AuditMarshaller) EnableLostRecords() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.lostRecords = true
+}
+
+// SetKernelLost records the lost counter from the last kernel audit status, it is reported
+// alongside the missing sequences in lost records
+func (a *AuditMarshaller) SetKernelLost(lost uint32) {
+	a.kernelLost.Store(lost)
+	metric.GetClient().Gauge("messages.kernel_lost", lost)
+}
+
+// Track sequence numbers and report the ones we suspect we missed
+func (a *AuditMarshaller) detectMissing(seq int, auditTime string) {
+	if seq > a.lastSeq+1 && a.lastSeq != 0 {
+		// We likely leap frogged over a msg, wait until the next sequence to make sure
+		gap := &sequenceGap{
+			windowStart: string(a.lastTime),
+			windowEnd:   strings.Clone(auditTime),
+		}
+		for i := a.lastSeq + 1; i < seq; i++ {
+			a.missed[i] = gap
+		}
+	}
+
+	var lost []int
+	for missedSeq := range a.missed {
+		if missedSeq == seq {
+			lag := a.lastSeq - missedSeq
+			if lag > a.worstLag {
+				a.worstLag = lag
+			}
+
+			if a.logOutOfOrder {
+				logger.Error("Got sequence", missedSeq, "after", lag, "messages. Worst lag so far", a.worstLag, "messages")
+			}
+			metric.GetClient().Increment("messages.out_of_order")
+			delete(a.missed, missedSeq)
+		} else if seq-missedSeq > a.maxOutOfOrder {
+			lost = append(lost, missedSeq)
+		}
+	}
+
+	if len(lost) > 0 {
+		a.reportLost(lost)
+	}
+
+	if seq > a.lastSeq {
+		// Keep track of the largest sequence, the time is copied as it points into a pooled buffer
+		a.lastSeq = seq
+		a.lastTime = append(a.lastTime[:0], auditTime...)
+	}
+}
+
+// flushMissed reports every sequence still missing as lost, nothing will fill the gaps anymore
+func (a *AuditMarshaller) flushMissed() {
+	if len(a.missed) == 0 {
+		return
+	}
+
+	lost := make([]int, 0, len(a.missed))
+	for missedSeq := range a.missed {
+		lost = append(lost, missedSeq)
+	}
+	a.reportLost(lost)
+}
+
+// reportLost removes the sequences from the missed set and reports each contiguous range
+// of them, sequences from different gaps are never merged
+func (a *AuditMarshaller) reportLost(seqs []int) {
+	slices.Sort(seqs)
+
+	for start := 0; start < len(seqs); {
+		gap := a.missed[seqs[start]]
+		end := start
+		delete(a.missed, seqs[start])
+		for end+1 < len(seqs) && seqs[end+1] == seqs[end]+1 && a.missed[seqs[end+1]] == gap {
+			end++
+			delete(a.missed, seqs[end])
+		}
+
+		first, last := seqs[start], seqs[end]
+		count := last - first + 1
+		logger.Error("Likely missed sequences", "first_seq", first, "last_seq", last, "count", count, "worst_lag", a.worstLag)
+		metric.GetClient().Increment("messages.gaps")
+		metric.GetClient().Count("messages.lost", count)
+
+		if a.lostRecords {
+			a.complete(a.lostRecord(first, last, gap))
+		}
+
+		start = end + 1
+	}
+}
+
+func isLostRecord(msg *parser.AuditMessageGroup) bool {
+	return msg.RuleKey == LostRecordKey && len(msg.Msgs) == 1 && msg.Msgs[0].Type == EventLost
+}
+
+// lostRecord builds the synthetic group reporting the sequences first through last as lost
+func (a *AuditMarshaller) lostRecord(first int, last int, gap *sequenceGap) *parser.AuditMessageGroup {
+	data := fmt.Sprintf(
+		"%s first_seq=%d last_seq=%d count=%d window_start=%s window_end=%s kernel_lost=%d",
+		LostRecordKey, first, last, last-first+1, gap.windowStart, gap.windowEnd, a.kernelLost.Load(),
+	)
+
+	return syntheticRecord(LostRecordKey, EventLost, first, data)
+}
+
+// syntheticRecord builds a group with a single message written by pauditd itself
+func syntheticRecord(key string, msgType uint16, seq int, data string) *parser.AuditMessageGroup {
+	auditTime := auditTimestamp(time.Now())
+
+	return &parser.AuditMessageGroup{
+		Seq:       seq,
+		AuditTime: auditTime,
+		Msgs: []*parser.AuditMessage{{
+			Type:      msgType,
+			Data:      data,
+			Seq:       seq,
+			AuditTime: auditTime,
+		}},
+		UIDMap:  make(map[string]string),
+		RuleKey: key,
+	}
+}
+
+// auditTimestamp formats t the way the kernel formats the time of audit messages
+func auditTimestamp(t time.Time) string {
+	return fmt.Sprintf("%d.%03d", t.Unix(), t.Nanosecond()/int(time.Millisecond))
+}
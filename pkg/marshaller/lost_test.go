@@ -0,0 +1,144 @@
+package marshaller
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/output"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSyscall(seq string, time string) *syscall.NetlinkMessage {
+	return &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(" + time + ":" + seq + "): hi there"),
+	}
+}
+
+func lostRecords(t *testing.T, out string) []parser.AuditMessageGroup {
+	var records []parser.AuditMessageGroup
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		group := parser.AuditMessageGroup{}
+		if err := json.Unmarshal([]byte(line), &group); err != nil {
+			t.Fatalf("Failed to decode output %q: %v", line, err)
+		}
+		if group.RuleKey == LostRecordKey {
+			records = append(records, group)
+		}
+	}
+
+	return records
+}
+
+func TestAuditMarshaller_lostRecords(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), true, false, 2, []AuditFilter{})
+	m.EnableLostRecords()
+	m.SetKernelLost(7)
+
+	m.Consume(newSyscall("1", "10000001.000"))
+	m.Consume(new1320("1"))
+
+	// 2 and 3 are skipped, 3 shows up late
+	m.Consume(newSyscall("4", "10000002.000"))
+	m.Consume(new1320("4"))
+	m.Consume(newSyscall("3", "10000002.000"))
+	m.Consume(new1320("3"))
+	assert.Empty(t, lostRecords(t, w.String()))
+
+	// 2 is now too far behind to be out of order
+	m.Consume(newSyscall("5", "10000003.000"))
+	m.Consume(new1320("5"))
+
+	records := lostRecords(t, w.String())
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, 2, records[0].Seq)
+		assert.Equal(t, uint16(EventLost), records[0].Msgs[0].Type)
+		assert.Equal(
+			t,
+			"pauditd_lost first_seq=2 last_seq=2 count=1 window_start=10000001.000 window_end=10000002.000 kernel_lost=7",
+			records[0].Msgs[0].Data,
+		)
+	}
+	assert.Empty(t, m.missed)
+}
+
+func TestAuditMarshaller_lostRecordsRanges(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), true, false, 100, []AuditFilter{})
+	m.EnableLostRecords()
+
+	m.Consume(newSyscall("1", "10000001.000"))
+	m.Consume(newSyscall("5", "10000002.000"))
+	m.Consume(newSyscall("6", "10000003.000"))
+	m.Consume(newSyscall("9", "10000004.000"))
+	m.Consume(newSyscall("3", "10000002.000"))
+
+	// Nothing is too far behind yet, shutting down reports whatever is still missing
+	m.Flush()
+
+	records := lostRecords(t, w.String())
+	if assert.Len(t, records, 3) {
+		assert.Contains(t, records[0].Msgs[0].Data, "first_seq=2 last_seq=2 count=1 window_start=10000001.000 window_end=10000002.000")
+		assert.Contains(t, records[1].Msgs[0].Data, "first_seq=4 last_seq=4 count=1 window_start=10000001.000 window_end=10000002.000")
+		assert.Contains(t, records[2].Msgs[0].Data, "first_seq=7 last_seq=8 count=2 window_start=10000003.000 window_end=10000004.000")
+	}
+}
+
+func TestAuditMarshaller_lostRecordsDisabled(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), true, false, 0, []AuditFilter{})
+
+	m.Consume(newSyscall("1", "10000001.000"))
+	m.Consume(newSyscall("5", "10000002.000"))
+	m.Consume(newSyscall("6", "10000003.000"))
+	m.Flush()
+
+	assert.Empty(t, lostRecords(t, w.String()))
+	assert.Empty(t, m.missed)
+}
+
+func TestAuditMarshaller_lostRecordsNotFiltered(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	filters := []AuditFilter{{Key: LostRecordKey, Action: Drop, Regex: regexp.MustCompile(".*")}}
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), true, false, 0, filters)
+	m.EnableLostRecords()
+
+	m.Consume(newSyscall("1", "10000001.000"))
+	m.Consume(newSyscall("3", "10000002.000"))
+	m.Consume(newSyscall("4", "10000003.000"))
+	m.Flush()
+
+	assert.Len(t, lostRecords(t, w.String()), 1)
+}
@@ -1,7 +1,11 @@
 package marshaller
 
 import (
-	"os"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,72 +22,171 @@ const EventEOE = 1320
 // TODO: Consider refactoring the AuditMarshaller struct to accept a metric.Client
 // as a dependency. This would make it easier to inject a mock client in tests.
 type AuditMarshaller struct {
+	lock          *sync.Mutex // guards the group table and sequence tracking between Consume and the flush timer
 	msgs          map[int]*parser.AuditMessageGroup
-	writer        *output.AuditWriter
+	pendingBytes  int // message data held by the groups in msgs
+	limits        PendingLimits
+	writer        atomic.Pointer[output.AuditWriter] // swapped by SetWriter without waiting for writes
 	lastSeq       int
-	missed        map[int]bool
+	lastTime      []byte               // audit time of lastSeq
+	missed        map[int]*sequenceGap // sequences skipped over that have not shown up yet
 	worstLag      int
+	lostRecords   bool          // write a pauditd_lost record for missed sequences
+	kernelLost    atomic.Uint32 // lost counter from the last kernel audit status
 	eventMin      uint16
 	eventMax      uint16
 	trackMessages bool
 	logOutOfOrder bool
 	maxOutOfOrder int
-	attempts      int                                  // nolint:unused
-	filters       map[string]map[uint16][]*AuditFilter // { syscall: { mtype: [regexp, ...] } }
+	attempts      int                         // nolint:unused
+	filters       atomic.Pointer[filterSet]   // swapped as a whole by SetFilters
+	limiter       atomic.Pointer[rateLimiter] // nil when no rate limits are configured
+	aggregator    atomic.Pointer[aggregator]  // nil when aggregation is off
+	redactor      atomic.Pointer[Redactor]    // nil when redaction is off
+	encryptor     atomic.Pointer[Encryptor]   // nil when encryption is off
+	pipeline      *Pipeline                   // when set complete groups are handed to the pipeline workers
+	stopTimer     chan struct{}
+	timerDone     chan struct{}
 }
 
 // NewAuditMarshaller creates a new AuditMarshaller instance.
 // It initializes the message tracking, filters, and output writer.
 func NewAuditMarshaller(w *output.AuditWriter, eventMin uint16, eventMax uint16, trackMessages, logOOO bool, maxOOO int, filters []AuditFilter) *AuditMarshaller {
 	am := AuditMarshaller{
-		writer:        w,
+		lock:          &sync.Mutex{},
 		msgs:          make(map[int]*parser.AuditMessageGroup, 5), // It is not typical to have more than 2 message groups at any given time
-		missed:        make(map[int]bool, 10),
+		missed:        make(map[int]*sequenceGap, 10),
 		eventMin:      eventMin,
 		eventMax:      eventMax,
 		trackMessages: trackMessages,
 		logOutOfOrder: logOOO,
 		maxOutOfOrder: maxOOO,
-		filters:       make(map[string]map[uint16][]*AuditFilter),
 	}
 
-	am.processAndSetFilters(filters)
+	am.writer.Store(w)
+	am.SetFilters(filters)
 	return &am
 }
 
 // Consume ingests a netlink message, processes it, and prepares it for logging.
 // It handles message sequencing, filtering, and multi-packet events.
 func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
-	aMsg := parser.NewAuditMessage(nlMsg)
+	a.consume(parser.NewAuditMessage(nlMsg))
+}
+
+// StartFlushTimer completes groups that are past their CompleteAfter time every interval,
+// even when no new messages arrive. Without it old groups are only flushed by the next message
+func (a *AuditMarshaller) StartFlushTimer(interval time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.stopTimer != nil {
+		return
+	}
+
+	a.stopTimer = make(chan struct{})
+	a.timerDone = make(chan struct{})
+
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				a.lock.Lock()
+				a.flushOld()
+				a.reportPending()
+				a.reportSuppressed(a.limiter.Load(), false)
+				a.flushAggregates(a.aggregator.Load(), false)
+				a.lock.Unlock()
+			}
+		}
+	}(a.stopTimer, a.timerDone)
+}
+
+// StopFlushTimer stops the flush timer and waits for a running flush to finish
+func (a *AuditMarshaller) StopFlushTimer() {
+	a.lock.Lock()
+	stop, done := a.stopTimer, a.timerDone
+	a.stopTimer, a.timerDone = nil, nil
+	a.lock.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+// Flush stops the flush timer and completes every pending message group in sequence
+// order regardless of their CompleteAfter time
+func (a *AuditMarshaller) Flush() {
+	a.StopFlushTimer()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	seqs := make([]int, 0, len(a.msgs))
+	for seq := range a.msgs {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+
+	for _, seq := range seqs {
+		a.completeMessage(seq)
+	}
+
+	if a.trackMessages {
+		a.flushMissed()
+	}
+
+	a.flushAggregates(a.aggregator.Load(), true)
+	a.reportSuppressed(a.limiter.Load(), true)
+}
+
+func (a *AuditMarshaller) consume(aMsg *parser.AuditMessage) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 
 	if aMsg.Seq == 0 {
 		// We got an invalid audit message, return the current message and reset
+		aMsg.Release()
 		a.flushOld()
 		return
 	}
 
 	if a.trackMessages {
-		a.detectMissing(aMsg.Seq)
+		a.detectMissing(aMsg.Seq, aMsg.AuditTime)
 	}
 
-	if nlMsg.Header.Type < a.eventMin || nlMsg.Header.Type > a.eventMax {
+	if aMsg.Type < a.eventMin || aMsg.Type > a.eventMax {
 		// Drop all audit messages that aren't things we care about or end a multi-packet event
+		aMsg.Release()
 		a.flushOld()
 		return
-	} else if nlMsg.Header.Type == EventEOE {
+	} else if aMsg.Type == EventEOE {
 		// This is end of event msg, flush the msg with that sequence and discard this one
 		a.completeMessage(aMsg.Seq)
+		aMsg.Release()
 		return
 	}
 
 	if val, ok := a.msgs[aMsg.Seq]; ok {
 		// Use the original AuditMessageGroup if we have one
-		val.AddMessage(aMsg)
+		val.AppendMessage(aMsg)
 	} else {
-		// Create a new AuditMessageGroup
-		a.msgs[aMsg.Seq] = parser.NewAuditMessageGroup(aMsg)
+		// Create a new AuditMessageGroup, usernames are resolved once the group is complete
+		a.msgs[aMsg.Seq] = parser.NewUnmappedAuditMessageGroup(aMsg)
 	}
+	a.pendingBytes += len(aMsg.Data)
 
+	a.enforceLimits()
 	a.flushOld()
 }
 
@@ -100,52 +203,157 @@ func (a *AuditMarshaller) flushOld() {
 
 // Write a complete message group to the configured output in json format
 func (a *AuditMarshaller) completeMessage(seq int) {
-	var msg *parser.AuditMessageGroup
-	var ok bool
-
-	if msg, ok = a.msgs[seq]; !ok {
+	msg := a.removeGroup(seq)
+	if msg == nil {
 		// TODO: attempted to complete a missing message, log?
 		return
 	}
 
-	if a.dropMessage(msg) {
-		metric.GetClient().Increment("messages.filtered")
-		delete(a.msgs, seq)
+	a.complete(msg)
+}
+
+// complete hands a complete message group to the pipeline or processes and writes it
+func (a *AuditMarshaller) complete(msg *parser.AuditMessageGroup) {
+	if a.pipeline != nil {
+		a.pipeline.dispatch(msg)
 		return
 	}
 
-	if err := a.writer.Write(msg); err != nil {
-		logger.Error("Failed to write message. Error:", err)
-		os.Exit(1)
+	a.writeMessage(msg, a.processMessage(msg))
+}
+
+// processMessage resolves the usernames of a complete message group and runs it through the
+// filters, rate limits, redaction and aggregation. It returns false when the group was filtered out,
+// suppressed or is held for aggregation
+func (a *AuditMarshaller) processMessage(msg *parser.AuditMessageGroup) bool {
+	if isLostRecord(msg) || isSuppressedRecord(msg) {
+		// Lost and suppressed records are ours, there is nothing to resolve and they must not be filtered
+		return true
+	}
+
+	if msg.Aggregated {
+		// went through all of this before it was held for aggregation
+		return a.encrypt(msg)
+	}
+
+	msg.MapUIDs()
+
+	if a.dropMessage(msg) == Drop {
+		metric.GetClient().Increment("messages.filtered")
+		return false
 	}
 
-	delete(a.msgs, seq)
+	if a.rateLimited(msg) {
+		metric.GetClient().Increment("messages.rate_limited")
+		return false
+	}
+
+	// filters and rate limits see the original messages, everything after them only the redacted ones
+	a.redact(msg)
+
+	if a.aggregate(msg) {
+		return false
+	}
+
+	// encrypted values differ every time, aggregation has to fingerprint the plain ones
+	return a.encrypt(msg)
+}
+
+// writeMessage writes the message group to the output when keep is set and hands the
+// group back to the pool. Nothing may hold on to the group afterwards
+func (a *AuditMarshaller) writeMessage(msg *parser.AuditMessageGroup, keep bool) {
+	defer msg.Release()
+
+	if !keep {
+		return
+	}
+
+	// failing to deliver a group is handled by the failure policy of the output, what is left are
+	// groups that could not be serialized or a writer that is already closed. A writer that was
+	// replaced and closed while the group was on its way gives it back to the one replacing it
+	for {
+		w := a.writer.Load()
+		err := w.Write(msg)
+		if errors.Is(err, output.ErrWriterClosed) && a.writer.Load() != w {
+			continue
+		}
+
+		if err != nil {
+			logger.Error("Failed to write message", "error", err)
+			metric.GetClient().Increment("messages.write_failed")
+		}
+		return
+	}
 }
 
 func (a *AuditMarshaller) dropMessage(msg *parser.AuditMessageGroup) FilterAction {
 	// SyscallMessage filters are always evaluated before rule key filters, preserving
 	// the original functionality first and for most for backward compatibility
 	filterTimer := metric.GetClient().NewTiming()
-	result := a.filterSyscallMessageType(msg) || a.filterRuleKey(msg)
+	filters := a.filters.Load()
+	result := Keep
+	if filters.filterSyscallMessageType(msg) == Drop || filters.filterRuleKey(msg) == Drop || filters.filterExpression(msg) == Drop {
+		result = Drop
+	}
 	filterTimer.Send("marshaller.filter_latency")
 	return result
 }
 
-func (a *AuditMarshaller) filterSyscallMessageType(msg *parser.AuditMessageGroup) FilterAction {
-	syscallFilters, hasSyscall := a.filters[msg.Syscall]
+// applyFilter counts the match and runs the action of a matching filter. Keep and drop end the
+// stage the filter belongs to, as does a sample that dropped the group. Every other action, and
+// any filter in dry run mode, changes the group and the following filters keep running
+func applyFilter(filter *AuditFilter, msg *parser.AuditMessageGroup) (FilterAction, bool) {
+	metric.GetClient().Increment(filter.matchedMetric)
+	if filter.Mode == DryRun {
+		msg.AddDryRunFilter(filter.ID)
+		return Keep, false
+	}
+
+	switch filter.Action {
+	case Keep, Drop:
+		return filter.Action, true
+	case Sample:
+		if rand.Float64()*100 >= filter.SampleRate {
+			return Drop, true
+		}
+	case Tag:
+		msg.AddTags(filter.Tags...)
+		if filter.Severity != "" {
+			msg.Severity = filter.Severity
+		}
+	case Redact:
+		for _, am := range msg.Msgs {
+			am.Data = filter.RedactRegex.ReplaceAllString(am.Data, RedactedText)
+		}
+	case Route:
+		msg.RouteTo(filter.Outputs...)
+	}
+
+	return Keep, false
+}
+
+func (f *filterSet) filterSyscallMessageType(msg *parser.AuditMessageGroup) FilterAction {
+	syscallFilters, hasSyscall := f.filters[msg.Syscall]
 	if !hasSyscall {
 		// no filter found for rule key move on (fast path)
 		return Keep
 	}
 
 	// for this each rule is executed for each message apart of the group
-	// before moving on to the next message
-	for _, msg := range msg.Msgs {
-		if fg, hasFilter := syscallFilters[msg.Type]; hasFilter {
+	// before moving on to the next message. A filter matching several messages
+	// only applies once
+	var applied []*AuditFilter
+	for _, am := range msg.Msgs {
+		if fg, hasFilter := syscallFilters[am.Type]; hasFilter {
 			for _, filter := range fg {
-				if filter.Regex.MatchString(msg.Data) {
-					return filter.Action
+				if slices.Contains(applied, filter) || !filter.Regex.MatchString(am.Data) {
+					continue
+				}
+
+				if action, done := applyFilter(filter, msg); done {
+					return action
 				}
+				applied = append(applied, filter)
 			}
 		}
 	}
@@ -153,25 +361,41 @@ func (a *AuditMarshaller) filterSyscallMessageType(msg *parser.AuditMessageGroup
 	return Keep
 }
 
-func (a *AuditMarshaller) filterRuleKey(msgGroup *parser.AuditMessageGroup) FilterAction {
-	// rule key filters are indexed in at 0 as we dont use the message type
-	ruleKeyFilters, hasRuleKey := a.filters[msgGroup.RuleKey][0]
-
-	if !hasRuleKey {
-		// no filter found for rule key move on (fast path)
-		return Keep
+func (f *filterSet) filterRuleKey(msgGroup *parser.AuditMessageGroup) FilterAction {
+	ruleKeys := msgGroup.RuleKeys
+	if len(ruleKeys) == 0 {
+		ruleKeys = []string{msgGroup.RuleKey}
 	}
 
 	fullMessage := ""
-	for _, msg := range msgGroup.Msgs {
-		fullMessage += msg.Data
-	}
+	for _, ruleKey := range ruleKeys {
+		// rule key filters are indexed in at 0 as we dont use the message type
+		ruleKeyFilters, hasRuleKey := f.filters[ruleKey][0]
+		if !hasRuleKey {
+			// no filter found for rule key move on (fast path)
+			continue
+		}
+
+		// for this each rule is evaluated against all the messages before moving on
+		// to the next rule, the first keep or drop rule of the first key with a match wins
+		for _, filter := range ruleKeyFilters {
+			if fullMessage == "" {
+				for _, msg := range msgGroup.Msgs {
+					fullMessage += msg.Data
+				}
+			}
+
+			if !filter.Regex.MatchString(fullMessage) {
+				continue
+			}
 
-	// for this each rule is evaluated against all the messages before moving on
-	// to the next rule
-	for _, filter := range ruleKeyFilters {
-		if filter.Regex.MatchString(fullMessage) {
-			return filter.Action
+			if action, done := applyFilter(filter, msgGroup); done {
+				return action
+			}
+			if filter.Action == Redact {
+				// later filters see the redacted messages
+				fullMessage = ""
+			}
 		}
 	}
 
@@ -179,56 +403,91 @@ func (a *AuditMarshaller) filterRuleKey(msgGroup *parser.AuditMessageGroup) Filt
 	return Keep
 }
 
-// Track sequence numbers and log if we suspect we missed a message
-func (a *AuditMarshaller) detectMissing(seq int) {
-	if seq > a.lastSeq+1 && a.lastSeq != 0 {
-		// We likely leap frogged over a msg, wait until the next sequence to make sure
-		for i := a.lastSeq + 1; i < seq; i++ {
-			a.missed[i] = true
-		}
+// filterExpression evaluates the expression filters in order, the first matching keep or drop
+// filter wins. The fields are read out of the group once for all of them
+func (f *filterSet) filterExpression(msg *parser.AuditMessageGroup) FilterAction {
+	if len(f.exprFilters) == 0 {
+		return Keep
 	}
 
-	for missedSeq := range a.missed {
-		if missedSeq == seq {
-			lag := a.lastSeq - missedSeq
-			if lag > a.worstLag {
-				a.worstLag = lag
-			}
+	fields := collectFields(msg, f.exprFields)
+	for _, filter := range f.exprFilters {
+		if !filter.Expression.root.eval(fields) {
+			continue
+		}
 
-			if a.logOutOfOrder {
-				logger.Error("Got sequence", missedSeq, "after", lag, "messages. Worst lag so far", a.worstLag, "messages")
-			}
-			delete(a.missed, missedSeq)
-		} else if seq-missedSeq > a.maxOutOfOrder {
-			logger.Error("Likely missed sequence %d, current %d, worst message delay %d\n", missedSeq, seq, a.worstLag)
-			delete(a.missed, missedSeq)
+		if action, done := applyFilter(filter, msg); done {
+			return action
+		}
+		if filter.Action == Redact {
+			// later filters see the redacted messages
+			fields = collectFields(msg, f.exprFields)
 		}
 	}
 
-	if seq > a.lastSeq {
-		// Keep track of the largest sequence
-		a.lastSeq = seq
-	}
+	return Keep
 }
 
-func (a *AuditMarshaller) processAndSetFilters(filters []AuditFilter) {
+// filterSet holds the configured filters indexed the way the filter stages look them up
+type filterSet struct {
+	filters     map[string]map[uint16][]*AuditFilter // { syscall: { mtype: [regexp, ...] } }
+	exprFilters []*AuditFilter                       // expression filters in the order they were configured
+	exprFields  map[string]bool                      // data fields read by any of the expression filters
+}
+
+// SetFilters replaces the filters of the marshaller. Groups being filtered at the time finish
+// with the filters they started with
+func (a *AuditMarshaller) SetFilters(filters []AuditFilter) {
+	a.filters.Store(newFilterSet(filters))
+}
+
+// SetWriter replaces the output of the marshaller and returns the previous one. It does not wait
+// for writes in progress, a write that waits for a full output would hold up the reload. Closing
+// the previous writer ends them and the groups it gives back are written to w
+func (a *AuditMarshaller) SetWriter(w *output.AuditWriter) *output.AuditWriter {
+	return a.writer.Swap(w)
+}
+
+func newFilterSet(filters []AuditFilter) *filterSet {
+	f := &filterSet{
+		filters:    make(map[string]map[uint16][]*AuditFilter),
+		exprFields: make(map[string]bool),
+	}
+
+	for idx := range filters {
+		if filters[idx].ID == "" {
+			filters[idx].ID = defaultFilterID(idx + 1)
+		}
+		filters[idx].matchedMetric = "filters." + filters[idx].ID + ".matched"
+	}
+
 	for idx, filter := range filters {
+		if filter.Expression != nil {
+			f.exprFilters = append(f.exprFilters, &filters[idx])
+			for field := range filter.Expression.fields {
+				f.exprFields[field] = true
+			}
+			continue
+		}
+
 		primaryKey := filter.Syscall
 		if primaryKey == "" {
 			primaryKey = filter.Key
 		}
 
-		if _, ok := a.filters[primaryKey]; !ok {
-			a.filters[primaryKey] = make(map[uint16][]*AuditFilter)
+		if _, ok := f.filters[primaryKey]; !ok {
+			f.filters[primaryKey] = make(map[uint16][]*AuditFilter)
 		}
 
 		// if we are doing a key filter then the messageType will be 0 as it is the golang default
 		// value. This means that all key filters (vs syscall,messageType filters) are stored
 		// in [key][0] => []*AuditFilter
-		if _, ok := a.filters[primaryKey][filter.MessageType]; !ok {
-			a.filters[primaryKey][filter.MessageType] = []*AuditFilter{}
+		if _, ok := f.filters[primaryKey][filter.MessageType]; !ok {
+			f.filters[primaryKey][filter.MessageType] = []*AuditFilter{}
 		}
 
-		a.filters[primaryKey][filter.MessageType] = append(a.filters[primaryKey][filter.MessageType], &filters[idx])
+		f.filters[primaryKey][filter.MessageType] = append(f.filters[primaryKey][filter.MessageType], &filters[idx])
 	}
+
+	return f
 }
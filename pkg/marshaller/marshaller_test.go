@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"regexp"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -130,6 +131,52 @@ func TestAuditMarshaller_Consume(t *testing.T) {
 	assert.Equal(t, 0, len(m.msgs))
 }
 
+func TestAuditMarshaller_StartFlushTimer(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &syncBuffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+	m.StartFlushTimer(10 * time.Millisecond)
+	defer m.StopFlushTimer()
+
+	start := time.Now()
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:4): hi there"),
+	})
+
+	// No further input, the timer has to complete the group on its own
+	assert.Eventually(t, func() bool { return w.String() != "" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "{\"sequence\":4,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"rule_key\":\"\"}\n", w.String())
+	assert.True(t, time.Since(start) >= parser.CompleteAfter, "Should have waited for the group to be complete")
+}
+
+func TestAuditMarshaller_Flush(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+	for _, seq := range []string{"6", "5"} {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(10000001:" + seq + "): hi there"),
+		})
+	}
+
+	m.Flush()
+	assert.Equal(t, 0, len(m.msgs))
+	assert.Equal(t, "{\"sequence\":5,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"rule_key\":\"\"}\n"+
+		"{\"sequence\":6,\"timestamp\":\"10000001\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"rule_key\":\"\"}\n", w.String())
+}
+
 func TestAuditMarshaller_completeMessage(t *testing.T) {
 	// TODO: cant test because completeMessage calls exit
 	t.Skip()
@@ -256,7 +303,151 @@ func TestAuditMarshaller_dropMessage(t *testing.T) {
 	})
 }
 
-func TestAuditMarshaller_processAndSetFilters(t *testing.T) {
+func TestAuditMarshaller_filterRuleKeyMultipleKeys(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	filters := []AuditFilter{
+		{
+			Key:    "second-key",
+			Action: Drop,
+			Regex:  regexp.MustCompile("exe=/usr/bin/noisy"),
+		},
+	}
+	m := NewAuditMarshaller(output.NewAuditWriter(&bytes.Buffer{}, 1), uint16(1100), uint16(1399), false, false, 0, filters)
+
+	message := &parser.AuditMessageGroup{
+		RuleKey:  "first-key",
+		RuleKeys: []string{"first-key", "second-key"},
+		Msgs:     []*parser.AuditMessage{{Type: 1300, Data: "syscall=59 exe=/usr/bin/noisy"}},
+	}
+	assert.Equal(t, Drop, m.dropMessage(message))
+
+	message.Msgs[0].Data = "syscall=59 exe=/usr/bin/quiet"
+	assert.Equal(t, Keep, m.dropMessage(message))
+}
+
+func TestAuditMarshaller_filterExpression(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	keepRoot, err := CompileExpression(`exe == "/usr/bin/noisy" && uid == 0`)
+	assert.Nil(t, err)
+	dropNoisy, err := CompileExpression(`exe in ["/usr/bin/noisy", "/usr/bin/loud"]`)
+	assert.Nil(t, err)
+
+	filters := []AuditFilter{
+		{Expression: keepRoot, Action: Keep},
+		{Expression: dropNoisy, Action: Drop},
+		{Key: "regex-key", Action: Drop, Regex: regexp.MustCompile("exe=/usr/bin/quiet")},
+	}
+	m := NewAuditMarshaller(output.NewAuditWriter(&bytes.Buffer{}, 1), uint16(1100), uint16(1399), false, false, 0, filters)
+	assert.Len(t, m.filters.Load().exprFilters, 2)
+	assert.Equal(t, map[string]bool{"exe": true, "uid": true}, m.filters.Load().exprFields)
+
+	message := &parser.AuditMessageGroup{
+		Msgs: []*parser.AuditMessage{{Type: 1300, Data: "syscall=59 uid=1000 exe=/usr/bin/noisy"}},
+	}
+	assert.Equal(t, Drop, m.dropMessage(message))
+
+	// the first matching expression wins
+	message.Msgs[0].Data = "syscall=59 uid=0 exe=/usr/bin/noisy"
+	assert.Equal(t, Keep, m.dropMessage(message))
+
+	// regex filters still apply next to expressions
+	message.RuleKey = "regex-key"
+	message.Msgs[0].Data = "syscall=59 uid=1000 exe=/usr/bin/quiet"
+	assert.Equal(t, Drop, m.dropMessage(message))
+}
+
+func TestAuditMarshaller_filterActions(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	isRoot, err := CompileExpression(`uid == 0`)
+	assert.Nil(t, err)
+	isSecret, err := CompileExpression(`exe == "/usr/bin/mysql"`)
+	assert.Nil(t, err)
+
+	filters := []AuditFilter{
+		{Key: "db", Action: Tag, Regex: regexp.MustCompile("mysql"), Tags: []string{"database"}},
+		{Key: "db", Action: Redact, Regex: regexp.MustCompile("mysql"), RedactRegex: regexp.MustCompile(`-p[^"\s]+`)},
+		{Key: "db", Action: Tag, Regex: regexp.MustCompile(`-p\S+`), Tags: []string{"not-redacted"}},
+		{Expression: isRoot, Action: Tag, Tags: []string{"database", "root"}, Severity: "high"},
+		{Expression: isSecret, Action: Route, Outputs: []string{"syslog"}},
+		{Expression: isRoot, Action: Sample, SampleRate: 100},
+		{Expression: isRoot, Action: Tag, Severity: "critical"},
+	}
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, filters)
+
+	message := &parser.AuditMessageGroup{
+		RuleKey: "db",
+		Msgs:    []*parser.AuditMessage{{Type: 1300, Data: `uid=0 exe="/usr/bin/mysql"`}, {Type: 1309, Data: `argc=2 a0="mysql" a1="-phunter2"`}},
+	}
+	assert.Equal(t, Keep, m.dropMessage(message))
+
+	// every matching filter applied in order
+	assert.Equal(t, []string{"database", "root"}, message.Tags)
+	assert.Equal(t, "critical", message.Severity)
+	assert.Equal(t, `argc=2 a0="mysql" a1="[REDACTED]"`, message.Msgs[1].Data)
+	assert.Equal(t, []string{"syslog"}, message.Outputs)
+
+	// the writer is not the output the group was routed to
+	m.writeMessage(message, true)
+	assert.Empty(t, w.String())
+
+	// sampling everything out drops the group
+	m = NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{
+		{Expression: isRoot, Action: Sample, SampleRate: 0},
+		{Expression: isRoot, Action: Tag, Tags: []string{"unreachable"}},
+	})
+	message = &parser.AuditMessageGroup{Msgs: []*parser.AuditMessage{{Type: 1300, Data: "uid=0"}}}
+	assert.Equal(t, Drop, m.dropMessage(message))
+	assert.Empty(t, message.Tags)
+}
+
+func TestAuditMarshaller_filterDryRun(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	isRoot, err := CompileExpression(`uid == 0`)
+	assert.Nil(t, err)
+
+	filters := []AuditFilter{
+		{ID: "new-drop", Mode: DryRun, Key: "test-key", Action: Drop, Regex: regexp.MustCompile("uid=0")},
+		{ID: "new-tag", Mode: DryRun, Expression: isRoot, Action: Tag, Tags: []string{"root"}},
+		{Expression: isRoot, Action: Tag, Severity: "high"},
+	}
+	m := NewAuditMarshaller(output.NewAuditWriter(&bytes.Buffer{}, 1), uint16(1100), uint16(1399), false, false, 0, filters)
+	assert.Equal(t, "filter_3", filters[2].ID)
+	assert.Equal(t, "filters.new-drop.matched", filters[0].matchedMetric)
+
+	message := &parser.AuditMessageGroup{
+		RuleKey: "test-key",
+		Msgs:    []*parser.AuditMessage{{Type: 1300, Data: "syscall=59 uid=0"}},
+	}
+
+	// dry run filters annotate the group instead of applying their action
+	assert.Equal(t, Keep, m.dropMessage(message))
+	assert.Equal(t, []string{"new-drop", "new-tag"}, message.DryRunFilters)
+	assert.Empty(t, message.Tags)
+	assert.Equal(t, "high", message.Severity)
+}
+
+func TestAuditMarshaller_newFilterSet(t *testing.T) {
 	w := &bytes.Buffer{}
 
 	filters := []AuditFilter{
@@ -273,9 +464,54 @@ func TestAuditMarshaller_processAndSetFilters(t *testing.T) {
 	}
 	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, filters)
 
-	assert.Equal(t, 2, len(m.filters["test-key"][0]))
-	assert.Equal(t, Keep, m.filters["test-key"][0][0].Action)
-	assert.Equal(t, Drop, m.filters["test-key"][0][1].Action)
+	assert.Equal(t, 2, len(m.filters.Load().filters["test-key"][0]))
+	assert.Equal(t, Keep, m.filters.Load().filters["test-key"][0][0].Action)
+	assert.Equal(t, Drop, m.filters.Load().filters["test-key"][0][1].Action)
+}
+
+func TestAuditMarshaller_SetFilters(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	m := NewAuditMarshaller(output.NewAuditWriter(&bytes.Buffer{}, 1), uint16(1100), uint16(1399), false, false, 0, nil)
+	message := &parser.AuditMessageGroup{
+		RuleKey: "test-key",
+		Msgs:    []*parser.AuditMessage{{Type: 1300, Data: "exe=/usr/bin/noisy"}},
+	}
+	assert.Equal(t, Keep, m.dropMessage(message))
+
+	m.SetFilters([]AuditFilter{{Key: "test-key", Action: Drop, Regex: regexp.MustCompile("noisy")}})
+	assert.Equal(t, Drop, m.dropMessage(message))
+
+	m.SetFilters(nil)
+	assert.Equal(t, Keep, m.dropMessage(message))
+}
+
+func TestAuditMarshaller_SetWriter(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	first := &bytes.Buffer{}
+	second := &bytes.Buffer{}
+	firstWriter := output.NewAuditWriter(first, 1)
+	m := NewAuditMarshaller(firstWriter, uint16(1100), uint16(1399), false, false, 0, nil)
+
+	assert.Same(t, firstWriter, m.SetWriter(output.NewAuditWriter(second, 1)))
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300), Flags: uint16(syscall.NLM_F_REQUEST), Seq: uint32(1), Pid: uint32(0)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+	m.Consume(new1320("1"))
+
+	assert.Equal(t, 0, first.Len())
+	assert.Contains(t, second.String(), "hi there")
 }
 
 func new1320(seq string) *syscall.NetlinkMessage {
@@ -291,6 +527,23 @@ func new1320(seq string) *syscall.NetlinkMessage {
 	}
 }
 
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
 type FailWriter struct{}
 
 func (f *FailWriter) Write(_ []byte) (n int, err error) {
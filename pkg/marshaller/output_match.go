@@ -0,0 +1,129 @@
+package marshaller
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+// OutputMatch decides which groups are written to an output. Every criterion that is set has to
+// match, a list matches when any of its entries does
+type OutputMatch struct {
+	Keys         []string // rule keys, any of the keys of the group
+	MessageTypes []uint16 // the group has a message of one of the types
+	Tags         []string // tags added by filters
+	Expression   *Expression
+}
+
+// NewOutputMatch creates the match of an output from the output.<name>.match config entry
+func NewOutputMatch(output string, obj map[string]interface{}) (*OutputMatch, error) {
+	om := &OutputMatch{}
+
+	for k, v := range obj {
+		var err error
+		switch k {
+		case "keys":
+			om.Keys, err = parseMatchStrings(output, k, v)
+		case "tags":
+			om.Tags, err = parseMatchStrings(output, k, v)
+		case "message_types":
+			om.MessageTypes, err = parseMatchMessageTypes(output, v)
+		case "expression":
+			expr, ok := v.(string)
+			if !ok {
+				err = fmt.Errorf("`expression` in the match of output %s could not be parsed; Value: `%+v`", output, v)
+				break
+			}
+			if om.Expression, err = CompileExpression(expr); err != nil {
+				err = fmt.Errorf("`expression` in the match of output %s could not be parsed; Value: `%+v`; Error: %s", output, v, err)
+			}
+		default:
+			err = fmt.Errorf("unknown entry `%s` in the match of output %s", k, output)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(om.Keys) == 0 && len(om.MessageTypes) == 0 && len(om.Tags) == 0 && om.Expression == nil {
+		return nil, fmt.Errorf("the match of output %s needs at least one of `keys`, `message_types`, `tags` or `expression`", output)
+	}
+
+	return om, nil
+}
+
+func parseMatchStrings(output string, name string, v interface{}) ([]string, error) {
+	switch value := v.(type) {
+	case string:
+		return []string{value}, nil
+	case []string:
+		return value, nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, e := range value {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("`%s` in the match of output %s could not be parsed; Value: `%+v`", name, output, v)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("`%s` in the match of output %s could not be parsed; Value: `%+v`", name, output, v)
+}
+
+func parseMatchMessageTypes(output string, v interface{}) ([]uint16, error) {
+	values, ok := v.([]interface{})
+	if !ok {
+		values = []interface{}{v}
+	}
+
+	types := make([]uint16, 0, len(values))
+	for _, e := range values {
+		var mt int
+		switch value := e.(type) {
+		case int:
+			mt = value
+		case string:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("`message_types` in the match of output %s could not be parsed; Value: `%+v`; Error: %s", output, e, err)
+			}
+			mt = n
+		default:
+			return nil, fmt.Errorf("`message_types` in the match of output %s could not be parsed; Value: `%+v`", output, e)
+		}
+
+		if mt < 0 || mt > math.MaxUint16 {
+			return nil, fmt.Errorf("`message_types` in the match of output %s is out of range; Value: `%+v`", output, e)
+		}
+		types = append(types, uint16(mt))
+	}
+
+	return types, nil
+}
+
+// Match reports whether the group is written to the output
+func (om *OutputMatch) Match(msg *parser.AuditMessageGroup) bool {
+	if len(om.Keys) > 0 && !slices.ContainsFunc(om.Keys, msg.HasRuleKey) {
+		return false
+	}
+
+	if len(om.MessageTypes) > 0 && !slices.ContainsFunc(msg.Msgs, func(am *parser.AuditMessage) bool {
+		return slices.Contains(om.MessageTypes, am.Type)
+	}) {
+		return false
+	}
+
+	if len(om.Tags) > 0 && !slices.ContainsFunc(om.Tags, func(tag string) bool {
+		return slices.Contains(msg.Tags, tag)
+	}) {
+		return false
+	}
+
+	return om.Expression == nil || om.Expression.Match(msg)
+}
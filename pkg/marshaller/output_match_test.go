@@ -0,0 +1,81 @@
+package marshaller
+
+import (
+	"testing"
+
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOutputMatch(t *testing.T) {
+	om, err := NewOutputMatch("file", map[string]interface{}{
+		"keys":          []interface{}{"passwd-write-log", "shadow"},
+		"message_types": []interface{}{1300, "1309"},
+		"tags":          "compliance",
+		"expression":    `uid == 0`,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"passwd-write-log", "shadow"}, om.Keys)
+	assert.Equal(t, []uint16{1300, 1309}, om.MessageTypes)
+	assert.Equal(t, []string{"compliance"}, om.Tags)
+	assert.Equal(t, `uid == 0`, om.Expression.String())
+
+	om, err = NewOutputMatch("file", map[string]interface{}{"message_types": 1309})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{1309}, om.MessageTypes)
+
+	tests := []struct {
+		obj map[string]interface{}
+		err string
+	}{
+		{map[string]interface{}{}, "the match of output file needs at least one of `keys`, `message_types`, `tags` or `expression`"},
+		{map[string]interface{}{"key": "x"}, "unknown entry `key` in the match of output file"},
+		{map[string]interface{}{"keys": 1}, "`keys` in the match of output file could not be parsed; Value: `1`"},
+		{map[string]interface{}{"tags": []interface{}{1}}, "`tags` in the match of output file could not be parsed; Value: `[1]`"},
+		{map[string]interface{}{"message_types": "x"}, "`message_types` in the match of output file could not be parsed; Value: `x`; Error: strconv.Atoi: parsing \"x\": invalid syntax"},
+		{map[string]interface{}{"message_types": 70000}, "`message_types` in the match of output file is out of range; Value: `70000`"},
+		{map[string]interface{}{"expression": "uid =="}, "`expression` in the match of output file could not be parsed; Value: `uid ==`; Error: expected a string or number at offset 6, got end of expression"},
+	}
+	for _, tt := range tests {
+		_, err := NewOutputMatch("file", tt.obj)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestOutputMatch_Match(t *testing.T) {
+	group := func(key string, tags []string, data string) *parser.AuditMessageGroup {
+		return &parser.AuditMessageGroup{
+			RuleKey: key,
+			Tags:    tags,
+			Msgs: []*parser.AuditMessage{
+				{Type: 1300, Data: data},
+				{Type: 1302, Data: `item=0 name="/etc/passwd"`},
+			},
+		}
+	}
+
+	expr, err := CompileExpression(`uid == 0`)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name  string
+		match OutputMatch
+		group *parser.AuditMessageGroup
+		want  bool
+	}{
+		{"any key", OutputMatch{Keys: []string{"a", "passwd-write-log"}}, group("passwd-write-log", nil, ""), true},
+		{"other key", OutputMatch{Keys: []string{"a"}}, group("passwd-write-log", nil, ""), false},
+		{"message type", OutputMatch{MessageTypes: []uint16{1302}}, group("x", nil, ""), true},
+		{"missing message type", OutputMatch{MessageTypes: []uint16{1309}}, group("x", nil, ""), false},
+		{"tag", OutputMatch{Tags: []string{"compliance"}}, group("x", []string{"noisy", "compliance"}, ""), true},
+		{"no tags", OutputMatch{Tags: []string{"compliance"}}, group("x", nil, ""), false},
+		{"expression", OutputMatch{Expression: expr}, group("x", nil, "uid=0"), true},
+		{"expression mismatch", OutputMatch{Expression: expr}, group("x", nil, "uid=1000"), false},
+		{"all criteria", OutputMatch{Keys: []string{"x"}, Expression: expr}, group("x", nil, "uid=0"), true},
+		{"one criterion fails", OutputMatch{Keys: []string{"x"}, Expression: expr}, group("x", nil, "uid=1000"), false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.match.Match(tt.group), tt.name)
+	}
+}
@@ -0,0 +1,127 @@
+package marshaller
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+// EvictionPolicy decides what happens to the oldest pending groups once the pending group
+// table is full
+type EvictionPolicy string
+
+const (
+	// EvictFlush completes the oldest groups early, they are written with the messages seen so far
+	EvictFlush EvictionPolicy = "flush"
+	// EvictDrop discards the oldest groups without writing them
+	EvictDrop EvictionPolicy = "drop"
+)
+
+// PendingLimits bounds the groups waiting for more messages. A zero limit is unlimited
+type PendingLimits struct {
+	MaxGroups int
+	MaxBytes  int // sum of the message data held by pending groups
+	Policy    EvictionPolicy
+}
+
+// ParseEvictionPolicy validates an eviction policy from the config, empty means EvictFlush
+func ParseEvictionPolicy(policy string) (EvictionPolicy, error) {
+	switch EvictionPolicy(policy) {
+	case "", EvictFlush:
+		return EvictFlush, nil
+	case EvictDrop:
+		return EvictDrop, nil
+	}
+
+	return "", fmt.Errorf("unknown eviction policy %q, expected %q or %q", policy, EvictFlush, EvictDrop)
+}
+
+// SetPendingLimits caps the pending group table, groups are evicted oldest first once either
+// limit is exceeded
+func (a *AuditMarshaller) SetPendingLimits(limits PendingLimits) {
+	if limits.Policy == "" {
+		limits.Policy = EvictFlush
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.limits = limits
+	a.enforceLimits()
+}
+
+// exceeds reports whether the pending table holds more than maxGroups or maxBytes, for the
+// limits that are enabled
+func (a *AuditMarshaller) exceeds(maxGroups int, maxBytes int) bool {
+	return (a.limits.MaxGroups > 0 && len(a.msgs) > maxGroups) ||
+		(a.limits.MaxBytes > 0 && a.pendingBytes > maxBytes)
+}
+
+// enforceLimits evicts the oldest pending groups when the table is over its limits. It
+// evicts down to 90% of the limits so a sustained burst does not sort the table on every message
+func (a *AuditMarshaller) enforceLimits() {
+	if !a.exceeds(a.limits.MaxGroups, a.limits.MaxBytes) {
+		return
+	}
+
+	seqs := make([]int, 0, len(a.msgs))
+	for seq := range a.msgs {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+
+	targetGroups := a.limits.MaxGroups * 9 / 10
+	targetBytes := a.limits.MaxBytes * 9 / 10
+	evicted := 0
+	for _, seq := range seqs {
+		if !a.exceeds(targetGroups, targetBytes) {
+			break
+		}
+
+		if a.limits.Policy == EvictDrop {
+			msg := a.removeGroup(seq)
+			msg.Release()
+		} else {
+			a.completeMessage(seq)
+		}
+		evicted++
+	}
+
+	if a.limits.Policy == EvictDrop {
+		logger.Error("Pending group table is full, dropped the oldest groups", "dropped", evicted, "groups", len(a.msgs), "bytes", a.pendingBytes)
+		metric.GetClient().Count("marshaller.pending.dropped", evicted)
+	} else {
+		metric.GetClient().Count("marshaller.pending.early_flushed", evicted)
+	}
+}
+
+// removeGroup takes a group out of the pending table
+func (a *AuditMarshaller) removeGroup(seq int) *parser.AuditMessageGroup {
+	msg, ok := a.msgs[seq]
+	if !ok {
+		return nil
+	}
+
+	delete(a.msgs, seq)
+	a.pendingBytes -= groupSize(msg)
+
+	return msg
+}
+
+// reportPending sends the occupancy of the pending group table
+func (a *AuditMarshaller) reportPending() {
+	metric.GetClient().Gauge("marshaller.pending.groups", len(a.msgs))
+	metric.GetClient().Gauge("marshaller.pending.bytes", a.pendingBytes)
+}
+
+func groupSize(msg *parser.AuditMessageGroup) int {
+	size := 0
+	for _, am := range msg.Msgs {
+		size += len(am.Data)
+	}
+
+	return size
+}
@@ -0,0 +1,80 @@
+package marshaller
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/output"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEvictionPolicy(t *testing.T) {
+	policy, err := ParseEvictionPolicy("")
+	assert.Nil(t, err)
+	assert.Equal(t, EvictFlush, policy)
+
+	policy, err = ParseEvictionPolicy("drop")
+	assert.Nil(t, err)
+	assert.Equal(t, EvictDrop, policy)
+
+	_, err = ParseEvictionPolicy("panic")
+	assert.EqualError(t, err, `unknown eviction policy "panic", expected "flush" or "drop"`)
+}
+
+func TestAuditMarshaller_pendingLimitsFlush(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+	m.SetPendingLimits(PendingLimits{MaxGroups: 10})
+
+	for _, seq := range []string{"3", "1", "2", "4", "5", "6", "7", "8", "9", "10"} {
+		m.Consume(newSyscall(seq, "10000001.000"))
+	}
+	assert.Empty(t, w.String())
+	assert.Len(t, m.msgs, 10)
+
+	// Going over the limit flushes the oldest sequences until 90% of the limit is left
+	m.Consume(newSyscall("11", "10000001.000"))
+	assert.Len(t, m.msgs, 9)
+	assert.Equal(t, "{\"sequence\":1,", w.String()[:14])
+	assert.Equal(t, 2, strings.Count(w.String(), "\n"))
+	assert.Contains(t, w.String(), "\"sequence\":2,")
+	assert.Equal(t, 9*len("hi there"), m.pendingBytes)
+}
+
+func TestAuditMarshaller_pendingLimitsDrop(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+	m.SetPendingLimits(PendingLimits{MaxBytes: 3 * len("hi there"), Policy: EvictDrop})
+
+	for _, seq := range []string{"1", "2", "3", "4"} {
+		m.Consume(newSyscall(seq, "10000001.000"))
+	}
+
+	// Dropped groups are never written
+	assert.Empty(t, w.String())
+	assert.Len(t, m.msgs, 2)
+	assert.Contains(t, m.msgs, 3)
+	assert.Contains(t, m.msgs, 4)
+	assert.Equal(t, 2*len("hi there"), m.pendingBytes)
+
+	// Completed groups give their bytes back
+	m.Consume(new1320("3"))
+	m.Consume(new1320("4"))
+	assert.Equal(t, 0, m.pendingBytes)
+	assert.Equal(t, 2, strings.Count(w.String(), "\n"))
+}
@@ -0,0 +1,209 @@
+package marshaller
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+const (
+	defaultPipelineReceiveBuffer   = 8192
+	defaultPipelineWorkBuffer      = 1024
+	defaultPipelineMetricsInterval = 10 * time.Second
+)
+
+// PipelineConfig holds the sizing of the pipeline stages
+type PipelineConfig struct {
+	Workers         int           // number of parallel enrich/filter workers, defaults to the number of CPUs
+	ReceiveBuffer   int           // number of messages buffered between the receiver and the grouping stage
+	WorkBuffer      int           // number of groups buffered for each worker and for the output stage
+	MetricsInterval time.Duration // how often queue depths are reported
+}
+
+// Pipeline runs the marshaller as a set of stages connected by bounded queues so a slow
+// output does not stall reading from the netlink socket:
+//
+//	receiver -> grouping -> enrich/filter workers (sharded by sequence) -> in order output
+//
+// Groups are numbered as they complete and the output stage restores that order before
+// writing, so events are written in the same order as with the plain AuditMarshaller
+type Pipeline struct {
+	marshaller *AuditMarshaller
+	received   chan *parser.AuditMessage // ring buffer between the receiver and the grouping stage
+	work       []chan *pipelineItem      // one queue per worker, groups are sharded by sequence
+	results    chan *pipelineItem        // processed groups waiting to be written in order
+	nextTicket uint64                    // guarded by the marshaller lock
+	reordering atomic.Int64              // groups held back by the output stage waiting for an earlier one
+	workers    *sync.WaitGroup
+	done       chan struct{}
+}
+
+type pipelineItem struct {
+	ticket uint64
+	group  *parser.AuditMessageGroup
+	keep   bool
+}
+
+var itemPool = sync.Pool{
+	New: func() any {
+		return &pipelineItem{}
+	},
+}
+
+// NewPipeline starts the pipeline stages around the marshaller. Once started all messages
+// must be handed to Pipeline.Consume instead of AuditMarshaller.Consume
+func NewPipeline(a *AuditMarshaller, config PipelineConfig) *Pipeline {
+	if config.Workers < 1 {
+		config.Workers = runtime.NumCPU()
+	}
+
+	if config.ReceiveBuffer < 1 {
+		config.ReceiveBuffer = defaultPipelineReceiveBuffer
+	}
+
+	if config.WorkBuffer < 1 {
+		config.WorkBuffer = defaultPipelineWorkBuffer
+	}
+
+	if config.MetricsInterval <= 0 {
+		config.MetricsInterval = defaultPipelineMetricsInterval
+	}
+
+	p := &Pipeline{
+		marshaller: a,
+		received:   make(chan *parser.AuditMessage, config.ReceiveBuffer),
+		work:       make([]chan *pipelineItem, config.Workers),
+		results:    make(chan *pipelineItem, config.WorkBuffer),
+		workers:    &sync.WaitGroup{},
+		done:       make(chan struct{}),
+	}
+	// the flush timer may already be completing groups
+	a.lock.Lock()
+	a.pipeline = p
+	a.lock.Unlock()
+
+	p.workers.Add(config.Workers)
+	for i := range p.work {
+		p.work[i] = make(chan *pipelineItem, config.WorkBuffer)
+		go p.process(p.work[i])
+	}
+
+	go func() {
+		p.workers.Wait()
+		close(p.results)
+	}()
+
+	go p.group()
+	go p.emit()
+	go p.reportQueueDepths(config.MetricsInterval)
+
+	return p
+}
+
+// Consume copies the netlink message and queues it for the grouping stage. It only blocks
+// when the receive buffer is full
+func (p *Pipeline) Consume(nlMsg *syscall.NetlinkMessage) {
+	aMsg := parser.NewAuditMessage(nlMsg)
+
+	select {
+	case p.received <- aMsg:
+	default:
+		metric.GetClient().Increment("pipeline.receive_buffer_full")
+		p.received <- aMsg
+	}
+}
+
+// Close stops accepting messages, completes every pending message group and waits for
+// all of them to be written. Consume must not be called afterwards
+func (p *Pipeline) Close() {
+	close(p.received)
+	<-p.done
+}
+
+// group feeds the marshaller's group table, only the flush timer touches it as well
+func (p *Pipeline) group() {
+	for aMsg := range p.received {
+		p.marshaller.consume(aMsg)
+	}
+
+	// Nothing else is coming, complete whatever is left
+	p.marshaller.Flush()
+
+	for _, work := range p.work {
+		close(work)
+	}
+}
+
+// dispatch numbers a complete group and hands it to the worker owning its sequence
+func (p *Pipeline) dispatch(msg *parser.AuditMessageGroup) {
+	item := itemPool.Get().(*pipelineItem)
+	item.ticket = p.nextTicket
+	item.group = msg
+	p.nextTicket++
+
+	p.work[msg.Seq%len(p.work)] <- item
+}
+
+func (p *Pipeline) process(work <-chan *pipelineItem) {
+	defer p.workers.Done()
+
+	for item := range work {
+		item.keep = p.marshaller.processMessage(item.group)
+		p.results <- item
+	}
+}
+
+// emit writes the processed groups in the order they were completed
+func (p *Pipeline) emit() {
+	defer close(p.done)
+
+	pending := make(map[uint64]*pipelineItem)
+	next := uint64(0)
+
+	for item := range p.results {
+		pending[item.ticket] = item
+
+		for {
+			ready, ok := pending[next]
+			if !ok {
+				break
+			}
+
+			delete(pending, next)
+			next++
+
+			p.marshaller.writeMessage(ready.group, ready.keep)
+			*ready = pipelineItem{}
+			itemPool.Put(ready)
+		}
+
+		p.reordering.Store(int64(len(pending)))
+	}
+}
+
+func (p *Pipeline) reportQueueDepths(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			work := 0
+			for _, w := range p.work {
+				work += len(w)
+			}
+
+			metric.GetClient().Gauge("pipeline.queue.received", len(p.received))
+			metric.GetClient().Gauge("pipeline.queue.work", work)
+			metric.GetClient().Gauge("pipeline.queue.results", len(p.results))
+			metric.GetClient().Gauge("pipeline.queue.reorder", p.reordering.Load())
+		}
+	}
+}
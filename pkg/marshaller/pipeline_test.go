@@ -0,0 +1,72 @@
+package marshaller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/output"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline_Consume(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	filters := []AuditFilter{
+		{
+			Key:    "test-key",
+			Action: Drop,
+			Regex:  regexp.MustCompile("drop me"),
+		},
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, filters)
+	p := NewPipeline(m, PipelineConfig{Workers: 4, ReceiveBuffer: 16, WorkBuffer: 4})
+
+	for seq := 1; seq <= 200; seq++ {
+		data := "keep me"
+		if seq%10 == 0 {
+			data = "drop me"
+		}
+
+		p.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte(fmt.Sprintf(`audit(10000001:%d): syscall=59 %s key="test-key"`, seq, data)),
+		})
+
+		// leave the last few groups without an EOE, closing the pipeline completes them
+		if seq <= 195 {
+			p.Consume(new1320(fmt.Sprint(seq)))
+		}
+	}
+
+	p.Close()
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Equal(t, 180, len(lines))
+
+	last := 0
+	for _, line := range lines {
+		group := struct {
+			Seq int `json:"sequence"`
+		}{}
+		if err := json.Unmarshal([]byte(line), &group); err != nil {
+			t.Fatalf("Failed to unmarshal output: %v", err)
+		}
+		assert.Greater(t, group.Seq, last, "groups should be written in order")
+		assert.NotZero(t, group.Seq%10, "filtered groups should not be written")
+		last = group.Seq
+	}
+	assert.Equal(t, 0, len(m.msgs))
+}
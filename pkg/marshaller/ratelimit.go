@@ -0,0 +1,357 @@
+package marshaller
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+const (
+	// SuppressedRecordKey is the rule key of the synthetic records summarizing rate limited groups
+	SuppressedRecordKey = "pauditd_suppressed"
+	// EventSuppressed is the message type of a suppressed record. Like lost records they are
+	// identified by their rule key
+	EventSuppressed = 0
+)
+
+// RateLimitBy is the part of a group a rate limit keeps its buckets for
+type RateLimitBy string
+
+const (
+	// RateLimitByKey keeps a bucket per rule key
+	RateLimitByKey RateLimitBy = exprFieldKey
+	// RateLimitBySyscall keeps a bucket per syscall
+	RateLimitBySyscall RateLimitBy = exprFieldSyscall
+	// RateLimitByUID keeps a bucket per uid
+	RateLimitByUID RateLimitBy = "uid"
+)
+
+var rateRegex = regexp.MustCompile(`^\s*([0-9.]+)\s*(?:/\s*(s|m|h))?\s*$`)
+
+// RateLimit is a token bucket for the groups with the same value of By. Groups over the limit
+// are suppressed and counted in a summary record
+type RateLimit struct {
+	ID    string
+	By    RateLimitBy
+	Value string  // only groups with this value are limited, when empty every value gets its own bucket
+	Rate  float64 // groups per second
+	Burst int     // groups allowed at once, the bucket size
+
+	suppressedMetric string
+}
+
+// NewRateLimit creates a rate limit from a config entry
+func NewRateLimit(limitNumber int, obj map[string]interface{}) (*RateLimit, error) {
+	rl := &RateLimit{ID: fmt.Sprintf("rate_limit_%d", limitNumber)}
+
+	for k, v := range obj {
+		var err error
+		switch k {
+		case "id":
+			rl.ID, err = parseRateLimitString(limitNumber, k, v)
+			if err == nil && !filterIDPattern.MatchString(rl.ID) {
+				err = fmt.Errorf("`id` in rate limit %d could not be parsed, only letters, digits, _ and - are allowed; Value: `%+v`", limitNumber, v)
+			}
+		case "by":
+			var by string
+			by, err = parseRateLimitString(limitNumber, k, v)
+			rl.By = RateLimitBy(by)
+		case "value":
+			err = parseRateLimitValue(limitNumber, v, rl)
+		case "rate":
+			rl.Rate, err = parseRate(limitNumber, v)
+		case "burst":
+			burst, ok := v.(int)
+			if !ok || burst < 1 {
+				err = fmt.Errorf("`burst` in rate limit %d must be a whole number above 0; Value: `%+v`", limitNumber, v)
+			}
+			rl.Burst = burst
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch rl.By {
+	case RateLimitByKey, RateLimitBySyscall, RateLimitByUID:
+	case "":
+		return nil, fmt.Errorf("rate limit %d is missing the `by` entry", limitNumber)
+	default:
+		return nil, fmt.Errorf("`by` in rate limit %d must be one of key, syscall or uid; Value: `%s`", limitNumber, rl.By)
+	}
+
+	if rl.Rate <= 0 {
+		return nil, fmt.Errorf("rate limit %d is missing the `rate` entry", limitNumber)
+	}
+
+	if rl.Burst == 0 {
+		rl.Burst = max(1, int(rl.Rate))
+	}
+
+	if rl.By == RateLimitBySyscall && rl.Value != "" {
+		if _, err := strconv.Atoi(rl.Value); err != nil {
+			num, ok := syscallNumbers[rl.Value]
+			if !ok {
+				return nil, fmt.Errorf("`value` in rate limit %d is not a known syscall; Value: `%s`", limitNumber, rl.Value)
+			}
+			rl.Value = strconv.Itoa(num)
+		}
+	}
+
+	logger.Info("Rate limiting messages", "id", rl.ID, "by", rl.By, "value", rl.Value, "rate", rl.Rate, "burst", rl.Burst)
+	return rl, nil
+}
+
+func parseRateLimitString(limitNumber int, name string, v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("`%s` in rate limit %d could not be parsed; Value: `%+v`", name, limitNumber, v)
+	}
+	return s, nil
+}
+
+func parseRateLimitValue(limitNumber int, v interface{}, rl *RateLimit) error {
+	switch value := v.(type) {
+	case string:
+		rl.Value = value
+	case int:
+		rl.Value = strconv.Itoa(value)
+	default:
+		return fmt.Errorf("`value` in rate limit %d could not be parsed; Value: `%+v`", limitNumber, v)
+	}
+	return nil
+}
+
+// parseRate reads a rate in groups per second, or per minute or hour with a /m or /h suffix
+func parseRate(limitNumber int, v interface{}) (float64, error) {
+	switch rate := v.(type) {
+	case int:
+		return float64(rate), nil
+	case float64:
+		return rate, nil
+	case string:
+		m := rateRegex.FindStringSubmatch(rate)
+		if m == nil {
+			break
+		}
+		n, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("`rate` in rate limit %d could not be parsed; Value: `%+v`; Error: %s", limitNumber, v, err)
+		}
+		switch m[2] {
+		case "m":
+			n /= 60
+		case "h":
+			n /= 3600
+		}
+		return n, nil
+	}
+
+	return 0, fmt.Errorf("`rate` in rate limit %d could not be parsed; Value: `%+v`", limitNumber, v)
+}
+
+type bucketKey struct {
+	limit int
+	value string
+}
+
+type tokenBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed int // groups suppressed in the current summary window
+}
+
+// suppression is the number of groups one bucket suppressed in a summary window
+type suppression struct {
+	limit      *RateLimit
+	value      string
+	count      int
+	windowFrom time.Time
+	windowTo   time.Time
+}
+
+// rateLimiter keeps the buckets of every rate limit, it is shared by the pipeline workers
+type rateLimiter struct {
+	lock        sync.Mutex
+	limits      []RateLimit
+	fields      map[string]bool // data fields needed to find the bucket of a group
+	buckets     map[bucketKey]*tokenBucket
+	interval    time.Duration // how often suppressed groups are summarized
+	windowStart time.Time
+}
+
+func newRateLimiter(limits []RateLimit, summaryInterval time.Duration, now time.Time) *rateLimiter {
+	r := &rateLimiter{
+		limits:      limits,
+		fields:      make(map[string]bool),
+		buckets:     make(map[bucketKey]*tokenBucket),
+		interval:    summaryInterval,
+		windowStart: now,
+	}
+
+	for idx := range r.limits {
+		r.limits[idx].suppressedMetric = "rate_limits." + r.limits[idx].ID + ".suppressed"
+		if r.limits[idx].By == RateLimitByUID {
+			r.fields[string(RateLimitByUID)] = true
+		}
+	}
+
+	return r
+}
+
+// allow takes a token from every bucket the group belongs to. When any of them is empty the group
+// is suppressed, no tokens are taken and the empty buckets count it
+func (r *rateLimiter) allow(msg *parser.AuditMessageGroup, now time.Time) bool {
+	fields := collectFields(msg, r.fields)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var buckets [8]*tokenBucket
+	matched := buckets[:0]
+	allowed := true
+	for idx := range r.limits {
+		limit := &r.limits[idx]
+		values := fields.get(string(limit.By))
+		if limit.By == RateLimitByUID && len(values) > 1 {
+			// the uid of the syscall record comes first, later records only add the uid of objects
+			values = values[:1]
+		}
+
+		for _, value := range values {
+			if limit.Value != "" && value != limit.Value {
+				continue
+			}
+
+			b := r.bucket(idx, value, now)
+			if b.tokens < 1 {
+				b.suppressed++
+				metric.GetClient().Increment(limit.suppressedMetric)
+				allowed = false
+			}
+			matched = append(matched, b)
+		}
+	}
+
+	if allowed {
+		for _, b := range matched {
+			b.tokens--
+		}
+	}
+
+	return allowed
+}
+
+// bucket returns the refilled bucket of value, creating a full one when there is none
+func (r *rateLimiter) bucket(limit int, value string, now time.Time) *tokenBucket {
+	key := bucketKey{limit: limit, value: value}
+	b, ok := r.buckets[key]
+	if !ok {
+		// the value points into the message buffer, which goes back to the pool with the group
+		key.value = strings.Clone(value)
+		b = &tokenBucket{tokens: float64(r.limits[limit].Burst), last: now}
+		r.buckets[key] = b
+		return b
+	}
+
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(float64(r.limits[limit].Burst), b.tokens+elapsed*r.limits[limit].Rate)
+		b.last = now
+	}
+
+	return b
+}
+
+// summarize returns what was suppressed since the last summary once the summary interval has
+// passed, or right away when force is set. Buckets that filled up again are forgotten
+func (r *rateLimiter) summarize(now time.Time, force bool) []suppression {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !force && now.Sub(r.windowStart) < r.interval {
+		return nil
+	}
+
+	var summaries []suppression
+	for key, b := range r.buckets {
+		if b.suppressed > 0 {
+			summaries = append(summaries, suppression{
+				limit:      &r.limits[key.limit],
+				value:      key.value,
+				count:      b.suppressed,
+				windowFrom: r.windowStart,
+				windowTo:   now,
+			})
+			b.suppressed = 0
+			continue
+		}
+
+		if r.bucket(key.limit, key.value, now).tokens >= float64(r.limits[key.limit].Burst) {
+			delete(r.buckets, key)
+		}
+	}
+	r.windowStart = now
+
+	slices.SortFunc(summaries, func(a, b suppression) int {
+		return cmp.Or(strings.Compare(a.limit.ID, b.limit.ID), strings.Compare(a.value, b.value))
+	})
+
+	return summaries
+}
+
+// SetRateLimits replaces the rate limits of the marshaller. Groups suppressed by the previous
+// limits are summarized right away, summaries are written every summaryInterval
+func (a *AuditMarshaller) SetRateLimits(limits []RateLimit, summaryInterval time.Duration) {
+	var limiter *rateLimiter
+	if len(limits) > 0 {
+		limiter = newRateLimiter(limits, summaryInterval, time.Now())
+	}
+
+	if old := a.limiter.Swap(limiter); old != nil {
+		a.lock.Lock()
+		a.reportSuppressed(old, true)
+		a.lock.Unlock()
+	}
+}
+
+// rateLimited reports whether the group is over any of the rate limits
+func (a *AuditMarshaller) rateLimited(msg *parser.AuditMessageGroup) bool {
+	limiter := a.limiter.Load()
+	return limiter != nil && !limiter.allow(msg, time.Now())
+}
+
+// reportSuppressed writes a suppressed record for every bucket that suppressed groups once the
+// summary is due. Must be called with the lock held
+func (a *AuditMarshaller) reportSuppressed(limiter *rateLimiter, force bool) {
+	if limiter == nil {
+		return
+	}
+
+	for _, s := range limiter.summarize(time.Now(), force) {
+		logger.Info("Suppressed rate limited messages", "id", s.limit.ID, "by", s.limit.By, "value", s.value, "count", s.count)
+		a.complete(suppressedRecord(s))
+	}
+}
+
+func isSuppressedRecord(msg *parser.AuditMessageGroup) bool {
+	return msg.RuleKey == SuppressedRecordKey && len(msg.Msgs) == 1 && msg.Msgs[0].Type == EventSuppressed
+}
+
+// suppressedRecord builds the synthetic group summarizing the groups a bucket suppressed
+func suppressedRecord(s suppression) *parser.AuditMessageGroup {
+	data := fmt.Sprintf(
+		"%s id=%s by=%s value=%s suppressed=%d window_start=%s window_end=%s",
+		SuppressedRecordKey, s.limit.ID, s.limit.By, strconv.Quote(s.value), s.count, auditTimestamp(s.windowFrom), auditTimestamp(s.windowTo),
+	)
+
+	return syntheticRecord(SuppressedRecordKey, EventSuppressed, 0, data)
+}
@@ -0,0 +1,161 @@
+package marshaller
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/output"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRateLimit(t *testing.T) {
+	rl, err := NewRateLimit(1, map[string]interface{}{"by": "key", "value": "exec", "rate": 10})
+	assert.Nil(t, err)
+	assert.Equal(t, RateLimit{ID: "rate_limit_1", By: RateLimitByKey, Value: "exec", Rate: 10, Burst: 10}, *rl)
+
+	rl, err = NewRateLimit(2, map[string]interface{}{"id": "ci", "by": "uid", "value": 1000, "rate": "120/m", "burst": 5})
+	assert.Nil(t, err)
+	assert.Equal(t, RateLimit{ID: "ci", By: RateLimitByUID, Value: "1000", Rate: 2, Burst: 5}, *rl)
+
+	rl, err = NewRateLimit(3, map[string]interface{}{"by": "syscall", "value": "execve", "rate": "0.5"})
+	assert.Nil(t, err)
+	assert.Equal(t, "59", rl.Value)
+	assert.Equal(t, 1, rl.Burst, "burst is at least 1")
+
+	tests := []struct {
+		obj map[string]interface{}
+		err string
+	}{
+		{map[string]interface{}{"rate": 1}, "rate limit 1 is missing the `by` entry"},
+		{map[string]interface{}{"by": "exe", "rate": 1}, "`by` in rate limit 1 must be one of key, syscall or uid; Value: `exe`"},
+		{map[string]interface{}{"by": "key"}, "rate limit 1 is missing the `rate` entry"},
+		{map[string]interface{}{"by": "key", "rate": "fast"}, "`rate` in rate limit 1 could not be parsed; Value: `fast`"},
+		{map[string]interface{}{"by": "key", "rate": "1/d"}, "`rate` in rate limit 1 could not be parsed; Value: `1/d`"},
+		{map[string]interface{}{"by": "key", "rate": 1, "burst": 0}, "`burst` in rate limit 1 must be a whole number above 0; Value: `0`"},
+		{map[string]interface{}{"by": "key", "rate": 1, "id": "a b"}, "`id` in rate limit 1 could not be parsed, only letters, digits, _ and - are allowed; Value: `a b`"},
+		{map[string]interface{}{"by": "syscall", "value": "nope", "rate": 1}, "`value` in rate limit 1 is not a known syscall; Value: `nope`"},
+		{map[string]interface{}{"by": "key", "value": []string{}, "rate": 1}, "`value` in rate limit 1 could not be parsed; Value: `[]`"},
+	}
+	for _, tt := range tests {
+		_, err := NewRateLimit(1, tt.obj)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestRateLimiter_allow(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	now := time.Unix(10000000, 0)
+	r := newRateLimiter([]RateLimit{
+		{ID: "exec", By: RateLimitByKey, Value: "exec", Rate: 1, Burst: 2},
+		{ID: "users", By: RateLimitByUID, Rate: 1, Burst: 3},
+	}, time.Minute, now)
+
+	group := func(key string, uid string) *parser.AuditMessageGroup {
+		return &parser.AuditMessageGroup{
+			RuleKey: key,
+			Msgs: []*parser.AuditMessage{
+				{Type: 1300, Data: "syscall=59 uid=" + uid},
+				{Type: 1302, Data: "name=/bin/true ouid=0 uid=0"},
+			},
+		}
+	}
+
+	// the burst of the exec key runs out first
+	assert.True(t, r.allow(group("exec", "1000"), now))
+	assert.True(t, r.allow(group("exec", "1000"), now))
+	assert.False(t, r.allow(group("exec", "1000"), now))
+
+	// other keys are only limited per uid, the suppressed group did not take a uid token
+	assert.True(t, r.allow(group("other", "1000"), now))
+	assert.False(t, r.allow(group("other", "1000"), now))
+	assert.True(t, r.allow(group("other", "1001"), now))
+
+	// tokens come back at the rate
+	now = now.Add(time.Second)
+	assert.True(t, r.allow(group("exec", "1002"), now))
+	assert.False(t, r.allow(group("exec", "1002"), now))
+
+	// nothing to summarize before the interval passed
+	assert.Nil(t, r.summarize(now, false))
+
+	later := now.Add(time.Minute)
+	summaries := r.summarize(later, false)
+	if assert.Len(t, summaries, 2) {
+		assert.Equal(t, "exec", summaries[0].limit.ID)
+		assert.Equal(t, "exec", summaries[0].value)
+		assert.Equal(t, 2, summaries[0].count)
+		assert.Equal(t, time.Unix(10000000, 0), summaries[0].windowFrom)
+		assert.Equal(t, later, summaries[0].windowTo)
+
+		assert.Equal(t, "users", summaries[1].limit.ID)
+		assert.Equal(t, "1000", summaries[1].value)
+		assert.Equal(t, 1, summaries[1].count)
+	}
+
+	// refilled buckets are forgotten and the window restarts
+	assert.Len(t, r.buckets, 2)
+	assert.Nil(t, r.summarize(later.Add(time.Minute), false))
+	assert.Empty(t, r.buckets)
+}
+
+func suppressedRecords(t *testing.T, out string) []parser.AuditMessageGroup {
+	var records []parser.AuditMessageGroup
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		group := parser.AuditMessageGroup{}
+		if err := json.Unmarshal([]byte(line), &group); err != nil {
+			t.Fatalf("Failed to decode output %q: %v", line, err)
+		}
+		if group.RuleKey == SuppressedRecordKey {
+			records = append(records, group)
+		}
+	}
+
+	return records
+}
+
+func TestAuditMarshaller_rateLimits(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller(output.NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+	m.SetRateLimits([]RateLimit{{ID: "noisy", By: RateLimitByKey, Rate: 0.001, Burst: 1}}, time.Hour)
+
+	for seq := 1; seq <= 3; seq++ {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(10000001.000:" + string(rune('0'+seq)) + `): syscall=59 key="noisy"`),
+		})
+		m.Consume(new1320(string(rune('0' + seq))))
+	}
+
+	assert.Equal(t, 1, strings.Count(w.String(), `syscall=59`), "only the first group fits the burst")
+	assert.Empty(t, suppressedRecords(t, w.String()))
+
+	// the summary is written when flushing and bypasses the rate limits
+	m.Flush()
+	records := suppressedRecords(t, w.String())
+	if assert.Len(t, records, 1) {
+		assert.Regexp(t, `^pauditd_suppressed id=noisy by=key value="noisy" suppressed=2 window_start=\d+\.\d{3} window_end=\d+\.\d{3}$`, records[0].Msgs[0].Data)
+	}
+
+	// replacing the limits summarizes the previous ones and removing them stops limiting
+	m.SetRateLimits(nil, time.Hour)
+	assert.Nil(t, m.limiter.Load())
+	assert.False(t, m.rateLimited(&parser.AuditMessageGroup{RuleKey: "noisy"}))
+}
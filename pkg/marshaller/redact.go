@@ -0,0 +1,528 @@
+package marshaller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+// RedactMode is how a redaction rule replaces what it matched
+type RedactMode string
+
+const (
+	// RedactMask replaces the match with RedactedText
+	RedactMask RedactMode = "mask"
+	// RedactHMAC replaces the match with a keyed hash, identical values get the same hash
+	RedactHMAC RedactMode = "hmac"
+)
+
+// minHMACKeySize is the shortest key accepted for hmac redaction
+const minHMACKeySize = 16
+
+// execveArgRegex matches the argument fields of EXECVE records, the kernel hex encodes them like
+// the fields in encodedFields
+var execveArgRegex = regexp.MustCompile(`^a[0-9]+(\[[0-9]+\])?$`)
+
+// BuiltinRedactionRules are the patterns for common secrets that can be turned on by name
+var BuiltinRedactionRules = map[string]RedactionRule{
+	"aws_access_key": {
+		ID:    "aws_access_key",
+		Regex: regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`),
+	},
+	"aws_secret_key": {
+		ID:    "aws_secret_key",
+		Regex: regexp.MustCompile(`(?i)aws_?secret_?(?:access_?)?key["']?\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`),
+	},
+	"bearer_token": {
+		ID:    "bearer_token",
+		Regex: regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`),
+	},
+	"password_flag": {
+		ID:    "password_flag",
+		Regex: regexp.MustCompile(`(?:^|[\s"'\x00])--(?:password|passwd)=([^\s"'\x00]+)`),
+		Args:  passwordArgs,
+	},
+}
+
+// passwordFlags are the flags that take a password as the next argument with any command
+var passwordFlags = map[string]bool{"--password": true, "--passwd": true}
+
+// passwordFlagTools are the commands that take a password with -p, true when the password may be
+// given as the next argument as well. -p means something else for most other commands
+var passwordFlagTools = map[string]bool{
+	"mysql":       false,
+	"mysqladmin":  false,
+	"mysqldump":   false,
+	"mysqlimport": false,
+	"mysqlcheck":  false,
+	"mysqlshow":   false,
+	"mariadb":     false,
+	"sshpass":     true,
+}
+
+// argSecret is the part of an argument in a command's argument list that is a secret
+type argSecret struct {
+	arg        int
+	start, end int
+}
+
+// passwordArgs finds the passwords given to a command with a whole `--password` flag followed by
+// the password, or with -p for the commands in passwordFlagTools
+func passwordArgs(args []string) []argSecret {
+	if len(args) == 0 {
+		return nil
+	}
+
+	var secrets []argSecret
+	tool, isTool := passwordFlagTools[path.Base(args[0])]
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case passwordFlags[arg] || (isTool && tool && arg == "-p"):
+			if i+1 < len(args) {
+				i++
+				secrets = append(secrets, argSecret{arg: i, start: 0, end: len(args[i])})
+			}
+		case isTool && len(arg) > 2 && strings.HasPrefix(arg, "-p"):
+			secrets = append(secrets, argSecret{arg: i, start: 2, end: len(arg)})
+		}
+	}
+
+	return secrets
+}
+
+// RedactionRule replaces secrets in the messages of a group. The first capture group of Regex
+// is replaced when it has one, the whole match otherwise
+type RedactionRule struct {
+	ID     string
+	Regex  *regexp.Regexp
+	Fields []string // only redact the values of these fields, the whole value when Regex is nil. Names, glob patterns or ExecveArgsField
+	Mode   RedactMode
+	// Args finds secrets in the argument list of a command, the a0, a1, ... fields of EXECVE
+	// records and the proctitle. Only built in rules set it
+	Args func(args []string) []argSecret
+
+	redactedMetric string
+	fields         fieldSelector
+}
+
+// NewRedactionRule creates a redaction rule from a config entry
+func NewRedactionRule(ruleNumber int, obj map[string]interface{}) (*RedactionRule, error) {
+	rr := &RedactionRule{ID: fmt.Sprintf("redaction_%d", ruleNumber), Mode: RedactMask}
+
+	for k, v := range obj {
+		var err error
+		switch k {
+		case "id":
+			id, ok := v.(string)
+			if !ok || !filterIDPattern.MatchString(id) {
+				err = fmt.Errorf("`id` in redaction rule %d could not be parsed, only letters, digits, _ and - are allowed; Value: `%+v`", ruleNumber, v)
+			}
+			rr.ID = id
+		case "regex":
+			re, ok := v.(string)
+			if !ok {
+				err = fmt.Errorf("`regex` in redaction rule %d could not be parsed; Value: `%+v`", ruleNumber, v)
+				break
+			}
+			if rr.Regex, err = regexp.Compile(re); err != nil {
+				err = fmt.Errorf("`regex` in redaction rule %d could not be parsed; Value: `%+v`; Error: %s", ruleNumber, v, err)
+			}
+		case "fields":
+			rr.Fields, err = parseFieldList(fmt.Sprintf("redaction rule %d", ruleNumber), v)
+		case "mode":
+			rr.Mode, err = ParseRedactMode(fmt.Sprint(v))
+			if err != nil {
+				err = fmt.Errorf("`mode` in redaction rule %d could not be parsed; Value: `%+v`", ruleNumber, v)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rr.Regex == nil && len(rr.Fields) == 0 {
+		return nil, fmt.Errorf("redaction rule %d needs a `regex` or `fields` entry", ruleNumber)
+	}
+
+	return rr, nil
+}
+
+// parseFieldList reads the `fields` entry of a config entry, rule names the entry in errors
+func parseFieldList(rule string, v interface{}) ([]string, error) {
+	var fields []string
+	switch value := v.(type) {
+	case string:
+		fields = []string{value}
+	case []interface{}:
+		for _, f := range value {
+			s, ok := f.(string)
+			if !ok {
+				return nil, fmt.Errorf("`fields` in %s could not be parsed; Value: `%+v`", rule, v)
+			}
+			fields = append(fields, s)
+		}
+	case []string:
+		fields = value
+	default:
+		return nil, fmt.Errorf("`fields` in %s could not be parsed; Value: `%+v`", rule, v)
+	}
+
+	for _, f := range fields {
+		if !isFieldSelector(f) {
+			return nil, fmt.Errorf("`fields` in %s could not be parsed, `%s` is not a field name", rule, f)
+		}
+	}
+	return fields, nil
+}
+
+// ParseRedactMode parses the name of a redaction mode
+func ParseRedactMode(s string) (RedactMode, error) {
+	switch mode := RedactMode(s); mode {
+	case RedactMask, RedactHMAC:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("unknown redaction mode %q, expected %q or %q", s, RedactMask, RedactHMAC)
+}
+
+// Redactor replaces secrets in the messages of a group before they are written
+type Redactor struct {
+	global []*RedactionRule            // rules applied to the whole message
+	args   []*RedactionRule            // rules applied to the argument list of a command
+	fields map[string][]*RedactionRule // rules applied to the values of a field
+	// rules applied to the values of the fields matching a pattern
+	patterned []*RedactionRule
+	key       []byte
+}
+
+// NewRedactor creates a redactor running the rules in order. The key is only needed by hmac rules
+func NewRedactor(rules []RedactionRule, key []byte) (*Redactor, error) {
+	r := &Redactor{fields: make(map[string][]*RedactionRule), key: key}
+
+	for idx := range rules {
+		rule := &rules[idx]
+		if rule.Mode == RedactHMAC && len(key) < minHMACKeySize {
+			return nil, fmt.Errorf("redaction rule `%s` uses hmac but the hmac key is shorter than %d bytes", rule.ID, minHMACKeySize)
+		}
+
+		rule.redactedMetric = "redaction." + rule.ID + ".redacted"
+		if rule.Args != nil {
+			r.args = append(r.args, rule)
+		}
+		if len(rule.Fields) == 0 && (rule.Regex != nil || rule.Args == nil) {
+			r.global = append(r.global, rule)
+		}
+		rule.fields = newFieldSelector(rule.Fields)
+		if len(rule.fields.patterns) > 0 || rule.fields.execveArgs {
+			r.patterned = append(r.patterned, rule)
+		}
+		for field := range rule.fields.names {
+			r.fields[field] = append(r.fields[field], rule)
+		}
+		logger.Info("Redacting messages", "id", rule.ID, "regex", rule.Regex, "fields", rule.Fields, "mode", rule.Mode)
+	}
+
+	return r, nil
+}
+
+// Redact replaces the secrets in every message of the group
+func (r *Redactor) Redact(msg *parser.AuditMessageGroup) {
+	for _, am := range msg.Msgs {
+		am.Data = r.redact(am.Data)
+	}
+}
+
+func (r *Redactor) redact(data string) string {
+	for _, rule := range r.global {
+		data = r.apply(rule, data)
+	}
+
+	if len(r.args) > 0 {
+		data = r.redactArgs(data)
+	}
+
+	// field rules and hex encoded values need the fields picked apart, most messages have neither
+	var b strings.Builder
+	last := 0
+	walkFields(data, func(name string, start, end int, quoted bool) {
+		value := data[start:end]
+		encoded := !quoted && isEncodedField(name)
+		plain := value
+		if encoded {
+			decoded, err := hex.DecodeString(value)
+			if err != nil {
+				encoded = false
+			} else {
+				plain = string(decoded)
+			}
+		}
+
+		redacted := plain
+		if encoded {
+			for _, rule := range r.global {
+				redacted = r.apply(rule, redacted)
+			}
+		}
+		for _, rule := range r.fields[name] {
+			redacted = r.apply(rule, redacted)
+		}
+		for _, rule := range r.patterned {
+			if !rule.fields.names[name] && rule.fields.has(name) {
+				redacted = r.apply(rule, redacted)
+			}
+		}
+
+		if redacted == plain {
+			return
+		}
+
+		if encoded {
+			redacted = strings.ToUpper(hex.EncodeToString([]byte(redacted)))
+		}
+		b.WriteString(data[last:start])
+		b.WriteString(redacted)
+		last = end
+	})
+
+	if last == 0 {
+		return data
+	}
+
+	b.WriteString(data[last:])
+	return b.String()
+}
+
+// argField is an argument of a command found in a message
+type argField struct {
+	start, end int
+	encoded    bool
+	value      string // decoded when encoded
+}
+
+// redactArgs runs the argument rules over the a0, a1, ... fields of an EXECVE record and over the
+// NUL separated arguments in a proctitle field
+func (r *Redactor) redactArgs(data string) string {
+	var args []argField
+	var proctitle *argField
+	walkFields(data, func(name string, start, end int, quoted bool) {
+		if name != "proctitle" && !execveArgRegex.MatchString(name) {
+			return
+		}
+		if strings.HasSuffix(name, "]") {
+			// arguments too long for a single field are split up, they are not taken apart
+			return
+		}
+
+		field := argField{start: start, end: end, value: data[start:end]}
+		if !quoted {
+			if decoded, err := hex.DecodeString(field.value); err == nil {
+				field.encoded, field.value = true, string(decoded)
+			}
+		}
+
+		if name == "proctitle" {
+			proctitle = &field
+			return
+		}
+		// the arguments are in order, a gap ends the argument list
+		if n, err := strconv.Atoi(name[1:]); err == nil && n == len(args) {
+			args = append(args, field)
+		}
+	})
+
+	if proctitle != nil {
+		values := strings.Split(proctitle.value, "\x00")
+		if r.redactArgList(values) {
+			proctitle.value = strings.Join(values, "\x00")
+			args = []argField{*proctitle}
+		} else {
+			args = nil
+		}
+	} else {
+		values := make([]string, len(args))
+		for i, arg := range args {
+			values[i] = arg.value
+		}
+		if !r.redactArgList(values) {
+			return data
+		}
+		for i := range args {
+			args[i].value = values[i]
+		}
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, arg := range args {
+		if arg.value == data[arg.start:arg.end] {
+			continue
+		}
+		value := arg.value
+		if arg.encoded {
+			value = strings.ToUpper(hex.EncodeToString([]byte(value)))
+			if value == data[arg.start:arg.end] {
+				continue
+			}
+		}
+		b.WriteString(data[last:arg.start])
+		b.WriteString(value)
+		last = arg.end
+	}
+	if last == 0 {
+		return data
+	}
+
+	b.WriteString(data[last:])
+	return b.String()
+}
+
+// redactArgList replaces the secrets the argument rules find in args, it reports whether any were found
+func (r *Redactor) redactArgList(args []string) bool {
+	found := false
+	for _, rule := range r.args {
+		secrets := rule.Args(args)
+		// replace from the back so the positions of earlier secrets in the same argument still fit
+		for i := len(secrets) - 1; i >= 0; i-- {
+			secret := secrets[i]
+			arg := args[secret.arg]
+			args[secret.arg] = arg[:secret.start] + r.replacement(rule, arg[secret.start:secret.end]) + arg[secret.end:]
+			metric.GetClient().Increment(rule.redactedMetric)
+			found = true
+		}
+	}
+
+	return found
+}
+
+// apply runs a single rule over s
+func (r *Redactor) apply(rule *RedactionRule, s string) string {
+	if rule.Regex == nil {
+		if s == "" {
+			return s
+		}
+		metric.GetClient().Increment(rule.redactedMetric)
+		return r.replacement(rule, s)
+	}
+
+	matches := rule.Regex.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			// only the first capture group is the secret
+			start, end = m[2], m[3]
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(r.replacement(rule, s[start:end]))
+		last = end
+		metric.GetClient().Increment(rule.redactedMetric)
+	}
+	b.WriteString(s[last:])
+
+	return b.String()
+}
+
+func (r *Redactor) replacement(rule *RedactionRule, secret string) string {
+	if rule.Mode != RedactHMAC {
+		return RedactedText
+	}
+
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(secret))
+	return "[HMAC:" + hex.EncodeToString(mac.Sum(nil)[:16]) + "]"
+}
+
+// isEncodedField reports whether the kernel may hex encode the value of the field
+func isEncodedField(name string) bool {
+	return encodedFields[name] || execveArgRegex.MatchString(name)
+}
+
+// walkFields calls fn with the position of the value of every name=value field in data, quotes
+// are not part of the value. Values of fields nested in a single quoted msg are walked as well
+func walkFields(data string, fn func(name string, start, end int, quoted bool)) {
+	walkFieldsAt(data, 0, fn)
+}
+
+func walkFieldsAt(data string, offset int, fn func(name string, start, end int, quoted bool)) {
+	isSep := func(c byte) bool {
+		return c == ' ' || c == '\x1d'
+	}
+
+	for i := 0; i < len(data); {
+		if isSep(data[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(data) && data[i] != '=' && !isSep(data[i]) {
+			i++
+		}
+		if i >= len(data) || data[i] != '=' {
+			continue
+		}
+		name := data[start:i]
+		i++
+
+		if i < len(data) && (data[i] == '"' || data[i] == '\'') {
+			quote := data[i]
+			valueStart := i + 1
+			valueEnd := len(data)
+			if end := strings.IndexByte(data[valueStart:], quote); end >= 0 {
+				valueEnd = valueStart + end
+			}
+			i = min(valueEnd+1, len(data))
+
+			if quote == '\'' {
+				walkFieldsAt(data[valueStart:valueEnd], offset+valueStart, fn)
+				continue
+			}
+			fn(name, offset+valueStart, offset+valueEnd, true)
+			continue
+		}
+
+		valueStart := i
+		for i < len(data) && !isSep(data[i]) {
+			i++
+		}
+		fn(name, offset+valueStart, offset+i, false)
+	}
+}
+
+// SetRedactor replaces the redactor of the marshaller, nil turns redaction off
+func (a *AuditMarshaller) SetRedactor(r *Redactor) {
+	a.redactor.Store(r)
+}
+
+// redact replaces the secrets in the group when redaction is on
+func (a *AuditMarshaller) redact(msg *parser.AuditMessageGroup) {
+	if r := a.redactor.Load(); r != nil {
+		r.Redact(msg)
+	}
+}
+
+// RedactionRuleIDs returns the ids of the built in redaction rules in a stable order
+func RedactionRuleIDs() []string {
+	ids := make([]string, 0, len(BuiltinRedactionRules))
+	for id := range BuiltinRedactionRules {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
@@ -0,0 +1,7 @@
+//go:build !amd64 && !arm64
+
+package marshaller
+
+// syscallNumbers is empty on architectures we do not carry a table for, expressions have to
+// compare the syscall by number there
+var syscallNumbers = map[string]int{}
@@ -2,8 +2,10 @@
 package output
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/pantheon-systems/pauditd/pkg/logger"
@@ -45,15 +47,96 @@ func CreateAuditWriter(auditWriterName string, config *viper.Viper) (*AuditWrite
 		return nil, fmt.Errorf("invalid audit writer name, must be one of: %s", strings.Join(availableAuditWriters, ", "))
 	}
 
+	queueSize := DefaultQueueSize
+	if key := "output." + auditWriterName + ".queue_size"; config.IsSet(key) {
+		if queueSize = config.GetInt(key); queueSize < 1 {
+			return nil, fmt.Errorf("output queue_size for %s must be at least 1, %d provided", auditWriterName, queueSize)
+		}
+	}
+
+	onFailure, err := ParseFailurePolicy(config.GetString("output." + auditWriterName + ".on_failure"))
+	if err != nil {
+		return nil, fmt.Errorf("output on_failure for %s is invalid, %s", auditWriterName, err)
+	}
+
 	// Run the factory with the configuration.
-	return auditWriterFactory(config)
+	writer, err := auditWriterFactory(config)
+	if err != nil {
+		return nil, err
+	}
+
+	writer.name = auditWriterName
+	writer.queueSize = queueSize
+	writer.onFailure = onFailure
+
+	if onFailure == FailSpool {
+		if writer.spool, err = createSpool(auditWriterName, writer, config); err != nil {
+			_ = writer.Close(context.Background())
+			return nil, err
+		}
+	}
+
+	return writer, nil
+}
+
+// createSpool opens the spool of an output from output.<name>.spool
+func createSpool(name string, writer *AuditWriter, config *viper.Viper) (*spool, error) {
+	key := "output." + name + ".spool."
+	sc := spoolConfig{
+		dir:         defaultSpoolDir,
+		maxSize:     defaultSpoolMaxSize,
+		segmentSize: defaultSpoolSegmentSize,
+		maxAge:      config.GetDuration(key + "max_age"),
+	}
+
+	if config.IsSet(key + "dir") {
+		sc.dir = config.GetString(key + "dir")
+	}
+	if config.IsSet(key + "max_size") {
+		if sc.maxSize = int64(config.GetSizeInBytes(key + "max_size")); sc.maxSize < 1 {
+			return nil, fmt.Errorf("output spool.max_size for %s must be a size, %s provided", name, config.GetString(key+"max_size"))
+		}
+	}
+	if config.IsSet(key + "segment_size") {
+		if sc.segmentSize = int64(config.GetSizeInBytes(key + "segment_size")); sc.segmentSize < 1 {
+			return nil, fmt.Errorf("output spool.segment_size for %s must be a size, %s provided", name, config.GetString(key+"segment_size"))
+		}
+	}
+	if sc.maxAge < 0 {
+		return nil, fmt.Errorf("output spool.max_age for %s can not be negative, %s provided", name, sc.maxAge)
+	}
+
+	sc.batchEvents, sc.batchBytes = defaultSpoolReplayBatch, defaultBatchMaxBytes
+	write := func(messages [][]byte) (int, error) {
+		for i, jsonBytes := range messages {
+			if _, err := writer.w.Write(jsonBytes); err != nil {
+				return i, err
+			}
+		}
+		return len(messages), nil
+	}
+	sw, spooling := writer.w.(spoolingWriter)
+	if spooling {
+		sc.batchEvents, sc.batchBytes = sw.spoolBatch()
+		write = sw.writeSpooled
+	}
+
+	s, err := openSpool(name, sc, write)
+	if err != nil {
+		return nil, err
+	}
+	if spooling {
+		sw.setSpool(s)
+	}
+	return s, nil
 }
 
-// GetAvailableAuditWriters returns an array of audit writer names as strings
+// GetAvailableAuditWriters returns an array of audit writer names as strings, sorted by name
 func GetAvailableAuditWriters() []string {
-	availableAuditWriters := make([]string, len(auditWriterFactories))
+	availableAuditWriters := make([]string, 0, len(auditWriterFactories))
 	for k := range auditWriterFactories {
 		availableAuditWriters = append(availableAuditWriters, k)
 	}
+	slices.Sort(availableAuditWriters)
 	return availableAuditWriters
 }
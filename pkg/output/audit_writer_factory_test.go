@@ -1,8 +1,10 @@
 package output
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -59,6 +61,44 @@ func TestCreateAuditWriter(t *testing.T) {
 
 	assert.NotNil(t, writer)
 	assert.Nil(t, err)
+	assert.Equal(t, FailDefault, writer.onFailure)
+	assert.Nil(t, writer.spool)
+
+	config.Set("output.successtest.on_failure", "retry")
+	writer, err = CreateAuditWriter("successtest", config)
+	assert.EqualError(t, err, `output on_failure for successtest is invalid, unknown failure policy "retry", expected "block", "drop", "spool" or "exit"`)
+	assert.Nil(t, writer)
+
+	config.Set("output.successtest.on_failure", "spool")
+	config.Set("output.successtest.spool.max_size", "0")
+	writer, err = CreateAuditWriter("successtest", config)
+	assert.EqualError(t, err, "output spool.max_size for successtest must be a size, 0 provided")
+	assert.Nil(t, writer)
+
+	config.Set("output.successtest.spool.max_size", "1MB")
+	config.Set("output.successtest.spool.max_age", "-1h")
+	writer, err = CreateAuditWriter("successtest", config)
+	assert.EqualError(t, err, "output spool.max_age for successtest can not be negative, -1h0m0s provided")
+	assert.Nil(t, writer)
+
+	configureMetrics(t)
+	config.Set("output.successtest.spool.dir", t.TempDir())
+	config.Set("output.successtest.spool.max_age", "24h")
+	config.Set("output.successtest.spool.segment_size", "64KB")
+	writer, err = CreateAuditWriter("successtest", config)
+	assert.Nil(t, err)
+	if assert.NotNil(t, writer) {
+		assert.Equal(t, FailSpool, writer.onFailure)
+		assert.Equal(t, spoolConfig{
+			dir:         config.GetString("output.successtest.spool.dir"),
+			maxSize:     1024 * 1024,
+			segmentSize: 64 * 1024,
+			maxAge:      24 * time.Hour,
+			batchEvents: defaultSpoolReplayBatch,
+			batchBytes:  defaultBatchMaxBytes,
+		}, writer.spool.config)
+		assert.Nil(t, writer.Close(context.Background()))
+	}
 
 	register("errortest", secondTestFactory)
 	writer, err = CreateAuditWriter("errortest", config)
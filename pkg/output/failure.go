@@ -0,0 +1,140 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+)
+
+// FailurePolicy decides what happens to a group an output could not write, modelled on the
+// failure modes of the kernel audit system
+type FailurePolicy string
+
+const (
+	// FailBlock keeps retrying the group, everything behind it waits until the output recovers
+	FailBlock FailurePolicy = "block"
+	// FailDrop discards the group and counts it
+	FailDrop FailurePolicy = "drop"
+	// FailSpool writes the group to a spool on disk, it is written again once the output recovers
+	FailSpool FailurePolicy = "spool"
+	// FailExit exits pauditd
+	FailExit FailurePolicy = "exit"
+	// FailDefault applies when on_failure is not set. A failed write exits pauditd like FailExit,
+	// a full buffer or queue is dropped and counted like FailDrop so a burst does not restart it
+	FailDefault FailurePolicy = ""
+)
+
+const (
+	// blockRetryInterval is how often a blocked output retries the group it failed to write
+	blockRetryInterval = time.Second
+	// defaultSpoolDir holds the spools of the outputs unless output.<name>.spool.dir is set
+	defaultSpoolDir = "/var/spool/pauditd"
+	// defaultSpoolMaxSize is the size of a spool unless output.<name>.spool.max_size is set
+	defaultSpoolMaxSize = 256 * 1024 * 1024
+	// defaultSpoolSegmentSize is the size of a spool segment unless output.<name>.spool.segment_size
+	// is set
+	defaultSpoolSegmentSize = 16 * 1024 * 1024
+)
+
+// exit is os.Exit, tests replace it
+var exit = os.Exit
+
+// ParseFailurePolicy validates a failure policy from the config, empty means FailDefault
+func ParseFailurePolicy(policy string) (FailurePolicy, error) {
+	switch p := FailurePolicy(policy); p {
+	case FailDefault, FailBlock, FailDrop, FailSpool, FailExit:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("unknown failure policy %q, expected %q, %q, %q or %q", policy, FailBlock, FailDrop, FailSpool, FailExit)
+}
+
+// deliver writes the serialized group to the output and applies the failure policy when that
+// fails. While the spool holds groups new ones are added to it, so they are written in order.
+// A group a replaced output gave back because it was closed is returned with ErrWriterClosed
+func (a *AuditWriter) deliver(jsonBytes []byte) error {
+	if a.spool != nil && a.spool.pending() {
+		if err := a.spool.append(jsonBytes); err != nil {
+			a.drop(err)
+		}
+		return nil
+	}
+
+	if err := a.write(jsonBytes); err != nil {
+		if errors.Is(err, errWriterClosed) && a.replaced.Load() {
+			return ErrWriterClosed
+		}
+		a.fail(jsonBytes, err)
+	}
+
+	return nil
+}
+
+// fail applies the failure policy to a group the output could not write
+func (a *AuditWriter) fail(jsonBytes []byte, err error) {
+	metric.GetClient().Increment("output." + a.name + ".failed")
+
+	switch a.onFailure {
+	case FailDefault:
+		if errors.Is(err, errBufferFull) {
+			break
+		}
+		fallthrough
+	case FailExit:
+		logger.Error("Failed to write message, exiting", "output", a.name, "error", err)
+		exit(1)
+	case FailBlock:
+		a.block(jsonBytes, err)
+		return
+	case FailSpool:
+		if err = a.spool.append(jsonBytes); err == nil {
+			return
+		}
+	}
+
+	a.drop(err)
+}
+
+// block retries the group until the output takes it or the writer is closed
+func (a *AuditWriter) block(jsonBytes []byte, err error) {
+	logger.Error("Failed to write message, blocking until the output recovers", "output", a.name, "error", err)
+	metric.GetClient().Increment("output." + a.name + ".blocked")
+
+	ticker := time.NewTicker(blockRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.closing:
+			a.drop(errors.New("output was closed while blocked"))
+			return
+		case <-ticker.C:
+		}
+
+		if _, err = a.w.Write(jsonBytes); err == nil {
+			logger.Info("Output recovered", "output", a.name)
+			return
+		}
+	}
+}
+
+// drop discards a group the output could not write
+func (a *AuditWriter) drop(err error) {
+	logger.Error("Failed to write message, dropping it", "output", a.name, "error", err)
+	metric.GetClient().Increment("output." + a.name + ".dropped")
+}
+
+// abandon spools or drops a group the output was given no more time to write
+func (a *AuditWriter) abandon(jsonBytes []byte) {
+	if a.spool != nil {
+		if err := a.spool.append(jsonBytes); err == nil {
+			return
+		}
+	}
+
+	a.drop(errors.New("output did not drain before the deadline"))
+}
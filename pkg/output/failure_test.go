@@ -0,0 +1,196 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyWriter fails until it is fixed
+type flakyWriter struct {
+	lock   sync.Mutex
+	broken bool
+	buf    bytes.Buffer
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.broken {
+		return 0, errors.New("broken")
+	}
+	return w.buf.Write(p)
+}
+
+func (w *flakyWriter) fix() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.broken = false
+}
+
+func (w *flakyWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.String()
+}
+
+func policyWriter(w *flakyWriter, onFailure FailurePolicy) *AuditWriter {
+	a := namedWriter("test", NewAuditWriter(w, 1), 10)
+	a.onFailure = onFailure
+	return a
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	for _, policy := range []FailurePolicy{FailBlock, FailDrop, FailSpool, FailExit} {
+		p, err := ParseFailurePolicy(string(policy))
+		assert.Nil(t, err)
+		assert.Equal(t, policy, p)
+	}
+
+	p, err := ParseFailurePolicy("")
+	assert.Nil(t, err)
+	assert.Equal(t, FailDefault, p)
+
+	_, err = ParseFailurePolicy("panic")
+	assert.EqualError(t, err, `unknown failure policy "panic", expected "block", "drop", "spool" or "exit"`)
+}
+
+func TestAuditWriter_failDrop(t *testing.T) {
+	configureMetrics(t)
+
+	out := &flakyWriter{broken: true}
+	w := policyWriter(out, FailDrop)
+
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1}))
+	out.fix()
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 2}))
+
+	assert.NotContains(t, out.String(), `"sequence":1,`)
+	assert.Contains(t, out.String(), `"sequence":2,`)
+}
+
+func TestAuditWriter_failExit(t *testing.T) {
+	configureMetrics(t)
+
+	code := -1
+	defer func(e func(int)) { exit = e }(exit)
+	exit = func(c int) { code = c }
+
+	w := policyWriter(&flakyWriter{broken: true}, FailExit)
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1}))
+	assert.Equal(t, 1, code)
+}
+
+func TestAuditWriter_failDefault(t *testing.T) {
+	configureMetrics(t)
+
+	code := -1
+	defer func(e func(int)) { exit = e }(exit)
+	exit = func(c int) { code = c }
+
+	// without on_failure a full http buffer is dropped and counted, pauditd keeps running
+	messages := make(chan *messageTransport, 1)
+	w := namedWriter("http", NewAuditWriter(&HTTPWriter{messages: messages}, 1), 10)
+	assert.Equal(t, FailDefault, w.onFailure)
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1}))
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 2}))
+	assert.Equal(t, -1, code)
+	assert.Len(t, messages, 1)
+
+	// as is a full queue
+	slow := &blockingWriter{release: make(chan struct{})}
+	defer close(slow.release)
+	fan := NewFanOutAuditWriter([]*AuditWriter{namedWriter("slow", NewAuditWriter(slow, 1), 1)})
+	for seq := 1; seq <= 3; seq++ {
+		assert.Nil(t, fan.Write(&parser.AuditMessageGroup{Seq: seq}))
+	}
+	assert.Equal(t, -1, code)
+
+	// a write that fails still exits
+	w = namedWriter("test", NewAuditWriter(&flakyWriter{broken: true}, 1), 10)
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 3}))
+	assert.Equal(t, 1, code)
+}
+
+func TestAuditWriter_failBlock(t *testing.T) {
+	configureMetrics(t)
+
+	out := &flakyWriter{broken: true}
+	w := policyWriter(out, FailBlock)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1}))
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write did not block on a broken output")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	out.fix()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write stayed blocked after the output recovered")
+	}
+	assert.Contains(t, out.String(), `"sequence":1,`)
+}
+
+func TestAuditWriter_failBlockClose(t *testing.T) {
+	configureMetrics(t)
+
+	w := policyWriter(&flakyWriter{broken: true}, FailBlock)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1}))
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, w.Close(context.Background()))
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not end the blocked write")
+	}
+}
+
+func TestAuditWriter_failSpool(t *testing.T) {
+	configureMetrics(t)
+
+	out := &flakyWriter{broken: true}
+	w := policyWriter(out, FailSpool)
+	s, err := openSpool("test", spoolConfig{dir: t.TempDir(), maxSize: 1024, segmentSize: 1024}, func(messages [][]byte) (int, error) {
+		for i, b := range messages {
+			if _, err := out.Write(b); err != nil {
+				return i, err
+			}
+		}
+		return len(messages), nil
+	})
+	assert.Nil(t, err)
+	w.spool = s
+	defer w.Close(context.Background())
+
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1}))
+	assert.True(t, s.pending())
+
+	// later groups queue up behind the spooled ones even when the output works again
+	out.fix()
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 2}))
+	assert.Equal(t, "", out.String())
+
+	assert.Nil(t, s.replay())
+	assert.False(t, s.pending())
+	assert.Regexp(t, `"sequence":1,(?s:.*)"sequence":2,`, out.String())
+}
@@ -0,0 +1,275 @@
+package output
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+)
+
+// DefaultQueueSize is the number of groups queued for an output when several are enabled and
+// output.<name>.queue_size is not set
+const DefaultQueueSize = 4096
+
+// releaseTimeout is how long an output that did not drain in time gets to return from its last
+// write once it was released, after that it is closed in the background when the write returns
+const releaseTimeout = time.Second
+
+// fanOut holds the outputs of a writer for several outputs
+type fanOut struct {
+	lock    sync.RWMutex // guards closing the queues against write
+	closed  bool
+	closing chan struct{} // closed before the queues are, ends waiting for a full queue
+	once    sync.Once
+	outputs []*queuedOutput
+	kept    map[*queuedOutput]bool // outputs handed over to the writer that replaced this one
+}
+
+// queuedOutput is one of the outputs of a fan out writer. Groups are queued for it and written by
+// a goroutine of its own, so a slow output only ever fills its own queue
+type queuedOutput struct {
+	writer    *AuditWriter
+	queue     chan []byte
+	done      chan struct{}
+	abandoned chan struct{} // closed when the output did not drain in time, the rest is not written
+}
+
+// NewFanOutAuditWriter creates an audit writer that writes every group to each of the writers it
+// is routed to. Each writer gets a queue of its own, when the queue of a writer is full or writing
+// to it fails the failure policy of that writer alone decides what happens to the group
+func NewFanOutAuditWriter(writers []*AuditWriter) *AuditWriter {
+	f := &fanOut{closing: make(chan struct{}), outputs: make([]*queuedOutput, len(writers))}
+
+	for i, w := range writers {
+		f.outputs[i] = newQueuedOutput(w)
+	}
+
+	return &AuditWriter{fan: f}
+}
+
+// ReplaceOutputs creates the writer that takes over from previous when the outputs named in
+// replaced were recreated as writers. The outputs of previous that were not replaced are kept
+// running with their queues, so the groups queued for them are neither lost nor written twice.
+// retire closes what previous does not hand over and is called once the returned writer took
+// its place
+func ReplaceOutputs(previous *AuditWriter, replaced []string, writers []*AuditWriter) (next *AuditWriter, retire func(ctx context.Context) error) {
+	var kept []*queuedOutput
+	retire = previous.Close
+
+	if f := previous.fan; f != nil {
+		f.lock.Lock()
+		f.kept = make(map[*queuedOutput]bool)
+		for _, o := range f.outputs {
+			if !slices.Contains(replaced, o.writer.name) {
+				f.kept[o] = true
+				kept = append(kept, o)
+			}
+		}
+		f.lock.Unlock()
+	} else if !slices.Contains(replaced, previous.name) {
+		kept = append(kept, newQueuedOutput(previous))
+		retire = func(context.Context) error { return nil }
+	} else {
+		previous.replaced.Store(true)
+	}
+
+	// queues that are kept need a fan out to keep writing them, even when it is the only output
+	if len(kept) == 0 && len(writers) == 1 {
+		return writers[0], retire
+	}
+
+	f := &fanOut{closing: make(chan struct{}), outputs: kept}
+	for _, w := range writers {
+		f.outputs = append(f.outputs, newQueuedOutput(w))
+	}
+
+	return &AuditWriter{fan: f}, retire
+}
+
+// newQueuedOutput creates the queue for the writer and starts writing it
+func newQueuedOutput(w *AuditWriter) *queuedOutput {
+	o := &queuedOutput{
+		writer:    w,
+		queue:     make(chan []byte, cmp.Or(w.queueSize, DefaultQueueSize)),
+		done:      make(chan struct{}),
+		abandoned: make(chan struct{}),
+	}
+	go o.run()
+
+	return o
+}
+
+// run writes the queued groups until the queue is closed and drained
+func (o *queuedOutput) run() {
+	defer close(o.done)
+
+	for jsonBytes := range o.queue {
+		select {
+		case <-o.abandoned:
+			o.writer.abandon(jsonBytes)
+		default:
+			if err := o.writer.deliver(jsonBytes); err != nil {
+				o.writer.abandon(jsonBytes)
+			}
+		}
+	}
+}
+
+// close waits until ctx is done for the output to write what is queued and closes it once
+// nothing writes to it any more. An output that does not drain in time is released, what is
+// left in its queue is spooled or dropped
+func (o *queuedOutput) close(ctx context.Context) error {
+	select {
+	case <-o.done:
+		return o.closeWriter(ctx)
+	case <-ctx.Done():
+	}
+
+	err := fmt.Errorf("output %s did not drain before the deadline, %d messages left in the queue", o.writer.name, len(o.queue))
+	close(o.abandoned)
+	o.writer.release()
+
+	timer := time.NewTimer(releaseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-o.done:
+		return errors.Join(err, o.closeWriter(ctx))
+	case <-timer.C:
+	}
+
+	// the output is stuck in a write, closing it underneath the write is left until it returns
+	go func() {
+		<-o.done
+		if err := o.closeWriter(ctx); err != nil {
+			logger.Error("Failed to close output", "error", err)
+		}
+	}()
+
+	return err
+}
+
+func (o *queuedOutput) closeWriter(ctx context.Context) error {
+	if err := o.writer.Close(ctx); err != nil {
+		return fmt.Errorf("output %s: %w", o.writer.name, err)
+	}
+
+	return nil
+}
+
+// queueFull applies the failure policy of the output to a group its queue has no room for
+func (f *fanOut) queueFull(o *queuedOutput, jsonBytes []byte) {
+	w := o.writer
+	err := errors.New("output queue is full")
+	metric.GetClient().Increment("output." + w.name + ".queue_full")
+
+	// without a policy a full queue is dropped, only FailExit exits on it
+	switch w.onFailure {
+	case FailExit:
+		logger.Error("Output queue full, exiting", "output", w.name)
+		exit(1)
+	case FailBlock:
+		select {
+		case o.queue <- jsonBytes:
+			return
+		case <-f.closing:
+		}
+	case FailSpool:
+		if err = w.spool.append(jsonBytes); err == nil {
+			return
+		}
+	}
+
+	w.drop(err)
+}
+
+// names returns the names of the outputs
+func (f *fanOut) names() string {
+	names := make([]string, len(f.outputs))
+	for i, o := range f.outputs {
+		names[i] = o.writer.name
+	}
+	return strings.Join(names, ",")
+}
+
+// write queues the group for every output that accepts it. The group is only serialized once and
+// not at all when no output accepts it
+func (f *fanOut) write(msg *parser.AuditMessageGroup) error {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.closed {
+		return ErrWriterClosed
+	}
+
+	var outputs [8]*queuedOutput
+	routed := outputs[:0]
+	for _, o := range f.outputs {
+		if o.writer.accepts(msg) {
+			routed = append(routed, o)
+		}
+	}
+
+	if len(routed) == 0 {
+		metric.GetClient().Increment("messages.routed_away")
+		return nil
+	}
+
+	jsonBytes, err := marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range routed {
+		select {
+		case o.queue <- jsonBytes:
+		default:
+			f.queueFull(o, jsonBytes)
+		}
+	}
+
+	return nil
+}
+
+// close stops queueing groups and closes the outputs that were not handed over to another writer.
+// The outputs drain at the same time, each of them until ctx is done
+func (f *fanOut) close(ctx context.Context) error {
+	// writes waiting for room in a queue hold the lock
+	f.once.Do(func() { close(f.closing) })
+
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return nil
+	}
+	f.closed = true
+	var closing []*queuedOutput
+	for _, o := range f.outputs {
+		if !f.kept[o] {
+			close(o.queue)
+			closing = append(closing, o)
+		}
+	}
+	f.lock.Unlock()
+
+	errs := make([]error, len(closing))
+	var wg sync.WaitGroup
+	for i, o := range closing {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = o.close(ctx)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
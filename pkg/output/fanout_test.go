@@ -0,0 +1,334 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingWriter holds every write until release is closed
+type blockingWriter struct {
+	release chan struct{}
+	lock    sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *blockingWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.buf.String()
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(_ []byte) (int, error) {
+	return 0, errors.New("broken")
+}
+
+// lockedBuffer is a buffer that can be read while the fan out writes to it
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// closingWriter is a blockingWriter that records whether it was written after it was closed
+type closingWriter struct {
+	blockingWriter
+	closed          bool
+	writeAfterClose bool
+	drainTime       time.Duration
+}
+
+func (w *closingWriter) Write(p []byte) (int, error) {
+	n, err := w.blockingWriter.Write(p)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		w.writeAfterClose = true
+	}
+	return n, err
+}
+
+func (w *closingWriter) Close(ctx context.Context) error {
+	if w.drainTime > 0 {
+		select {
+		case <-time.After(w.drainTime):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	return nil
+}
+
+func (w *closingWriter) isClosed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closed
+}
+
+func namedWriter(name string, w *AuditWriter, queueSize int) *AuditWriter {
+	w.name = name
+	w.queueSize = queueSize
+	return w
+}
+
+func TestFanOutAuditWriter(t *testing.T) {
+	configureMetrics(t)
+
+	fast := &lockedBuffer{}
+	slow := &blockingWriter{release: make(chan struct{})}
+	slowWriter := namedWriter("slow", NewAuditWriter(slow, 1), 1)
+	slowWriter.onFailure = FailDrop
+	brokenWriter := namedWriter("broken", NewAuditWriter(failingWriter{}, 1), 10)
+	brokenWriter.onFailure = FailDrop
+	w := NewFanOutAuditWriter([]*AuditWriter{
+		namedWriter("fast", NewAuditWriter(fast, 1), 10),
+		slowWriter,
+		brokenWriter,
+	})
+	assert.Equal(t, "fast,slow,broken", w.Name())
+
+	// the slow output fills its queue and drops the rest, the others do not notice
+	for seq := 1; seq <= 4; seq++ {
+		assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: seq}))
+	}
+	assert.Eventually(t, func() bool {
+		return bytes.Count([]byte(fast.String()), []byte("\n")) == 4
+	}, time.Second, 10*time.Millisecond)
+
+	// routed groups only go to their outputs
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 5, Outputs: []string{"fast"}}))
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 6, Outputs: []string{"elsewhere"}}))
+
+	close(slow.release)
+	assert.Nil(t, w.Close(context.Background()))
+
+	assert.Contains(t, fast.String(), `"sequence":5,`)
+	assert.NotContains(t, fast.String(), `"sequence":6,`)
+	assert.NotContains(t, slow.String(), `"sequence":4,`)
+	assert.NotContains(t, slow.String(), `"sequence":5,`)
+	assert.Contains(t, slow.String(), `"sequence":1,`)
+
+	assert.EqualError(t, w.Write(&parser.AuditMessageGroup{Seq: 7}), "audit writer is closed")
+	assert.Nil(t, w.Close(context.Background()))
+}
+
+func TestFanOutAuditWriter_closeDeadline(t *testing.T) {
+	configureMetrics(t)
+
+	slow := &blockingWriter{release: make(chan struct{})}
+	defer close(slow.release)
+
+	w := NewFanOutAuditWriter([]*AuditWriter{
+		namedWriter("fast", NewAuditWriter(&lockedBuffer{}, 1), 10),
+		namedWriter("slow", NewAuditWriter(slow, 1), 10),
+	})
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1}))
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 2}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.EqualError(t, w.Close(ctx), "output slow did not drain before the deadline, 1 messages left in the queue")
+}
+
+func TestFanOutAuditWriter_closeDeadlineRelease(t *testing.T) {
+	configureMetrics(t)
+
+	slow := &closingWriter{blockingWriter: blockingWriter{release: make(chan struct{})}}
+	w := NewFanOutAuditWriter([]*AuditWriter{namedWriter("slow", NewAuditWriter(slow, 1), 10)})
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1}))
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 2}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.EqualError(t, w.Close(ctx), "output slow did not drain before the deadline, 1 messages left in the queue")
+	assert.False(t, slow.isClosed(), "the output is not closed while it is being written")
+
+	// once the write in progress returns the output is closed, the rest of the queue is dropped
+	close(slow.release)
+	assert.Eventually(t, slow.isClosed, time.Second, 10*time.Millisecond)
+	assert.False(t, slow.writeAfterClose)
+	assert.Contains(t, slow.String(), `"sequence":1,`)
+	assert.NotContains(t, slow.String(), `"sequence":2,`)
+}
+
+func TestFanOutAuditWriter_closeParallel(t *testing.T) {
+	configureMetrics(t)
+
+	var writers []*AuditWriter
+	for _, name := range []string{"a", "b", "c"} {
+		drain := &closingWriter{blockingWriter: blockingWriter{release: make(chan struct{})}, drainTime: 200 * time.Millisecond}
+		close(drain.release)
+		writers = append(writers, namedWriter(name, NewAuditWriter(drain, 1), 10))
+	}
+	w := NewFanOutAuditWriter(writers)
+
+	// each output takes most of the deadline to drain, one after the other they would miss it
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, w.Close(ctx))
+}
+
+func TestReplaceOutputs(t *testing.T) {
+	configureMetrics(t)
+
+	previousFile, nextFile := &lockedBuffer{}, &lockedBuffer{}
+	slow := &blockingWriter{release: make(chan struct{})}
+	previous := NewFanOutAuditWriter([]*AuditWriter{
+		namedWriter("file", NewAuditWriter(previousFile, 1), 10),
+		namedWriter("http", NewAuditWriter(slow, 1), 10),
+	})
+	assert.Nil(t, previous.Write(&parser.AuditMessageGroup{Seq: 1}))
+
+	// the file output is replaced, the http output keeps its queue and goroutine
+	next, retire := ReplaceOutputs(previous, []string{"file"}, []*AuditWriter{namedWriter("file", NewAuditWriter(nextFile, 1), 10)})
+	assert.Equal(t, "http,file", next.Name())
+	assert.Nil(t, retire(context.Background()))
+	assert.EqualError(t, previous.Write(&parser.AuditMessageGroup{Seq: 2}), "audit writer is closed")
+
+	assert.Nil(t, next.Write(&parser.AuditMessageGroup{Seq: 3}))
+	close(slow.release)
+	assert.Nil(t, next.Close(context.Background()))
+
+	assert.Contains(t, previousFile.String(), `"sequence":1,`)
+	assert.NotContains(t, previousFile.String(), `"sequence":3,`)
+	assert.Contains(t, nextFile.String(), `"sequence":3,`)
+	assert.NotContains(t, nextFile.String(), `"sequence":1,`)
+	assert.Equal(t, 1, strings.Count(slow.String(), `"sequence":1,`))
+	assert.Equal(t, 1, strings.Count(slow.String(), `"sequence":3,`))
+	assert.NotContains(t, slow.String(), `"sequence":2,`)
+}
+
+func TestReplaceOutputs_single(t *testing.T) {
+	configureMetrics(t)
+
+	// a replaced single output is swapped for the new one
+	replacement := namedWriter("file", NewAuditWriter(&lockedBuffer{}, 1), 10)
+	next, retire := ReplaceOutputs(namedWriter("file", NewAuditWriter(&lockedBuffer{}, 1), 10), []string{"file"}, []*AuditWriter{replacement})
+	assert.Same(t, replacement, next)
+	assert.Nil(t, retire(context.Background()))
+
+	// a kept single output is queued next to the added one and not closed
+	kept := &closingWriter{blockingWriter: blockingWriter{release: make(chan struct{})}}
+	close(kept.release)
+	next, retire = ReplaceOutputs(namedWriter("file", NewAuditWriter(kept, 1), 10), []string{"http"}, []*AuditWriter{namedWriter("http", NewAuditWriter(&lockedBuffer{}, 1), 10)})
+	assert.Equal(t, "file,http", next.Name())
+	assert.Nil(t, retire(context.Background()))
+	assert.False(t, kept.isClosed())
+
+	assert.Nil(t, next.Write(&parser.AuditMessageGroup{Seq: 1}))
+	assert.Nil(t, next.Close(context.Background()))
+	assert.True(t, kept.isClosed())
+	assert.Contains(t, kept.String(), `"sequence":1,`)
+}
+
+func TestFanOutAuditWriter_match(t *testing.T) {
+	configureMetrics(t)
+
+	compliance, analytics := &lockedBuffer{}, &lockedBuffer{}
+	complianceWriter := namedWriter("file", NewAuditWriter(compliance, 1), 10)
+	complianceWriter.SetMatcher(matchFunc(func(msg *parser.AuditMessageGroup) bool {
+		return msg.RuleKey == "passwd-write-log"
+	}))
+	analyticsWriter := namedWriter("http", NewAuditWriter(analytics, 1), 10)
+	analyticsWriter.SetMatcher(matchFunc(func(msg *parser.AuditMessageGroup) bool {
+		return msg.RuleKey == "execve"
+	}))
+
+	w := NewFanOutAuditWriter([]*AuditWriter{complianceWriter, analyticsWriter})
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1, RuleKey: "passwd-write-log"}))
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 2, RuleKey: "execve"}))
+	// a group no output matches is written nowhere
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 3, RuleKey: "other"}))
+	assert.Nil(t, w.Close(context.Background()))
+
+	assert.Contains(t, compliance.String(), `"sequence":1,`)
+	assert.NotContains(t, compliance.String(), `"sequence":2,`)
+	assert.Contains(t, analytics.String(), `"sequence":2,`)
+	assert.NotContains(t, analytics.String(), `"sequence":1,`)
+	assert.NotContains(t, compliance.String()+analytics.String(), `"sequence":3,`)
+}
+
+func TestFanOutAuditWriter_queueFullBlock(t *testing.T) {
+	configureMetrics(t)
+
+	slow := &blockingWriter{release: make(chan struct{})}
+	blocking := namedWriter("slow", NewAuditWriter(slow, 1), 1)
+	blocking.onFailure = FailBlock
+	w := NewFanOutAuditWriter([]*AuditWriter{blocking})
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		// one group is held by the writer, one waits in the queue, the third waits for room
+		for seq := 1; seq <= 3; seq++ {
+			assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: seq}))
+		}
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write did not wait for room in the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(slow.release)
+	<-written
+	assert.Nil(t, w.Close(context.Background()))
+	assert.Contains(t, slow.String(), `"sequence":3,`)
+}
+
+func TestFanOutAuditWriter_queueFullBlockClose(t *testing.T) {
+	configureMetrics(t)
+
+	slow := &blockingWriter{release: make(chan struct{})}
+	defer close(slow.release)
+	blocking := namedWriter("slow", NewAuditWriter(slow, 1), 1)
+	blocking.onFailure = FailBlock
+	w := NewFanOutAuditWriter([]*AuditWriter{blocking})
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for seq := 1; seq <= 3; seq++ {
+			assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: seq}))
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// closing ends the wait for room, the group is dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, w.Close(ctx))
+	<-written
+}
@@ -0,0 +1,208 @@
+package output
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/spf13/viper"
+)
+
+const (
+	// secretCheckInterval is how often a credential file is checked for a new credential
+	secretCheckInterval = time.Second
+
+	defaultSignatureHeader = "X-Signature"
+	defaultTimestampHeader = "X-Timestamp"
+)
+
+// secret is a credential given in the config or read from a file. The file is read again once
+// it changes, so rotated credentials are used without a restart
+type secret struct {
+	path string
+
+	lock    sync.Mutex
+	value   string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+// newSecret reads the credential from <key> or the file in <key>_file, it is nil when neither is
+// set
+func newSecret(config *viper.Viper, key string) (*secret, error) {
+	value, path := config.GetString(key), config.GetString(key+"_file")
+	switch {
+	case value != "" && path != "":
+		return nil, fmt.Errorf("output %s and %s_file for http can not both be set", key, key)
+	case value != "":
+		return &secret{value: value}, nil
+	case path == "":
+		return nil, nil
+	}
+
+	s := &secret{path: path}
+	if _, err := s.get(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns the credential, reading the file again when it changed since it was last checked
+func (s *secret) get(now time.Time) (string, error) {
+	if s.path == "" {
+		return s.value, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.checked.IsZero() && now.Sub(s.checked) < secretCheckInterval {
+		return s.value, nil
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the credential in %s. Error: %s", s.path, err)
+	}
+	if !s.checked.IsZero() && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		s.checked = now
+		return s.value, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the credential in %s. Error: %s", s.path, err)
+	}
+	value := string(bytes.TrimSpace(data))
+	if value == "" {
+		return "", fmt.Errorf("the credential in %s is empty", s.path)
+	}
+
+	if !s.checked.IsZero() {
+		logger.Info("Credential file changed, using the new credential", "path", s.path)
+	}
+	s.value, s.modTime, s.size, s.checked = value, info.ModTime(), info.Size(), now
+	return s.value, nil
+}
+
+// httpAuth adds the headers and credentials from output.http.auth to the requests
+type httpAuth struct {
+	headers map[string]string
+	bearer  *secret
+	basic   *basicAuth
+	hmac    *hmacSigner
+}
+
+type basicAuth struct {
+	username string
+	password *secret
+}
+
+// hmacSigner signs the request body with HMAC-SHA256. The signature covers the timestamp and the
+// body as "<timestamp>.<body>" so a captured request can not be sent again later
+type hmacSigner struct {
+	key             *secret
+	signatureHeader string
+	timestampHeader string
+}
+
+func newHTTPAuth(config *viper.Viper) (*httpAuth, error) {
+	if !config.IsSet("output.http.auth") {
+		return nil, nil
+	}
+
+	var err error
+	a := &httpAuth{headers: config.GetStringMapString("output.http.auth.headers")}
+
+	if a.bearer, err = newSecret(config, "output.http.auth.bearer_token"); err != nil {
+		return nil, err
+	}
+
+	if config.IsSet("output.http.auth.basic") {
+		a.basic = &basicAuth{username: config.GetString("output.http.auth.basic.username")}
+		if a.basic.password, err = newSecret(config, "output.http.auth.basic.password"); err != nil {
+			return nil, err
+		}
+		if a.basic.username == "" || a.basic.password == nil {
+			return nil, errors.New("output auth.basic for http needs a username and a password or password_file")
+		}
+		if a.bearer != nil {
+			return nil, errors.New("output auth for http can use a bearer token or basic auth, not both")
+		}
+	}
+
+	if config.IsSet("output.http.auth.hmac") {
+		a.hmac = &hmacSigner{
+			signatureHeader: defaultSignatureHeader,
+			timestampHeader: defaultTimestampHeader,
+		}
+		if a.hmac.key, err = newSecret(config, "output.http.auth.hmac.key"); err != nil {
+			return nil, err
+		}
+		if a.hmac.key == nil {
+			return nil, errors.New("output auth.hmac for http needs a key or key_file")
+		}
+		if header := config.GetString("output.http.auth.hmac.signature_header"); header != "" {
+			a.hmac.signatureHeader = header
+		}
+		if header := config.GetString("output.http.auth.hmac.timestamp_header"); header != "" {
+			a.hmac.timestampHeader = header
+		}
+	}
+
+	return a, nil
+}
+
+// apply adds the headers and credentials to the request for the body
+func (a *httpAuth) apply(req *http.Request, body []byte, now time.Time) error {
+	for name, value := range a.headers {
+		req.Header.Set(name, value)
+	}
+
+	if a.bearer != nil {
+		token, err := a.bearer.get(now)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if a.basic != nil {
+		password, err := a.basic.password.get(now)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(a.basic.username, password)
+	}
+
+	if a.hmac != nil {
+		key, err := a.hmac.key.get(now)
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		req.Header.Set(a.hmac.timestampHeader, timestamp)
+		req.Header.Set(a.hmac.signatureHeader, sign(key, timestamp, body))
+	}
+
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>"
+func sign(key string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
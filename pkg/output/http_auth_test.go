@@ -0,0 +1,162 @@
+package output
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecret_get(t *testing.T) {
+	c := viper.New()
+	s, err := newSecret(c, "output.http.auth.bearer_token")
+	assert.Nil(t, err)
+	assert.Nil(t, s)
+
+	c.Set("output.http.auth.bearer_token", "static")
+	s, err = newSecret(c, "output.http.auth.bearer_token")
+	assert.Nil(t, err)
+	value, err := s.get(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "static", value)
+
+	path := filepath.Join(t.TempDir(), "token")
+	c.Set("output.http.auth.bearer_token_file", path)
+	_, err = newSecret(c, "output.http.auth.bearer_token")
+	assert.EqualError(t, err, "output output.http.auth.bearer_token and output.http.auth.bearer_token_file for http can not both be set")
+
+	c.Set("output.http.auth.bearer_token", "")
+	_, err = newSecret(c, "output.http.auth.bearer_token")
+	assert.ErrorContains(t, err, "failed to read the credential in "+path)
+
+	assert.Nil(t, os.WriteFile(path, nil, 0o600))
+	_, err = newSecret(c, "output.http.auth.bearer_token")
+	assert.EqualError(t, err, "the credential in "+path+" is empty")
+
+	assert.Nil(t, os.WriteFile(path, []byte("first\n"), 0o600))
+	s, err = newSecret(c, "output.http.auth.bearer_token")
+	assert.Nil(t, err)
+	now := time.Now()
+	value, err = s.get(now)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", value)
+
+	// a rotated file is picked up once it is checked again
+	assert.Nil(t, os.WriteFile(path, []byte("second-token\n"), 0o600))
+	later := now.Add(time.Hour)
+	assert.Nil(t, os.Chtimes(path, later, later))
+	value, err = s.get(now)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", value)
+	value, err = s.get(now.Add(secretCheckInterval))
+	assert.Nil(t, err)
+	assert.Equal(t, "second-token", value)
+}
+
+func TestNewHTTPAuth(t *testing.T) {
+	c := viper.New()
+	a, err := newHTTPAuth(c)
+	assert.Nil(t, err)
+	assert.Nil(t, a)
+
+	tests := []struct {
+		auth map[string]interface{}
+		err  string
+	}{
+		{map[string]interface{}{"basic": map[string]interface{}{"username": "pauditd"}}, "output auth.basic for http needs a username and a password or password_file"},
+		{map[string]interface{}{"basic": map[string]interface{}{"username": "pauditd", "password": "secret"}, "bearer_token": "token"}, "output auth for http can use a bearer token or basic auth, not both"},
+		{map[string]interface{}{"hmac": map[string]interface{}{"signature_header": "X-Sig"}}, "output auth.hmac for http needs a key or key_file"},
+	}
+	for _, tt := range tests {
+		c := viper.New()
+		c.Set("output.http.auth", tt.auth)
+		_, err := newHTTPAuth(c)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestHTTPAuth_apply(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"sequence":1}`)
+
+	c := viper.New()
+	c.Set("output.http.auth", map[string]interface{}{
+		"bearer_token": "token",
+		"headers":      map[string]interface{}{"X-Api-Key": "key", "X-Tenant": "audit"},
+		"hmac":         map[string]interface{}{"key": "hmac-key"},
+	})
+	a, err := newHTTPAuth(c)
+	assert.Nil(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", nil)
+	assert.Nil(t, a.apply(req, body, now))
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	assert.Equal(t, "key", req.Header.Get("X-Api-Key"))
+	assert.Equal(t, "audit", req.Header.Get("X-Tenant"))
+	assert.Equal(t, "1700000000", req.Header.Get("X-Timestamp"))
+
+	mac := hmac.New(sha256.New, []byte("hmac-key"))
+	mac.Write([]byte("1700000000." + string(body)))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), req.Header.Get("X-Signature"))
+
+	c = viper.New()
+	c.Set("output.http.auth", map[string]interface{}{
+		"basic": map[string]interface{}{"username": "pauditd", "password": "secret"},
+		"hmac":  map[string]interface{}{"key": "hmac-key", "signature_header": "X-Sig", "timestamp_header": "X-Time"},
+	})
+	a, err = newHTTPAuth(c)
+	assert.Nil(t, err)
+
+	req = httptest.NewRequest(http.MethodPost, "http://example.com", nil)
+	assert.Nil(t, a.apply(req, body, now))
+	username, password, ok := req.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "pauditd", username)
+	assert.Equal(t, "secret", password)
+	assert.Equal(t, "1700000000", req.Header.Get("X-Time"))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), req.Header.Get("X-Sig"))
+}
+
+func TestHTTPWriter_auth(t *testing.T) {
+	configureMetrics(t)
+
+	path := filepath.Join(t.TempDir(), "key")
+	assert.Nil(t, os.WriteFile(path, []byte("hmac-key\n"), 0o600))
+
+	var authorization string
+	var signed bool
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		authorization = r.Header.Get("Authorization")
+		signed = r.Header.Get("X-Signature") == sign("hmac-key", r.Header.Get("X-Timestamp"), body)
+	}))
+	defer testServer.Close()
+
+	c := viper.New()
+	c.Set("output.http.auth.bearer_token", "token")
+	c.Set("output.http.auth.hmac.key_file", path)
+	auth, err := newHTTPAuth(c)
+	assert.Nil(t, err)
+
+	writer := &HTTPWriter{
+		url:                     testServer.URL,
+		client:                  &http.Client{},
+		ResponseBodyTransformer: TestTransformer{},
+		retry:                   retryPolicy{attempts: 1},
+		auth:                    auth,
+	}
+
+	assert.Nil(t, writer.send(context.Background(), [][]byte{[]byte("test string")}))
+	assert.Equal(t, "Bearer token", authorization)
+	assert.True(t, signed)
+}
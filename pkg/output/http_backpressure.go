@@ -0,0 +1,63 @@
+package output
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+)
+
+const (
+	backpressureDrop  = "drop"
+	backpressureBlock = "block"
+
+	defaultBackpressureMaxWait = 10 * time.Second
+)
+
+// backpressure makes Write wait for room in a full buffer instead of failing right away, so a
+// spike is slowed down and absorbed by the kernel backlog rather than dropped
+type backpressure struct {
+	maxWait time.Duration // 0 waits until there is room or the writer is closed
+
+	closing   chan struct{} // closed before the buffer is, ends waiting for room
+	closeOnce sync.Once
+}
+
+func newBackpressure(maxWait time.Duration) *backpressure {
+	return &backpressure{
+		maxWait: maxWait,
+		closing: make(chan struct{}),
+	}
+}
+
+// wait hands the message to the workers once they make room in the buffer. It gives up with
+// errBufferFull after the max wait, and with errWriterClosed when the writer is closed first
+func (b *backpressure) wait(messages chan<- *messageTransport, transport *messageTransport) error {
+	metric.GetClient().Increment("http_writer.blocked")
+	blocked := metric.GetClient().NewTiming()
+	defer blocked.Send("http_writer.blocked_time")
+
+	var timeout <-chan time.Time
+	if b.maxWait > 0 {
+		timer := time.NewTimer(b.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case messages <- transport:
+		return nil
+	case <-timeout:
+		metric.GetClient().Increment("http_writer.buffer_full")
+		return errBufferFull
+	case <-b.closing:
+		return errWriterClosed
+	}
+}
+
+// release ends every wait, Close calls it before it waits for the writes to finish
+func (b *backpressure) release() {
+	b.closeOnce.Do(func() {
+		close(b.closing)
+	})
+}
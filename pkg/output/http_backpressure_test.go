@@ -0,0 +1,121 @@
+package output
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPWriter_writeBlocks(t *testing.T) {
+	configureMetrics(t)
+
+	msgChannel := make(chan *messageTransport, 1)
+	writer := &HTTPWriter{
+		messages:     msgChannel,
+		backpressure: newBackpressure(0),
+	}
+
+	msg := []byte("test string")
+	_, err := writer.Write(msg)
+	assert.Nil(t, err)
+
+	written := make(chan error)
+	go func() {
+		_, err := writer.Write([]byte("blocked"))
+		written <- err
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write to a full buffer did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the write goes through once a worker makes room
+	assert.Equal(t, "test string", string((<-msgChannel).message))
+	assert.Nil(t, <-written)
+	assert.Equal(t, "blocked", string((<-msgChannel).message))
+}
+
+func TestHTTPWriter_writeBlocksMaxWait(t *testing.T) {
+	configureMetrics(t)
+
+	writer := &HTTPWriter{
+		messages:     make(chan *messageTransport, 1),
+		backpressure: newBackpressure(20 * time.Millisecond),
+	}
+
+	msg := []byte("test string")
+	_, err := writer.Write(msg)
+	assert.Nil(t, err)
+
+	start := time.Now()
+	result, err := writer.Write(msg)
+	assert.ErrorIs(t, err, errBufferFull)
+	assert.Equal(t, 0, result)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+}
+
+func TestHTTPWriter_closeReleasesBlockedWrites(t *testing.T) {
+	configureMetrics(t)
+
+	writer := &HTTPWriter{
+		messages:     make(chan *messageTransport, 1),
+		wg:           &sync.WaitGroup{},
+		cancelFunc:   func() {},
+		backpressure: newBackpressure(0),
+	}
+
+	_, err := writer.Write([]byte("test string"))
+	assert.Nil(t, err)
+
+	written := make(chan error)
+	go func() {
+		_, err := writer.Write([]byte("blocked"))
+		written <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// no worker ever makes room, Close has to end the wait to close the buffer
+	closed := make(chan error)
+	go func() {
+		closed <- writer.Close(context.Background())
+	}()
+
+	assert.ErrorIs(t, <-written, errWriterClosed)
+	assert.Nil(t, <-closed)
+	_, err = writer.Write([]byte("late"))
+	assert.ErrorIs(t, err, errWriterClosed)
+}
+
+func TestHTTPWriter_replacedGivesBackBlockedWrites(t *testing.T) {
+	configureMetrics(t)
+
+	previous := namedWriter("http", NewAuditWriter(&HTTPWriter{
+		messages:     make(chan *messageTransport, 1),
+		wg:           &sync.WaitGroup{},
+		cancelFunc:   func() {},
+		backpressure: newBackpressure(0),
+	}, 1), 10)
+	previous.onFailure = FailDrop
+	assert.Nil(t, previous.Write(&parser.AuditMessageGroup{Seq: 1}))
+
+	written := make(chan error)
+	go func() {
+		written <- previous.Write(&parser.AuditMessageGroup{Seq: 2})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// retiring the replaced output ends the wait and gives the group back instead of dropping it
+	next := namedWriter("http", NewAuditWriter(&lockedBuffer{}, 1), 10)
+	replacement, retire := ReplaceOutputs(previous, []string{"http"}, []*AuditWriter{next})
+	assert.Same(t, next, replacement)
+	assert.Nil(t, retire(context.Background()))
+	assert.ErrorIs(t, <-written, ErrWriterClosed)
+
+	assert.ErrorIs(t, previous.Write(&parser.AuditMessageGroup{Seq: 3}), ErrWriterClosed)
+}
@@ -0,0 +1,181 @@
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	statsd "gopkg.in/alexcesaro/statsd.v2"
+)
+
+const (
+	defaultBatchMaxEvents     = 500
+	defaultBatchMaxBytes      = 1024 * 1024
+	defaultBatchFlushInterval = time.Second
+)
+
+// batchFormat is how the messages of a batch are put into the request body
+type batchFormat string
+
+const (
+	// batchNDJSON puts every message on a line of its own
+	batchNDJSON batchFormat = "ndjson"
+	// batchJSONArray puts the messages in a JSON array
+	batchJSONArray batchFormat = "json_array"
+)
+
+// batchConfig decides when the messages a worker collected are sent
+type batchConfig struct {
+	maxEvents     int
+	maxBytes      int
+	flushInterval time.Duration
+	format        batchFormat
+}
+
+// contentType returns the Content-Type of a batch body
+func (f batchFormat) contentType() string {
+	if f == batchNDJSON {
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// encode puts the transformed messages into the body of a batch
+func (f batchFormat) encode(bodies [][]byte) []byte {
+	var buf bytes.Buffer
+	if f == batchJSONArray {
+		buf.WriteByte('[')
+	}
+
+	for i, body := range bodies {
+		body = bytes.TrimSpace(body)
+		if f == batchJSONArray {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(body)
+			continue
+		}
+		buf.Write(body)
+		buf.WriteByte('\n')
+	}
+
+	if f == batchJSONArray {
+		buf.WriteByte(']')
+	}
+	return buf.Bytes()
+}
+
+// compression is the Content-Encoding of the request bodies, empty sends them as they are
+type compression string
+
+const (
+	compressionGzip compression = "gzip"
+	compressionZstd compression = "zstd"
+)
+
+// zstdEncoder is shared by the workers, EncodeAll can be called concurrently
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+func (c compression) compress(body []byte) ([]byte, error) {
+	switch c {
+	case compressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case compressionZstd:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(body, make([]byte, 0, len(body)/2)), nil
+	}
+
+	return body, nil
+}
+
+// batch holds the messages a worker collected
+type batch struct {
+	messages [][]byte
+	bytes    int
+	timer    statsd.Timing // started when the oldest message was written
+}
+
+func (b *batch) add(transport *messageTransport) {
+	if len(b.messages) == 0 {
+		b.timer = transport.timer
+	}
+	b.messages = append(b.messages, transport.message)
+	b.bytes += len(transport.message)
+}
+
+// full reports whether the batch reached the count or size it is sent at
+func (b *batch) full(c *batchConfig) bool {
+	return len(b.messages) >= c.maxEvents || b.bytes >= c.maxBytes
+}
+
+// processBatches collects the messages from the channel into batches and sends them once they
+// are full or the oldest message waited for the flush interval
+func (w *HTTPWriter) processBatches(ctx context.Context) {
+	defer w.wg.Done()
+
+	var b batch
+	flushTimer := time.NewTimer(w.batch.flushInterval)
+	flushTimer.Stop()
+	defer flushTimer.Stop()
+
+	flush := func() {
+		flushTimer.Stop()
+		if len(b.messages) == 0 {
+			return
+		}
+
+		metric.GetClient().Increment("http_writer.batches")
+		metric.GetClient().Count("http_writer.batched_messages", len(b.messages))
+		if w.dispatch(ctx, b.messages) {
+			b.timer.Send("http_writer.latency")
+		}
+		b = batch{}
+	}
+
+	for {
+		select {
+		case <-w.workerShutdownSignals:
+			logger.Info("Worker shutting down")
+			flush()
+			return
+		case transport, ok := <-w.messages:
+			if !ok {
+				// Closed and drained
+				flush()
+				return
+			}
+			if transport == nil {
+				continue
+			}
+
+			if len(b.messages) == 0 {
+				flushTimer.Reset(w.batch.flushInterval)
+			}
+			b.add(transport)
+			if b.full(w.batch) {
+				flush()
+			}
+		case <-flushTimer.C:
+			flush()
+		}
+	}
+}
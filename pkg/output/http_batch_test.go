@@ -0,0 +1,162 @@
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchFormat_encode(t *testing.T) {
+	bodies := [][]byte{[]byte(`{"sequence":1}` + "\n"), []byte(`{"sequence":2}`)}
+
+	assert.Equal(t, "{\"sequence\":1}\n{\"sequence\":2}\n", string(batchNDJSON.encode(bodies)))
+	assert.Equal(t, `[{"sequence":1},{"sequence":2}]`, string(batchJSONArray.encode(bodies)))
+	assert.Equal(t, `[]`, string(batchJSONArray.encode(nil)))
+
+	assert.Equal(t, "application/x-ndjson", batchNDJSON.contentType())
+	assert.Equal(t, "application/json", batchJSONArray.contentType())
+}
+
+func TestCompression_compress(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"sequence":1}`+"\n"), 100)
+
+	same, err := compression("").compress(body)
+	assert.Nil(t, err)
+	assert.Equal(t, body, same)
+
+	gzipped, err := compressionGzip.compress(body)
+	assert.Nil(t, err)
+	assert.Less(t, len(gzipped), len(body))
+	zr, err := gzip.NewReader(bytes.NewReader(gzipped))
+	assert.Nil(t, err)
+	decoded, err := io.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Equal(t, body, decoded)
+
+	zstded, err := compressionZstd.compress(body)
+	assert.Nil(t, err)
+	assert.Less(t, len(zstded), len(body))
+	dec, err := zstd.NewReader(nil)
+	assert.Nil(t, err)
+	defer dec.Close()
+	decoded, err = dec.DecodeAll(zstded, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, body, decoded)
+}
+
+func TestHTTPWriter_processBatches(t *testing.T) {
+	configureMetrics(t)
+
+	type request struct {
+		body                         string
+		contentType, contentEncoding string
+	}
+	var mu sync.Mutex
+	var requests []request
+	testServer := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		assert.Nil(t, err)
+		body, err := io.ReadAll(zr)
+		assert.Nil(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request{string(body), r.Header.Get("Content-Type"), r.Header.Get("Content-Encoding")})
+	}))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &HTTPWriter{
+		url:                     testServer.URL,
+		client:                  &http.Client{},
+		messages:                make(chan *messageTransport, 10),
+		ResponseBodyTransformer: TestTransformer{},
+		workerShutdownSignals:   make(chan struct{}, 1),
+		wg:                      &sync.WaitGroup{},
+		ctx:                     ctx,
+		cancelFunc:              cancel,
+		retry:                   retryPolicy{attempts: 1},
+		batch:                   &batchConfig{maxEvents: 3, maxBytes: 1024, flushInterval: 50 * time.Millisecond, format: batchJSONArray},
+		compression:             compressionGzip,
+	}
+	writer.wg.Add(1)
+	go writer.Process(ctx)
+
+	// a full batch is sent right away, the rest once the flush interval passed
+	for _, msg := range []string{`{"sequence":1}`, `{"sequence":2}`, `{"sequence":3}`, `{"sequence":4}`} {
+		_, err := writer.Write([]byte(msg + "\n"))
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// what is collected when the writer closes is sent before it returns
+	_, err := writer.Write([]byte(`{"sequence":5}` + "\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close(context.Background()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []request{
+		{`[{"sequence":1},{"sequence":2},{"sequence":3}]`, "application/json", "gzip"},
+		{`[{"sequence":4}]`, "application/json", "gzip"},
+		{`[{"sequence":5}]`, "application/json", "gzip"},
+	}, requests)
+}
+
+func TestHTTPWriter_writeSpooledBatches(t *testing.T) {
+	configureMetrics(t)
+
+	var mu sync.Mutex
+	var bodies []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+	}))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := &HTTPWriter{
+		url:                     testServer.URL,
+		client:                  &http.Client{},
+		ResponseBodyTransformer: TestTransformer{},
+		ctx:                     ctx,
+		retry:                   retryPolicy{attempts: 1},
+		batch:                   &batchConfig{maxEvents: 2, maxBytes: 1024, format: batchNDJSON},
+	}
+
+	// the spool is replayed in batches of the size the writer sends
+	config := testSpoolConfig(t.TempDir())
+	config.batchEvents, config.batchBytes = writer.spoolBatch()
+	s, err := openSpool("http", config, writer.writeSpooled)
+	assert.Nil(t, err)
+	defer s.close()
+
+	for _, msg := range []string{`{"sequence":1}`, `{"sequence":2}`, `{"sequence":3}`} {
+		assert.Nil(t, s.append([]byte(msg+"\n")))
+	}
+	assert.Nil(t, s.replay())
+	assert.False(t, s.pending())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		`{"sequence":1}` + "\n" + `{"sequence":2}` + "\n",
+		`{"sequence":3}` + "\n",
+	}, bodies)
+}
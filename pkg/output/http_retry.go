@@ -0,0 +1,105 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetryInitialBackoff = 500 * time.Millisecond
+	defaultRetryMaxBackoff     = 30 * time.Second
+	// maxRetryAfter caps a Retry-After from the service, so a broken header can not stall the
+	// worker for days
+	maxRetryAfter = 10 * time.Minute
+)
+
+// statusError is a response the service may accept when the request is sent again
+type statusError struct {
+	code       int
+	retryAfter time.Duration // from the Retry-After header, 0 when there is none
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("service responded with %d", e.code)
+}
+
+// retryableStatus reports whether sending a request again can change the response
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// retryPolicy decides how often and after how long a failed request is sent again
+type retryPolicy struct {
+	attempts       int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// retryable reports whether the request that failed with err is worth sending again
+func retryable(err error) bool {
+	if errors.Is(err, errUnsendable) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		return retryableStatus(se.code)
+	}
+
+	// the request did not reach the service or the breaker is open
+	return true
+}
+
+// backoff returns how long to wait before the attempt after the given one, attempts start at 0.
+// The backoff doubles with every attempt and half of it is random so workers do not retry in
+// lockstep. A Retry-After from the service is honored as given, beyond the max backoff
+func (p retryPolicy) backoff(attempt int, err error) time.Duration {
+	backoff := p.initialBackoff
+	for i := 0; i < attempt && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, p.maxBackoff)
+	backoff = backoff/2 + rand.N(backoff/2+1)
+
+	var se *statusError
+	if errors.As(err, &se) && se.retryAfter > backoff {
+		backoff = min(se.retryAfter, maxRetryAfter)
+	}
+
+	return backoff
+}
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as a date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+
+	return 0
+}
+
+// sleep waits for d unless ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,53 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := retryPolicy{attempts: 10, initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second}
+
+	// half of the backoff is random
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			backoff := p.backoff(attempt, errors.New("broken"))
+			assert.GreaterOrEqual(t, backoff, want/2)
+			assert.LessOrEqual(t, backoff, want)
+		}
+	}
+	assert.LessOrEqual(t, p.backoff(1000, nil), time.Second)
+
+	// Retry-After is honored as given, even beyond the max backoff
+	assert.Equal(t, 700*time.Millisecond, p.backoff(0, &statusError{code: 503, retryAfter: 700 * time.Millisecond}))
+	assert.Equal(t, 60*time.Second, p.backoff(0, &statusError{code: 429, retryAfter: 60 * time.Second}))
+	assert.Equal(t, maxRetryAfter, p.backoff(0, &statusError{code: 429, retryAfter: 24 * time.Hour}))
+	assert.LessOrEqual(t, p.backoff(0, &statusError{code: 429}), 100*time.Millisecond)
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(errors.New("connection refused")))
+	assert.True(t, retryable(&statusError{code: http.StatusTooManyRequests}))
+	assert.True(t, retryable(&statusError{code: http.StatusBadGateway}))
+	assert.False(t, retryable(&statusError{code: http.StatusBadRequest}))
+	assert.False(t, retryable(errUnsendable))
+	assert.False(t, retryable(context.Canceled))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 2*time.Second, parseRetryAfter("2", now))
+	assert.Equal(t, 60*time.Second, parseRetryAfter("60", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-2", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("Mon, 01 Jan 2024 12:00:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Mon, 01 Jan 2024 11:00:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
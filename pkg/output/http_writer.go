@@ -3,12 +3,13 @@ package output
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pantheon-systems/pauditd/pkg/logger"
 	"github.com/pantheon-systems/pauditd/pkg/metric"
@@ -19,9 +20,15 @@ import (
 	statsd "gopkg.in/alexcesaro/statsd.v2"
 )
 
-const (
-	maxBuffErrCount = 10
-)
+// errBufferFull is returned by Write when the workers are behind and the buffer has no room left,
+// the failure policy of the output decides what happens to the message
+var errBufferFull = errors.New("http writer buffer is full")
+
+// errWriterClosed is returned by Write once Close was called
+var errWriterClosed = errors.New("http writer is closed")
+
+// errUnsendable marks messages that fail the same way however often they are sent
+var errUnsendable = errors.New("message can not be sent")
 
 // HTTPWriter is the class that encapsulates the http output plugin
 type HTTPWriter struct {
@@ -33,8 +40,17 @@ type HTTPWriter struct {
 	debug                   bool
 	traceHeaderName         string
 	workerShutdownSignals   chan struct{}
+	workerCount             int
+	ctx                     context.Context
 	cancelFunc              context.CancelFunc
-	buffErrCount            int
+	spool                   atomic.Pointer[spool] // set when the output spools what it fails to send
+	retry                   retryPolicy
+	batch                   *batchConfig // nil sends every message on its own
+	compression             compression
+	auth                    *httpAuth     // nil sends the requests without credentials
+	backpressure            *backpressure // nil fails writes to a full buffer right away
+	closeLock               sync.RWMutex  // guards closing the messages channel against Write
+	closed                  bool
 }
 
 type messageTransport struct {
@@ -49,21 +65,12 @@ func init() {
 func (w *HTTPWriter) Write(p []byte) (n int, err error) {
 	latencyTimer := metric.GetClient().NewTiming()
 
-	// this defered method catches the panic on write to the channel
-	// then handles shutdown gracefully
-	defer func() {
-		if r := recover(); r != nil {
-			_, ok := r.(error)
-			if !ok {
-				logger.Error(fmt.Sprintf("pkg: %v", r))
-			}
-			w.cancelFunc()
-			logger.Info("Waiting for goroutines to complete")
-			w.wg.Wait()
-			logger.Info("Goroutines completed")
-			os.Exit(0)
-		}
-	}()
+	w.closeLock.RLock()
+	defer w.closeLock.RUnlock()
+
+	if w.closed {
+		return 0, errWriterClosed
+	}
 
 	metric.GetClient().Increment("http_writer.total_messages")
 
@@ -72,88 +79,306 @@ func (w *HTTPWriter) Write(p []byte) (n int, err error) {
 		timer:   latencyTimer,
 	}
 
-	bytesSent := len(p)
 	select {
 	case w.messages <- transport:
-		w.buffErrCount = 0
+		return len(p), nil
 	default:
-		logger.Error("Buffer full or closed, messages dropped")
-		metric.GetClient().Increment("http_writer.dropped_messages")
+	}
 
-		// Exit the pod if the error persists
-		if w.buffErrCount > maxBuffErrCount {
-			os.Exit(1)
+	if w.backpressure != nil {
+		if err := w.backpressure.wait(w.messages, transport); err != nil {
+			return 0, err
 		}
-		w.buffErrCount++
+		return len(p), nil
 	}
 
-	return bytesSent, nil
+	metric.GetClient().Increment("http_writer.buffer_full")
+	return 0, errBufferFull
+}
+
+// release ends the writes waiting for room in the buffer
+func (w *HTTPWriter) release() {
+	if w.backpressure != nil {
+		w.backpressure.release()
+	}
+}
+
+// Close stops accepting messages and waits for the workers to send everything that is
+// already buffered. If ctx is done first the in flight requests are cancelled
+func (w *HTTPWriter) Close(ctx context.Context) error {
+	// writes waiting for room hold the read lock, they have to give up before the buffer is closed
+	w.release()
+
+	w.closeLock.Lock()
+	if w.closed {
+		w.closeLock.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.messages)
+	w.closeLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		w.cancelFunc()
+		return nil
+	case <-ctx.Done():
+		remaining := len(w.messages)
+		w.cancelFunc()
+
+		s := w.spool.Load()
+		if s == nil {
+			return fmt.Errorf("http writer did not drain before the deadline, %d messages left in the buffer", remaining)
+		}
+
+		// the cancelled requests are spooled by the workers, what they did not get to is spooled here
+		<-drained
+		for transport := range w.messages {
+			w.spill(s, transport.message)
+		}
+		return fmt.Errorf("http writer did not drain before the deadline, %d messages left in the buffer were spooled", remaining)
+	}
 }
 
 // Process blocks and listens for messages in the channel
 func (w *HTTPWriter) Process(ctx context.Context) {
+	if w.batch != nil {
+		w.processBatches(ctx)
+		return
+	}
+
 	for {
 		select {
 		case <-w.workerShutdownSignals:
-			fmt.Println("Worker shutting down!")
+			logger.Info("Worker shutting down")
 			w.wg.Done()
 			return
-		case transport := <-w.messages:
+		case transport, ok := <-w.messages:
+			if !ok {
+				// Closed and drained
+				w.wg.Done()
+				return
+			}
 			if transport == nil {
 				continue
 			}
 
-			traceID := uuid.NewV1()
-			body, err := w.ResponseBodyTransformer.Transform(traceID, transport.message)
-			if err != nil || body == nil {
-				logger.Error(fmt.Sprintf("Message transformation failed: %v", err))
-				continue
-			}
-			if w.debug {
-				logger.Info("http_writer.process",
-					"trace_id", traceID,
-					"original", strings.TrimSpace(string(transport.message)),
-					"transformed", string(body),
-					"event", "http.write",
-					"component", "http_writer",
-				)
+			if w.dispatch(ctx, [][]byte{transport.message}) {
+				transport.timer.Send("http_writer.latency")
 			}
-			payloadReader := bytes.NewReader(body)
+		}
+	}
+}
 
-			req, err := http.NewRequest(http.MethodPost, w.url, payloadReader)
-			if err != nil {
-				logger.Error(fmt.Sprintf("HTTPWriter.Process failed to create HTTP request: %v", err))
-				continue
-			}
+// dispatch sends the messages in one request and spools them when that fails. It reports whether
+// the messages were sent
+func (w *HTTPWriter) dispatch(ctx context.Context, messages [][]byte) bool {
+	// messages queue up behind the spooled ones until the spool is replayed
+	if s := w.spool.Load(); s != nil && s.pending() {
+		for _, message := range messages {
+			w.spill(s, message)
+		}
+		return false
+	}
 
-			if w.traceHeaderName != "" {
-				req.Header.Add(w.traceHeaderName, traceID.String())
-				logger.Info("http_writer.header_injection",
-					"event", "header.inject",
-					"component", "http_writer",
-					"trace_id", traceID,
-					"header_name", w.traceHeaderName,
-					"header_value", traceID.String(),
-				)
+	if err := w.send(ctx, messages); err != nil {
+		logger.Error(fmt.Sprintf("HTTPWriter.Process failed to send message: %v", err))
+		if s := w.spool.Load(); s != nil && !errors.Is(err, errUnsendable) {
+			for _, message := range messages {
+				w.spill(s, message)
 			}
+		}
+		return false
+	}
 
-			resp, err := w.client.Do(req.WithContext(ctx))
-			if err != nil {
-				logger.Error(fmt.Sprintf("HTTPWriter.Process failed to send HTTP request: %v", err))
-				metric.GetClient().Increment("http_writer.request_error.count")
-				continue
-			}
+	return true
+}
 
-			metric.GetClient().Increment(fmt.Sprintf("http_code.%d", resp.StatusCode))
-			if err := resp.Body.Close(); err != nil {
-				logger.Error("Failed to close response body", "error", err)
-			}
+// send posts the messages to the service, in a batch when batching is enabled. Requests that fail
+// or get a response the service may change its mind about are sent again with the same trace ID
+// until the attempts run out
+func (w *HTTPWriter) send(ctx context.Context, messages [][]byte) error {
+	traceID := uuid.NewV1()
+	body, err := w.body(traceID, messages)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		// the transformer left every message of the batch out
+		return nil
+	}
+	if w.debug {
+		logger.Info("http_writer.process",
+			"trace_id", traceID,
+			"messages", len(messages),
+			"original", strings.TrimSpace(string(bytes.Join(messages, nil))),
+			"transformed", string(body),
+			"event", "http.write",
+			"component", "http_writer",
+		)
+	}
+
+	if body, err = w.compression.compress(body); err != nil {
+		return fmt.Errorf("%w, compression failed: %v", errUnsendable, err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, traceID, body)
+		if err == nil || !retryable(err) || attempt+1 >= w.retry.attempts {
+			return err
+		}
 
-			transport.timer.Send("http_writer.latency")
+		backoff := w.retry.backoff(attempt, err)
+		logger.Error("HTTP request failed, retrying", "trace_id", traceID, "attempt", attempt+1, "backoff", backoff, "error", err)
+		metric.GetClient().Increment("http_writer.retries")
+		if err := sleep(ctx, backoff); err != nil {
+			return err
 		}
 	}
 }
 
+// body transforms the messages into the request body, it is nil when there is nothing to send
+func (w *HTTPWriter) body(traceID uuid.UUID, messages [][]byte) ([]byte, error) {
+	if w.batch == nil {
+		body, err := w.ResponseBodyTransformer.Transform(traceID, messages[0])
+		if err != nil || body == nil {
+			return nil, fmt.Errorf("%w, transformation failed: %v", errUnsendable, err)
+		}
+		return body, nil
+	}
+
+	bodies, err := httptransformer.TransformBatch(w.ResponseBodyTransformer, traceID, messages)
+	if err != nil {
+		return nil, fmt.Errorf("%w, transformation failed: %v", errUnsendable, err)
+	}
+	if len(bodies) == 0 {
+		return nil, nil
+	}
+	return w.batch.format.encode(bodies), nil
+}
+
+// post sends one request with the body to the service
+func (w *HTTPWriter) post(ctx context.Context, traceID uuid.UUID, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w, failed to create HTTP request: %v", errUnsendable, err)
+	}
+
+	if w.batch != nil {
+		req.Header.Set("Content-Type", w.batch.format.contentType())
+	}
+	if w.compression != "" {
+		req.Header.Set("Content-Encoding", string(w.compression))
+	}
+
+	if w.auth != nil {
+		// signatures and timestamps are renewed for every attempt
+		if err := w.auth.apply(req, body, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if w.traceHeaderName != "" {
+		req.Header.Add(w.traceHeaderName, traceID.String())
+		logger.Info("http_writer.header_injection",
+			"event", "header.inject",
+			"component", "http_writer",
+			"trace_id", traceID,
+			"header_name", w.traceHeaderName,
+			"header_value", traceID.String(),
+		)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		metric.GetClient().Increment("http_writer.request_error.count")
+		return err
+	}
+
+	metric.GetClient().Increment(fmt.Sprintf("http_code.%d", resp.StatusCode))
+	if err := resp.Body.Close(); err != nil {
+		logger.Error("Failed to close response body", "error", err)
+	}
+
+	switch {
+	case retryableStatus(resp.StatusCode):
+		return &statusError{code: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	case resp.StatusCode >= http.StatusBadRequest:
+		// sending the same request again gets the same response
+		metric.GetClient().Increment("http_writer.rejected")
+		return fmt.Errorf("%w, service responded with %d", errUnsendable, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// spill appends a message the writer could not send to the spool
+func (w *HTTPWriter) spill(s *spool, message []byte) {
+	if err := s.append(message); err != nil {
+		logger.Error("Failed to spool message, dropping it", "error", err)
+		metric.GetClient().Increment("http_writer.dropped_messages")
+	}
+}
+
+// writeSpooled sends messages replayed from the spool, in batches when batching is enabled and
+// otherwise in a request each, one per worker at a time. Messages that can never be sent are
+// dropped so they do not hold up the spool
+func (w *HTTPWriter) writeSpooled(messages [][]byte) (int, error) {
+	if w.batch != nil {
+		if err := w.sendSpooled(messages); err != nil {
+			return 0, err
+		}
+		return len(messages), nil
+	}
+
+	errs := make([]error, len(messages))
+	var wg sync.WaitGroup
+	for i, message := range messages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = w.sendSpooled([][]byte{message})
+		}()
+	}
+	wg.Wait()
+
+	// the messages after the first failed one are sent again, even the ones that made it
+	for i, err := range errs {
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(messages), nil
+}
+
+func (w *HTTPWriter) sendSpooled(messages [][]byte) error {
+	err := w.send(w.ctx, messages)
+	if errors.Is(err, errUnsendable) {
+		logger.Error("Dropping spooled messages", "messages", len(messages), "error", err)
+		metric.GetClient().Count("http_writer.dropped_messages", len(messages))
+		return nil
+	}
+	return err
+}
+
+// spoolBatch returns the size of a batch, or the number of workers when batching is disabled
+func (w *HTTPWriter) spoolBatch() (int, int) {
+	if w.batch != nil {
+		return w.batch.maxEvents, w.batch.maxBytes
+	}
+	return w.workerCount, 0
+}
+
+func (w *HTTPWriter) setSpool(s *spool) {
+	w.spool.Store(s)
+}
+
 func newHTTPWriter(config *viper.Viper) (*AuditWriter, error) {
 	var err error
 
@@ -170,18 +395,11 @@ func newHTTPWriter(config *viper.Viper) (*AuditWriter, error) {
 	workerShutdownSignals := make(chan struct{}, writerConfig.workerCount)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
 	go func() {
-		select {
-		case v := <-signals:
-			logger.Info(fmt.Sprintf("Received signal %v\n", v))
-			close(queue)
-			cancel()
-		case <-ctx.Done():
-			logger.Info("cancel() called! Shutting down")
-		}
-		logger.Info(fmt.Sprintf("Shutting down %d workers...\n", writerConfig.workerCount))
+		// ctx is cancelled by every Close, once the workers drained or the deadline passed, and when
+		// the TLS certificates could not be rotated. The signals stop the workers still running
+		<-ctx.Done()
+		logger.Info("Shutting down workers", "count", writerConfig.workerCount)
 		for i := 0; i < writerConfig.workerCount; i++ {
 			workerShutdownSignals <- struct{}{}
 		}
@@ -219,13 +437,20 @@ func newHTTPWriter(config *viper.Viper) (*AuditWriter, error) {
 		debug:                   writerConfig.debug,
 		traceHeaderName:         writerConfig.traceHeaderName,
 		workerShutdownSignals:   workerShutdownSignals,
+		workerCount:             writerConfig.workerCount,
+		ctx:                     ctx,
 		cancelFunc:              cancel,
-		buffErrCount:            0,
+		retry:                   writerConfig.retry,
+		batch:                   writerConfig.batch,
+		compression:             writerConfig.compression,
+		auth:                    writerConfig.auth,
+		backpressure:            writerConfig.backpressure,
 	}
 
 	for i := 0; i < writerConfig.workerCount; i++ {
 		go writer.Process(ctx)
 	}
 
-	return NewAuditWriter(writer, writerConfig.attempts), nil
+	// the attempts are spent on the requests, handing messages to the workers is not retried
+	return NewAuditWriter(writer, 1), nil
 }
@@ -31,6 +31,11 @@ type config struct {
 	workerCount       int
 	serviceURL        string
 	attempts          int
+	retry             retryPolicy
+	batch             *batchConfig
+	compression       compression
+	auth              *httpAuth
+	backpressure      *backpressure
 	idleConnTimeout   time.Duration
 	debug             bool
 
@@ -43,23 +48,33 @@ type config struct {
 func (c config) String() string {
 	return fmt.Sprintf(`Using HTTP Writers Output Plugin
 		attempts: %d
+		retry.initial_backoff: %s
+		retry.max_backoff: %s
 		url: %s
 	  worker_count: %d
 		buffer_size: %d
+		backpressure: %t
 		breaker_failure_ratio %f
 		response_body_transformer: %s
 		idle_conn_timeout: %s,
+		batch: %t
+		compression: %s
 		ssl: %s
 		ssl.client_cert: %s
 		ssl.client_key: %s
 		ssl.ca_cert: %s`,
 		c.attempts,
+		c.retry.initialBackoff,
+		c.retry.maxBackoff,
 		c.serviceURL,
 		c.workerCount,
 		c.bufferSize,
+		c.backpressure != nil,
 		c.failureRatio,
 		c.respBodyTransName,
 		c.idleConnTimeout,
+		c.batch != nil,
+		c.compression,
 		strconv.FormatBool(c.sslEnabled),
 		c.clientCertPath,
 		c.clientKeyPath,
@@ -96,6 +111,10 @@ func newHTTPWriterConfig(viperConfig *viper.Viper) (*config, error) {
 		return nil, err
 	}
 
+	if err := setRetry(viperConfig, c); err != nil {
+		return nil, err
+	}
+
 	if err := setServiceURL(viperConfig, c); err != nil {
 		return nil, err
 	}
@@ -108,6 +127,10 @@ func newHTTPWriterConfig(viperConfig *viper.Viper) (*config, error) {
 		return nil, err
 	}
 
+	if err := setBackpressure(viperConfig, c); err != nil {
+		return nil, err
+	}
+
 	setTraceHeaderName(viperConfig, c)
 	setResponseBodyTransformer(viperConfig, c)
 	setDebug(viperConfig, c)
@@ -119,6 +142,18 @@ func newHTTPWriterConfig(viperConfig *viper.Viper) (*config, error) {
 
 	setIdleConnTimeout(viperConfig, c)
 
+	if err := setBatch(viperConfig, c); err != nil {
+		return nil, err
+	}
+
+	if err := setCompression(viperConfig, c); err != nil {
+		return nil, err
+	}
+
+	if err := setAuth(viperConfig, c); err != nil {
+		return nil, err
+	}
+
 	return c, nil
 }
 
@@ -130,6 +165,27 @@ func setAttempts(viperConfig *viper.Viper, c *config) error {
 	return nil
 }
 
+func setRetry(viperConfig *viper.Viper, c *config) error {
+	c.retry = retryPolicy{
+		attempts:       c.attempts,
+		initialBackoff: defaultRetryInitialBackoff,
+		maxBackoff:     defaultRetryMaxBackoff,
+	}
+	if viperConfig.IsSet("output.http.retry.initial_backoff") {
+		c.retry.initialBackoff = viperConfig.GetDuration("output.http.retry.initial_backoff")
+		if c.retry.initialBackoff <= 0 {
+			return fmt.Errorf("output retry.initial_backoff for http must be positive, %v provided", c.retry.initialBackoff)
+		}
+	}
+	if viperConfig.IsSet("output.http.retry.max_backoff") {
+		c.retry.maxBackoff = viperConfig.GetDuration("output.http.retry.max_backoff")
+		if c.retry.maxBackoff < c.retry.initialBackoff {
+			return fmt.Errorf("output retry.max_backoff for http must be at least the initial backoff, %v provided", c.retry.maxBackoff)
+		}
+	}
+	return nil
+}
+
 func setServiceURL(viperConfig *viper.Viper, c *config) error {
 	c.serviceURL = viperConfig.GetString("output.http.url")
 	if c.serviceURL == "" {
@@ -160,6 +216,26 @@ func setBufferSize(viperConfig *viper.Viper, c *config) error {
 	return nil
 }
 
+func setBackpressure(viperConfig *viper.Viper, c *config) error {
+	switch value := viperConfig.GetString("output.http.backpressure"); value {
+	case "", backpressureDrop:
+		return nil
+	case backpressureBlock:
+	default:
+		return fmt.Errorf("output backpressure for http must be %s or %s, %s provided", backpressureDrop, backpressureBlock, value)
+	}
+
+	maxWait := defaultBackpressureMaxWait
+	if viperConfig.IsSet("output.http.max_wait") {
+		maxWait = viperConfig.GetDuration("output.http.max_wait")
+		if maxWait < 0 {
+			return fmt.Errorf("output max_wait for http can not be negative, %v provided", maxWait)
+		}
+	}
+	c.backpressure = newBackpressure(maxWait)
+	return nil
+}
+
 func setTraceHeaderName(viperConfig *viper.Viper, c *config) {
 	if viperConfig.IsSet("output.http.trace_header_name") {
 		c.traceHeaderName = viperConfig.GetString("output.http.trace_header_name")
@@ -204,3 +280,62 @@ func setIdleConnTimeout(viperConfig *viper.Viper, c *config) {
 		c.idleConnTimeout = viperConfig.GetDuration("output.http.idle_conn_timeout")
 	}
 }
+
+func setBatch(viperConfig *viper.Viper, c *config) error {
+	if !viperConfig.GetBool("output.http.batch.enabled") {
+		return nil
+	}
+
+	c.batch = &batchConfig{
+		maxEvents:     defaultBatchMaxEvents,
+		maxBytes:      defaultBatchMaxBytes,
+		flushInterval: defaultBatchFlushInterval,
+		format:        batchNDJSON,
+	}
+	if viperConfig.IsSet("output.http.batch.max_events") {
+		c.batch.maxEvents = viperConfig.GetInt("output.http.batch.max_events")
+		if c.batch.maxEvents < 1 {
+			return fmt.Errorf("output batch.max_events for http must be at least 1, %v provided", c.batch.maxEvents)
+		}
+	}
+	if viperConfig.IsSet("output.http.batch.max_bytes") {
+		c.batch.maxBytes = int(viperConfig.GetSizeInBytes("output.http.batch.max_bytes"))
+		if c.batch.maxBytes < 1 {
+			return fmt.Errorf("output batch.max_bytes for http must be a size, %v provided", viperConfig.GetString("output.http.batch.max_bytes"))
+		}
+	}
+	if viperConfig.IsSet("output.http.batch.flush_interval") {
+		c.batch.flushInterval = viperConfig.GetDuration("output.http.batch.flush_interval")
+		if c.batch.flushInterval <= 0 {
+			return fmt.Errorf("output batch.flush_interval for http must be positive, %v provided", c.batch.flushInterval)
+		}
+	}
+	if viperConfig.IsSet("output.http.batch.format") {
+		switch c.batch.format = batchFormat(viperConfig.GetString("output.http.batch.format")); c.batch.format {
+		case batchNDJSON, batchJSONArray:
+		default:
+			return fmt.Errorf("output batch.format for http must be %s or %s, %s provided", batchNDJSON, batchJSONArray, c.batch.format)
+		}
+	}
+	return nil
+}
+
+func setCompression(viperConfig *viper.Viper, c *config) error {
+	switch value := viperConfig.GetString("output.http.compression"); value {
+	case "", "none":
+	case string(compressionGzip), string(compressionZstd):
+		c.compression = compression(value)
+	default:
+		return fmt.Errorf("output compression for http must be none, gzip or zstd, %s provided", value)
+	}
+	return nil
+}
+
+func setAuth(viperConfig *viper.Viper, c *config) error {
+	auth, err := newHTTPAuth(viperConfig)
+	if err != nil {
+		return err
+	}
+	c.auth = auth
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,6 +18,20 @@ import (
 
 var transformerFunctionWasCalled = false
 
+var metricsOnce sync.Once
+
+// configureMetrics sets up a disabled metrics client once, reconfiguring it would race with
+// workers left running by earlier tests
+func configureMetrics(t *testing.T) {
+	metricsOnce.Do(func() {
+		cfg := viper.New()
+		cfg.Set("metrics.enabled", false)
+		if err := metric.Configure(cfg); err != nil {
+			t.Fatalf("Failed to configure metrics: %v", err)
+		}
+	})
+}
+
 type TestTransformer struct{}
 
 func (t TestTransformer) Transform(_ uuid.UUID, body []byte) ([]byte, error) {
@@ -33,6 +48,20 @@ func TestHTTPWriter_newHttpWriter(t *testing.T) {
 	assert.EqualError(t, err, "output attempts for http must be at least 1, 0 provided")
 	assert.Nil(t, w)
 
+	// retry errors
+	c = viper.New()
+	c.Set("output.http.attempts", 3)
+	c.Set("output.http.retry.initial_backoff", "0s")
+	w, err = newHTTPWriter(c)
+	assert.EqualError(t, err, "output retry.initial_backoff for http must be positive, 0s provided")
+	assert.Nil(t, w)
+
+	c.Set("output.http.retry.initial_backoff", "2s")
+	c.Set("output.http.retry.max_backoff", "1s")
+	w, err = newHTTPWriter(c)
+	assert.EqualError(t, err, "output retry.max_backoff for http must be at least the initial backoff, 1s provided")
+	assert.Nil(t, w)
+
 	// url error
 	c = viper.New()
 	c.Set("output.http.stats.enabled", false)
@@ -78,6 +107,51 @@ func TestHTTPWriter_newHttpWriter(t *testing.T) {
 	assert.NotNil(t, w)
 	assert.IsType(t, &HTTPWriter{}, w.w)
 	assert.Equal(t, 1, w.attempts)
+	assert.Equal(t, retryPolicy{attempts: 1, initialBackoff: defaultRetryInitialBackoff, maxBackoff: defaultRetryMaxBackoff}, w.w.(*HTTPWriter).retry)
+
+	// batching and compression
+	c.Set("output.http.batch.enabled", true)
+	c.Set("output.http.batch.max_events", 100)
+	c.Set("output.http.batch.max_bytes", "64KB")
+	c.Set("output.http.batch.flush_interval", "200ms")
+	c.Set("output.http.batch.format", "json_array")
+	c.Set("output.http.compression", "zstd")
+	w, err = newHTTPWriter(c)
+	assert.Nil(t, err)
+	assert.Equal(t, &batchConfig{maxEvents: 100, maxBytes: 64 * 1024, flushInterval: 200 * time.Millisecond, format: batchJSONArray}, w.w.(*HTTPWriter).batch)
+	assert.Equal(t, compressionZstd, w.w.(*HTTPWriter).compression)
+	assert.Nil(t, w.w.(*HTTPWriter).backpressure)
+
+	// blocking backpressure
+	c.Set("output.http.backpressure", "block")
+	w, err = newHTTPWriter(c)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultBackpressureMaxWait, w.w.(*HTTPWriter).backpressure.maxWait)
+	c.Set("output.http.max_wait", "2s")
+	w, err = newHTTPWriter(c)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Second, w.w.(*HTTPWriter).backpressure.maxWait)
+
+	for key, tt := range map[string]struct {
+		value interface{}
+		err   string
+	}{
+		"batch.max_events":     {0, "output batch.max_events for http must be at least 1, 0 provided"},
+		"batch.max_bytes":      {"0", "output batch.max_bytes for http must be a size, 0 provided"},
+		"batch.flush_interval": {"0s", "output batch.flush_interval for http must be positive, 0s provided"},
+		"batch.format":         {"xml", "output batch.format for http must be ndjson or json_array, xml provided"},
+		"compression":          {"brotli", "output compression for http must be none, gzip or zstd, brotli provided"},
+		"max_wait":             {"-1s", "output max_wait for http can not be negative, -1s provided"},
+		"backpressure":         {"wait", "output backpressure for http must be drop or block, wait provided"},
+	} {
+		// keys set before the loop, like backpressure, are put back so every case sees them
+		previous := c.Get("output.http." + key)
+		c.Set("output.http."+key, tt.value)
+		w, err = newHTTPWriter(c)
+		assert.EqualError(t, err, tt.err, key)
+		assert.Nil(t, w)
+		c.Set("output.http."+key, previous)
+	}
 
 	// ssl no certs error
 	c = viper.New()
@@ -95,11 +169,7 @@ func TestHTTPWriter_newHttpWriter(t *testing.T) {
 func TestHTTPWriter_write(t *testing.T) {
 	msgChannel := make(chan *messageTransport, 1)
 
-	cfg := viper.New()
-	cfg.Set("metrics.enabled", false)
-	if err := metric.Configure(cfg); err != nil {
-		t.Errorf("Failed to configure metric: %v", err)
-	}
+	configureMetrics(t)
 	writer := &HTTPWriter{
 		messages: msgChannel,
 	}
@@ -109,6 +179,11 @@ func TestHTTPWriter_write(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, len(msg), result)
 
+	// a full buffer is reported, the failure policy of the output takes it from there
+	result, err = writer.Write(msg)
+	assert.ErrorIs(t, err, errBufferFull)
+	assert.Equal(t, 0, result)
+
 	resultMsg := <-msgChannel
 	assert.Equal(t, "test string", string(resultMsg.message))
 }
@@ -120,12 +195,7 @@ func TestHTTPWriter_process(t *testing.T) {
 	var traceID string
 	var mu sync.Mutex // Guard shared variables
 
-	// Configure metrics
-	cfg := viper.New()
-	cfg.Set("metrics.enabled", false)
-	if err := metric.Configure(cfg); err != nil {
-		t.Fatalf("Failed to configure metrics: %v", err)
-	}
+	configureMetrics(t)
 
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
@@ -182,6 +252,217 @@ func TestHTTPWriter_process(t *testing.T) {
 	assert.Equal(t, msg, body, "Body should match message")
 }
 
+func TestHTTPWriter_close(t *testing.T) {
+	configureMetrics(t)
+
+	var received atomic.Int32
+	release := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		<-release
+		received.Add(1)
+	}))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &HTTPWriter{
+		url:                     testServer.URL,
+		client:                  &http.Client{},
+		messages:                make(chan *messageTransport, 10),
+		ResponseBodyTransformer: TestTransformer{},
+		workerShutdownSignals:   make(chan struct{}, 1),
+		wg:                      &sync.WaitGroup{},
+		cancelFunc:              cancel,
+	}
+	writer.wg.Add(1)
+	go writer.Process(ctx)
+
+	for i := 0; i < 3; i++ {
+		_, err := writer.Write([]byte("test string"))
+		assert.Nil(t, err)
+	}
+
+	// Deadline passes while the endpoint is stuck
+	deadline, deadlineCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer deadlineCancel()
+	err := writer.Close(deadline)
+	assert.ErrorContains(t, err, "http writer did not drain before the deadline")
+	close(release)
+
+	// Closed writers refuse new messages instead of panicking
+	_, err = writer.Write([]byte("test string"))
+	assert.EqualError(t, err, "http writer is closed")
+	assert.Nil(t, writer.Close(context.Background()))
+
+	// The worker gives up on the remaining messages once the deadline cancelled it
+	writer.wg.Wait()
+}
+
+func TestHTTPWriter_closeDrains(t *testing.T) {
+	configureMetrics(t)
+
+	var received atomic.Int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		received.Add(1)
+	}))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &HTTPWriter{
+		url:                     testServer.URL,
+		client:                  &http.Client{},
+		messages:                make(chan *messageTransport, 10),
+		ResponseBodyTransformer: TestTransformer{},
+		workerShutdownSignals:   make(chan struct{}, 1),
+		wg:                      &sync.WaitGroup{},
+		cancelFunc:              cancel,
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := writer.Write([]byte("test string"))
+		assert.Nil(t, err)
+	}
+
+	// Start the worker late so everything is still buffered when Close is called
+	writer.wg.Add(1)
+	go writer.Process(ctx)
+
+	assert.Nil(t, writer.Close(context.Background()))
+	assert.Equal(t, int32(5), received.Load())
+}
+
+func TestHTTPWriter_spool(t *testing.T) {
+	configureMetrics(t)
+
+	var down atomic.Bool
+	var mu sync.Mutex
+	var bodies []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+	}))
+	defer testServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &HTTPWriter{
+		url:                     testServer.URL,
+		client:                  &http.Client{},
+		messages:                make(chan *messageTransport, 10),
+		ResponseBodyTransformer: TestTransformer{},
+		workerShutdownSignals:   make(chan struct{}, 1),
+		wg:                      &sync.WaitGroup{},
+		ctx:                     ctx,
+		cancelFunc:              cancel,
+		retry:                   retryPolicy{attempts: 1},
+	}
+	s, err := openSpool("http", testSpoolConfig(t.TempDir()), writer.writeSpooled)
+	assert.Nil(t, err)
+	defer s.close()
+	writer.setSpool(s)
+
+	writer.wg.Add(1)
+	go writer.Process(ctx)
+
+	// the endpoint is down, what the worker fails to send is spooled
+	down.Store(true)
+	for _, msg := range []string{"one", "two"} {
+		_, err := writer.Write([]byte(msg))
+		assert.Nil(t, err)
+	}
+	assert.Eventually(t, func() bool { return s.depth() == 2*recordHeaderSize+6 }, time.Second, 10*time.Millisecond)
+
+	// replaying fails while the endpoint is down, nothing is lost
+	assert.Nil(t, s.replay())
+	assert.True(t, s.pending())
+
+	// messages written while the spool is pending queue up behind it
+	_, err = writer.Write([]byte("three"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return s.depth() == 3*recordHeaderSize+11 }, time.Second, 10*time.Millisecond)
+
+	down.Store(false)
+	assert.Nil(t, s.replay())
+	assert.False(t, s.pending())
+
+	_, err = writer.Write([]byte("four"))
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close(context.Background()))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"one", "two", "three", "four"}, bodies)
+}
+
+func TestHTTPWriter_retry(t *testing.T) {
+	configureMetrics(t)
+
+	var mu sync.Mutex
+	var traceIDs []string
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	testServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		traceIDs = append(traceIDs, r.Header.Get("X-TRACE-ID"))
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == http.StatusTooManyRequests {
+			rw.Header().Set("Retry-After", "0")
+		}
+		rw.WriteHeader(status)
+	}))
+	defer testServer.Close()
+
+	writer := &HTTPWriter{
+		url:                     testServer.URL,
+		client:                  &http.Client{},
+		ResponseBodyTransformer: TestTransformer{},
+		traceHeaderName:         "X-TRACE-ID",
+		retry:                   retryPolicy{attempts: 3, initialBackoff: time.Millisecond, maxBackoff: 10 * time.Millisecond},
+	}
+
+	// server errors and rate limits are retried with the same trace id
+	assert.Nil(t, writer.send(context.Background(), [][]byte{[]byte("test string")}))
+	mu.Lock()
+	assert.Len(t, traceIDs, 3)
+	assert.NotEmpty(t, traceIDs[0])
+	assert.Equal(t, traceIDs[0], traceIDs[1])
+	assert.Equal(t, traceIDs[0], traceIDs[2])
+
+	// bad requests are never retried
+	traceIDs = nil
+	statuses = []int{http.StatusBadRequest, http.StatusOK}
+	mu.Unlock()
+	err := writer.send(context.Background(), [][]byte{[]byte("test string")})
+	assert.ErrorIs(t, err, errUnsendable)
+	assert.EqualError(t, err, "message can not be sent, service responded with 400")
+	mu.Lock()
+	assert.Len(t, traceIDs, 1)
+
+	// the last error is returned once the attempts run out
+	traceIDs = nil
+	statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}
+	mu.Unlock()
+	err = writer.send(context.Background(), [][]byte{[]byte("test string")})
+	assert.EqualError(t, err, "service responded with 502")
+	mu.Lock()
+	assert.Len(t, traceIDs, 3)
+	mu.Unlock()
+
+	// cancelling stops waiting for the next attempt
+	writer.retry = retryPolicy{attempts: 3, initialBackoff: time.Minute, maxBackoff: time.Minute}
+	mu.Lock()
+	statuses = []int{http.StatusBadGateway}
+	mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, writer.send(ctx, [][]byte{[]byte("test string")}), context.DeadlineExceeded)
+}
+
 func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
 	c := make(chan struct{})
 	go func() {
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"regexp"
 	"strings"
 
 	"github.com/pantheon-systems/pauditd/pkg/metric"
@@ -29,7 +28,11 @@ type notification struct {
 	Version    string            `json:"version"`
 }
 
-var ruleKeyRegex = regexp.MustCompile(`"rule_key":"(.*)"`)
+// ruleKeys is the subset of the message group used to route the notification to a topic
+type ruleKeys struct {
+	RuleKey  string   `json:"rule_key"`
+	RuleKeys []string `json:"rule_keys"`
+}
 
 func init() {
 	Register("notification-service", NewNotificationServiceTransformer)
@@ -50,9 +53,8 @@ func NewNotificationServiceTransformer(config *viper.Viper) ResponseBodyTransfor
 func (t NotificationServiceTransformer) Transform(traceID uuid.UUID, body []byte) ([]byte, error) {
 	var err error
 
-	matches := ruleKeyRegex.FindStringSubmatch(string(body))
-	// the "(null)" case is for some rules that are set by other systems (SECCOMP, TTY)
-	if len(matches) < 2 || matches[1] == "" || matches[1] == "(null)" || matches[1] == "rule_key" {
+	topic := findTopic(body)
+	if topic == "" {
 		// No topic specified, default to stdout or skip
 		if t.noTopicToStdOut {
 			_, err = os.Stdout.Write(body)
@@ -61,16 +63,38 @@ func (t NotificationServiceTransformer) Transform(traceID uuid.UUID, body []byte
 		return nil, err
 	}
 
-	metric.GetClient().Increment(fmt.Sprintf("notif-service-transformer.topic.%s", matches[1]))
+	return t.wrap(topic, t.attributes(traceID), body)
+}
 
-	// removing the \n char at the end of the message, this is added by the
-	// JSON marsharler for all the other outputs but that messes up
-	// the http writer for unmarshalling on the other side
-	jsonBody := body[:len(body)-1]
-	if err != nil {
-		return nil, err
+// TransformBatch wraps every body of the batch in a notification. The notifications share the
+// trace id of the batch, bodies without a topic are left out of it
+func (t NotificationServiceTransformer) TransformBatch(traceID uuid.UUID, bodies [][]byte) ([][]byte, error) {
+	attributes := t.attributes(traceID)
+	notifications := make([][]byte, 0, len(bodies))
+
+	for _, body := range bodies {
+		topic := findTopic(body)
+		if topic == "" {
+			if t.noTopicToStdOut {
+				if _, err := os.Stdout.Write(body); err != nil {
+					return nil, err
+				}
+			}
+			metric.GetClient().Increment("notif-service-transformer.topic.no-topic")
+			continue
+		}
+
+		notification, err := t.wrap(topic, attributes, body)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
 	}
 
+	return notifications, nil
+}
+
+func (t NotificationServiceTransformer) attributes(traceID uuid.UUID) map[string]string {
 	attributes := map[string]string{
 		"hostname": t.hostname,
 		"trace_id": traceID.String(),
@@ -83,22 +107,41 @@ func (t NotificationServiceTransformer) Transform(traceID uuid.UUID, body []byte
 		}
 	}
 
+	return attributes
+}
+
+func (t NotificationServiceTransformer) wrap(topic string, attributes map[string]string, body []byte) ([]byte, error) {
+	metric.GetClient().Increment(fmt.Sprintf("notif-service-transformer.topic.%s", topic))
+
 	// we remove the last char of the body, the code that creates the
 	// body is in the marsharller which adds a newline at the end of the
 	// message. This works for all the other output methods but not this one
 	notif := notification{
-		Topic:      matches[1],
-		Data:       jsonBody,
+		Topic:      topic,
+		Data:       body[:len(body)-1],
 		Attributes: attributes,
 		Version:    "1.0.0",
 	}
 
-	transformedBody, err := json.Marshal(notif)
-	if err != nil {
-		return nil, err
+	return json.Marshal(notif)
+}
+
+// findTopic returns the first usable rule key of the message group in body, the primary
+// rule key is tried first followed by any additional keys on the event
+func findTopic(body []byte) string {
+	keys := ruleKeys{}
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return ""
+	}
+
+	for _, key := range append([]string{keys.RuleKey}, keys.RuleKeys...) {
+		// the "(null)" case is for some rules that are set by other systems (SECCOMP, TTY)
+		if key != "" && key != "(null)" && key != "rule_key" {
+			return key
+		}
 	}
 
-	return transformedBody, nil
+	return ""
 }
 
 func getHostname() string {
@@ -121,3 +121,53 @@ func TestNotificationServiceTransformer_ExtraAttributes(t *testing.T) {
 	assert.Equal(t, "value1", notifResult.Attributes["key1"])
 	assert.Equal(t, "value2", notifResult.Attributes["key2"])
 }
+
+func TestNotificationServiceTransformerTransformMultipleRuleKeys(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Fatalf("Failed to configure metrics: %v", err)
+	}
+
+	transformer := NotificationServiceTransformer{
+		hostname: "test-hostname",
+	}
+
+	traceID, _ := uuid.FromString("cd4702b3-4763-11e8-917a-0242ac110002")
+	body := []byte("{\"sequence\":1,\"rule_key\":\"(null)\",\"rule_keys\":[\"\",\"binding-file-ops\"]}\n")
+	resultBody, err := transformer.Transform(traceID, body)
+	assert.Nil(t, err)
+
+	notifResult := &notification{}
+	if err := json.Unmarshal(resultBody, &notifResult); err != nil {
+		t.Errorf("Failed to unmarshal JSON: %v", err)
+	}
+	assert.Equal(t, "binding-file-ops", notifResult.Topic)
+}
+
+func TestNotificationServiceTransformerTransformBatch(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Fatalf("Failed to configure metrics: %v", err)
+	}
+
+	transformer := NotificationServiceTransformer{
+		hostname:  "test-hostname",
+		extraAttr: map[string]string{"key1": "value1"},
+	}
+
+	traceID, _ := uuid.FromString("cd4702b3-4763-11e8-917a-0242ac110002")
+	bodies, err := TransformBatch(transformer, traceID, [][]byte{
+		[]byte("{\"sequence\":1,\"rule_key\":\"binding-file-ops\"}\n"),
+		[]byte("test string"),
+		[]byte("{\"sequence\":2,\"rule_key\":\"(null)\",\"rule_keys\":[\"passwd\"]}\n"),
+	})
+	assert.Nil(t, err)
+
+	// the message without a topic is left out, the others share the trace id of the batch
+	if assert.Len(t, bodies, 2) {
+		assert.JSONEq(t, `{"topic":"binding-file-ops","attributes":{"hostname":"test-hostname","trace_id":"cd4702b3-4763-11e8-917a-0242ac110002","key1":"value1"},"data":{"sequence":1,"rule_key":"binding-file-ops"},"version":"1.0.0"}`, string(bodies[0]))
+		assert.JSONEq(t, `{"topic":"passwd","attributes":{"hostname":"test-hostname","trace_id":"cd4702b3-4763-11e8-917a-0242ac110002","key1":"value1"},"data":{"sequence":2,"rule_key":"(null)","rule_keys":["passwd"]},"version":"1.0.0"}`, string(bodies[1]))
+	}
+}
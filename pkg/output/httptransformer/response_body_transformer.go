@@ -1,6 +1,9 @@
 package httptransformer
 
 import (
+	"bytes"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
 	uuid "github.com/satori/go.uuid"
 	"github.com/spf13/viper"
 )
@@ -14,6 +17,12 @@ type ResponseBodyTransformer interface {
 	Transform(uuid.UUID, []byte) ([]byte, error)
 }
 
+// BatchTransformer is implemented by transformers that transform a batch of messages at once.
+// The bodies they return are sent in one request, the messages they leave out are not sent
+type BatchTransformer interface {
+	TransformBatch(uuid.UUID, [][]byte) ([][]byte, error)
+}
+
 type tansformerConstructor func(*viper.Viper) ResponseBodyTransformer
 
 var transformers = map[string]tansformerConstructor{}
@@ -50,3 +59,34 @@ func NewNoopTransformer(_ *viper.Viper) ResponseBodyTransformer {
 func (t NoopTransformer) Transform(_ uuid.UUID, body []byte) ([]byte, error) {
 	return body, nil
 }
+
+// TransformBatch transforms the bodies of a batch. Transformers that are not batch aware transform
+// every body on their own, bodies that fail or come back empty are left out of the batch
+func TransformBatch(t ResponseBodyTransformer, traceID uuid.UUID, bodies [][]byte) ([][]byte, error) {
+	if bt, ok := t.(BatchTransformer); ok {
+		return bt.TransformBatch(traceID, bodies)
+	}
+
+	transformed := make([][]byte, 0, len(bodies))
+	for _, body := range bodies {
+		b, err := t.Transform(traceID, body)
+		if err != nil {
+			logger.Error("Message transformation failed, leaving it out of the batch", "trace_id", traceID, "error", err)
+			continue
+		}
+		if b != nil {
+			transformed = append(transformed, b)
+		}
+	}
+
+	return transformed, nil
+}
+
+// TransformBatch returns the bodies without the newline the marshaller ends them with
+func (t NoopTransformer) TransformBatch(_ uuid.UUID, bodies [][]byte) ([][]byte, error) {
+	transformed := make([][]byte, len(bodies))
+	for i, body := range bodies {
+		transformed[i] = bytes.TrimSuffix(body, []byte("\n"))
+	}
+	return transformed, nil
+}
@@ -1,6 +1,7 @@
 package httptransformer
 
 import (
+	"errors"
 	"testing"
 
 	uuid "github.com/satori/go.uuid"
@@ -49,3 +50,29 @@ func TestNoopTransformerTransform(t *testing.T) {
 
 	assert.Equal(t, body, resultBody)
 }
+
+// skippingTransformer leaves out empty bodies and fails on "bad"
+type skippingTransformer struct{}
+
+func (t skippingTransformer) Transform(_ uuid.UUID, body []byte) ([]byte, error) {
+	switch string(body) {
+	case "":
+		return nil, nil
+	case "bad":
+		return nil, errors.New("bad body")
+	}
+	return append([]byte("t:"), body...), nil
+}
+
+func TestTransformBatch(t *testing.T) {
+	traceID, _ := uuid.FromString("cd4702b3-4763-11e8-917a-0242ac110002")
+
+	// transformers that are not batch aware transform every body on their own
+	bodies, err := TransformBatch(skippingTransformer{}, traceID, [][]byte{[]byte("a"), nil, []byte("bad"), []byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("t:a"), []byte("t:b")}, bodies)
+
+	bodies, err = TransformBatch(&NoopTransformer{}, traceID, [][]byte{[]byte("a\n"), []byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, bodies)
+}
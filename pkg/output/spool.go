@@ -0,0 +1,531 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+)
+
+const (
+	// spoolReplayInterval is how often a spool tries to write what it holds
+	spoolReplayInterval = time.Second
+	// spoolCursorInterval is how often the cursor is saved while a spool is replayed, so a crash
+	// only writes what was replayed since then again
+	spoolCursorInterval = time.Second
+	// defaultSpoolReplayBatch is the number of groups replayed in one write to outputs that do not
+	// batch on their own
+	defaultSpoolReplayBatch = 100
+	// recordHeaderSize is the length and CRC-32C checksum in front of every spooled group
+	recordHeaderSize = 8
+	segmentSuffix    = ".seg"
+	// cursorFile remembers how far the oldest segment was replayed across restarts
+	cursorFile = "cursor"
+)
+
+var (
+	errSpoolFull    = errors.New("spool is full")
+	errSpoolCorrupt = errors.New("spool record is corrupt")
+	spoolCRCTable   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// spoolConfig holds the limits of a spool
+type spoolConfig struct {
+	dir         string        // the segments of an output are kept in <dir>/<output name>
+	maxSize     int64         // bytes the segments may take on disk, groups are dropped beyond it
+	segmentSize int64         // bytes written to a segment before the next one is started
+	maxAge      time.Duration // segments last written to before are dropped, 0 keeps them
+	batchEvents int           // groups replayed in one write, 0 replays them one by one
+	batchBytes  int           // bytes of groups replayed in one write, 0 does not limit them
+}
+
+// spoolWrite writes replayed groups to the output, oldest first. It returns how many of them were
+// written before it failed
+type spoolWrite func(messages [][]byte) (int, error)
+
+// spoolingWriter is implemented by outputs that only buffer what they are given in Write. The spool
+// replays through writeSpooled to learn whether the output really took the groups, and the output
+// spools what it fails to send later on
+type spoolingWriter interface {
+	writeSpooled(messages [][]byte) (int, error)
+	// spoolBatch returns the groups and bytes the output sends in one request
+	spoolBatch() (events int, bytes int)
+	setSpool(s *spool)
+}
+
+// spool keeps the groups an output could not write on disk and writes them to the output again
+// once it recovers, oldest first. Groups are appended to segment files with the length and
+// checksum of every record, a segment is removed once it is replayed or older than the max age.
+// What is left when pauditd stops is written after the next start
+type spool struct {
+	lock      sync.Mutex
+	dir       string
+	name      string // the output, for logs and metrics
+	config    spoolConfig
+	segments  []*segment // oldest first
+	size      int64      // bytes of all segments
+	file      *os.File   // the newest segment opened for appending, nil until the next append starts one
+	write     spoolWrite
+	replaying sync.Mutex // serializes replays, appending only waits for lock
+	saved     time.Time  // when the cursor was saved, guarded by replaying
+	refs      int        // guarded by spoolsLock
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// segment is a spool file, the records before read were written to the output
+type segment struct {
+	id      uint64
+	size    int64
+	read    int64
+	modTime time.Time
+}
+
+var (
+	spoolsLock sync.Mutex
+	// spools are the open spools by directory. A reload creates the new writer of an output before
+	// the old one is closed, both share the spool and the new writer takes over replaying it
+	spools = make(map[string]*spool)
+)
+
+func openSpool(name string, config spoolConfig, write spoolWrite) (*spool, error) {
+	dir := filepath.Join(config.dir, name)
+
+	spoolsLock.Lock()
+	defer spoolsLock.Unlock()
+
+	if s, ok := spools[dir]; ok {
+		s.lock.Lock()
+		s.write = write
+		s.config = config
+		s.lock.Unlock()
+		s.refs++
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the spool directory for %s. Error: %s", name, err)
+	}
+
+	s := &spool{
+		dir:    dir,
+		name:   name,
+		config: config,
+		write:  write,
+		refs:   1,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("failed to open the spool of %s. Error: %s", name, err)
+	}
+
+	if depth := s.depth(); depth > 0 {
+		logger.Info("Spool holds messages from a previous run", "output", name, "path", dir, "bytes", depth)
+	}
+	s.gauge()
+
+	spools[dir] = s
+	go s.run()
+	return s, nil
+}
+
+// load picks up the segments and the cursor left by a previous run
+func (s *spool) load() error {
+	// entries are sorted by name, the zero padded ids sort the segments oldest first
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentSuffix), 10, 64)
+		if !strings.HasSuffix(e.Name(), segmentSuffix) || err != nil {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, &segment{id: id, size: info.Size(), modTime: info.ModTime()})
+		s.size += info.Size()
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, cursorFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var id uint64
+	var read int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &id, &read); err != nil {
+		logger.Error("Ignoring the unreadable spool cursor", "output", s.name, "error", err)
+		return nil
+	}
+	for _, seg := range s.segments {
+		if seg.id == id {
+			seg.read = min(read, seg.size)
+		}
+	}
+
+	return nil
+}
+
+func (s *spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// pending reports whether the spool holds groups
+func (s *spool) pending() bool {
+	return s.depth() > 0
+}
+
+// depth returns the bytes that were not replayed yet
+func (s *spool) depth() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var depth int64
+	for _, seg := range s.segments {
+		depth += seg.size - seg.read
+	}
+	return depth
+}
+
+// gauge reports the depth of the spool
+func (s *spool) gauge() {
+	depth := s.depth()
+	s.lock.Lock()
+	segments := len(s.segments)
+	s.lock.Unlock()
+
+	metric.GetClient().Gauge("output."+s.name+".spool.depth", depth)
+	metric.GetClient().Gauge("output."+s.name+".spool.segments", segments)
+}
+
+// append adds a serialized group to the end of the spool
+func (s *spool) append(jsonBytes []byte) error {
+	if err := s.appendRecord(jsonBytes); err != nil {
+		return err
+	}
+
+	metric.GetClient().Increment("output." + s.name + ".spooled")
+	s.gauge()
+	return nil
+}
+
+func (s *spool) appendRecord(jsonBytes []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	size := int64(recordHeaderSize + len(jsonBytes))
+	if s.size+size > s.config.maxSize {
+		metric.GetClient().Increment("output." + s.name + ".spool.full")
+		return errSpoolFull
+	}
+
+	if s.file == nil || s.segments[len(s.segments)-1].size >= s.config.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, recordHeaderSize, size)
+	binary.BigEndian.PutUint32(record, uint32(len(jsonBytes)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(jsonBytes, spoolCRCTable))
+	record = append(record, jsonBytes...)
+
+	n, err := s.file.Write(record)
+	seg := s.segments[len(s.segments)-1]
+	seg.size += int64(n)
+	seg.modTime = time.Now()
+	s.size += int64(n)
+	if err != nil {
+		// a partial record ends the segment, replaying skips it as corrupt
+		s.file.Close()
+		s.file = nil
+		return err
+	}
+
+	return nil
+}
+
+// rotate seals the segment being appended to and starts a new one. Must be called with the lock
+// held
+func (s *spool) rotate() error {
+	if err := s.seal(); err != nil {
+		return err
+	}
+
+	id := uint64(1)
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1].id + 1
+	}
+
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	s.file = f
+	s.segments = append(s.segments, &segment{id: id, modTime: time.Now()})
+	return nil
+}
+
+// seal syncs the segment being appended to and closes it, the groups in it survive a crash from
+// then on. Must be called with the lock held
+func (s *spool) seal() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Sync()
+	err = errors.Join(err, s.file.Close())
+	s.file = nil
+	return err
+}
+
+func (s *spool) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.replay(); err != nil {
+				logger.Error("Failed to replay the spool", "output", s.name, "error", err)
+			}
+		}
+	}
+}
+
+// replay writes the spooled groups to the output, oldest first, until it fails again
+func (s *spool) replay() error {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+	defer s.gauge()
+
+	s.expire()
+
+	for {
+		seg, ok := s.head()
+		if !ok {
+			return nil
+		}
+
+		stopped, err := s.replaySegment(seg)
+		if err != nil || stopped {
+			return err
+		}
+	}
+}
+
+// head returns the oldest segment that was not replayed yet, removing the ones that were
+func (s *spool) head() (*segment, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if seg.read < seg.size {
+			return seg, true
+		}
+		if err := s.removeHead(); err != nil {
+			logger.Error("Failed to remove a replayed spool segment", "output", s.name, "segment", seg.id, "error", err)
+			return nil, false
+		}
+		if len(s.segments) == 0 {
+			logger.Info("Spool replayed", "output", s.name)
+		}
+	}
+
+	return nil, false
+}
+
+// replaySegment writes the records of the segment to the output, as many at a time as the output
+// takes in one write. It reports whether the output failed, the rest of the segment is replayed
+// on the next attempt
+func (s *spool) replaySegment(seg *segment) (bool, error) {
+	s.lock.Lock()
+	from, to, write, config := seg.read, seg.size, s.write, s.config
+	s.lock.Unlock()
+
+	f, err := os.Open(s.segmentPath(seg.id))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.NewSectionReader(f, from, to-from))
+	// offset is where the records that were written end, next where the ones that were read end
+	offset, next := from, from
+	for offset < to {
+		var messages [][]byte
+		var size int
+		var corrupt error
+		for next < to && (len(messages) == 0 || (len(messages) < config.batchEvents && (config.batchBytes == 0 || size < config.batchBytes))) {
+			jsonBytes, n, err := readRecord(r, to-next)
+			if err != nil {
+				corrupt = err
+				break
+			}
+			messages = append(messages, jsonBytes)
+			size += len(jsonBytes)
+			next += n
+		}
+
+		if len(messages) > 0 {
+			written, err := write(messages)
+			for _, jsonBytes := range messages[:written] {
+				offset += recordHeaderSize + int64(len(jsonBytes))
+			}
+			s.advance(seg, offset)
+			metric.GetClient().Count("output."+s.name+".spool.replayed", written)
+
+			if err != nil {
+				return true, s.saveCursor(seg.id, offset)
+			}
+		}
+
+		if corrupt != nil {
+			logger.Error("Skipping the corrupt rest of a spool segment", "output", s.name, "segment", seg.id, "bytes", to-offset, "error", corrupt)
+			metric.GetClient().Increment("output." + s.name + ".spool.corrupt")
+			s.advance(seg, to)
+			return false, nil
+		}
+
+		if offset < to && time.Since(s.saved) >= spoolCursorInterval {
+			if err := s.saveCursor(seg.id, offset); err != nil {
+				logger.Error("Failed to save the spool cursor", "output", s.name, "error", err)
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// readRecord reads the next group from a segment that has remaining bytes left to read
+func readRecord(r io.Reader, remaining int64) ([]byte, int64, error) {
+	if remaining < recordHeaderSize {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if length > remaining-recordHeaderSize {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	jsonBytes := make([]byte, length)
+	if _, err := io.ReadFull(r, jsonBytes); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(jsonBytes, spoolCRCTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	return jsonBytes, recordHeaderSize + length, nil
+}
+
+func (s *spool) advance(seg *segment, read int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seg.read = read
+}
+
+// expire drops the oldest segments while they are older than the max age
+func (s *spool) expire() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.config.maxAge <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-s.config.maxAge)
+	for len(s.segments) > 0 && s.segments[0].modTime.Before(cutoff) {
+		seg := s.segments[0]
+		logger.Error("Spool segment expired, messages dropped", "output", s.name, "segment", seg.id, "bytes", seg.size-seg.read)
+		metric.GetClient().Increment("output." + s.name + ".spool.expired")
+		if err := s.removeHead(); err != nil {
+			logger.Error("Failed to remove an expired spool segment", "output", s.name, "segment", seg.id, "error", err)
+			return
+		}
+	}
+}
+
+// removeHead removes the oldest segment. Must be called with the lock held
+func (s *spool) removeHead() error {
+	seg := s.segments[0]
+	if len(s.segments) == 1 && s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	if err := os.Remove(s.segmentPath(seg.id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.size -= seg.size
+	s.segments = s.segments[1:]
+	return nil
+}
+
+// saveCursor remembers how far the segment was replayed, so it is not written twice after a
+// restart. Must be called with replaying held
+func (s *spool) saveCursor(id uint64, read int64) error {
+	s.saved = time.Now()
+	path := filepath.Join(s.dir, cursorFile)
+	if err := os.WriteFile(path+".tmp", []byte(fmt.Sprintf("%d %d\n", id, read)), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// close stops replaying once the last writer sharing the spool closes it, whatever is left stays
+// in the segments
+func (s *spool) close() error {
+	spoolsLock.Lock()
+	if s.refs--; s.refs > 0 {
+		spoolsLock.Unlock()
+		return nil
+	}
+	delete(spools, s.dir)
+	spoolsLock.Unlock()
+
+	close(s.stop)
+	<-s.done
+
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	if len(s.segments) > 0 {
+		err = s.saveCursor(s.segments[0].id, s.segments[0].read)
+	}
+	return errors.Join(err, s.seal())
+}
@@ -0,0 +1,293 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder takes groups until fail is set
+type recorder struct {
+	lock    sync.Mutex
+	lines   []string
+	batches []int
+	fail    int // the number of groups to take before failing, -1 never fails
+}
+
+func (r *recorder) write(messages [][]byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.batches = append(r.batches, len(messages))
+	for i, b := range messages {
+		if r.fail == 0 {
+			return i, errors.New("broken")
+		}
+		if r.fail > 0 {
+			r.fail--
+		}
+		r.lines = append(r.lines, string(b))
+	}
+	return len(messages), nil
+}
+
+func (r *recorder) failAfter(n int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.fail = n
+}
+
+func (r *recorder) written() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+func testSpoolConfig(dir string) spoolConfig {
+	return spoolConfig{dir: dir, maxSize: 1024, segmentSize: 1024}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "http", "*"+segmentSuffix))
+	assert.Nil(t, err)
+	return files
+}
+
+func TestSpool_replay(t *testing.T) {
+	configureMetrics(t)
+
+	dir := t.TempDir()
+	out := &recorder{fail: 0}
+	s, err := openSpool("http", testSpoolConfig(dir), out.write)
+	assert.Nil(t, err)
+	defer s.close()
+
+	assert.False(t, s.pending())
+	assert.Nil(t, s.replay())
+
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		assert.Nil(t, s.append([]byte(line)))
+	}
+	assert.True(t, s.pending())
+	assert.Equal(t, int64(3*recordHeaderSize+14), s.depth())
+
+	// the output still fails, nothing is lost
+	assert.Nil(t, s.replay())
+	assert.Empty(t, out.written())
+
+	// the output fails again after the first group, the rest stays spooled
+	out.failAfter(1)
+	assert.Nil(t, s.replay())
+	assert.Equal(t, []string{"one\n"}, out.written())
+	assert.Equal(t, int64(2*recordHeaderSize+10), s.depth())
+
+	// appending after a partial replay keeps the order
+	assert.Nil(t, s.append([]byte("four\n")))
+	out.failAfter(-1)
+	assert.Nil(t, s.replay())
+	assert.Equal(t, []string{"one\n", "two\n", "three\n", "four\n"}, out.written())
+	assert.False(t, s.pending())
+	assert.Empty(t, segmentFiles(t, dir))
+}
+
+func TestSpool_replayBatches(t *testing.T) {
+	configureMetrics(t)
+
+	dir := t.TempDir()
+	out := &recorder{fail: 3}
+	config := testSpoolConfig(dir)
+	config.batchEvents = 2
+	var cursors []string
+	s, err := openSpool("http", config, func(messages [][]byte) (int, error) {
+		cursor, _ := os.ReadFile(filepath.Join(dir, "http", cursorFile))
+		cursors = append(cursors, string(cursor))
+		return out.write(messages)
+	})
+	assert.Nil(t, err)
+	defer s.close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		assert.Nil(t, s.append([]byte(line)))
+	}
+
+	// the output fails in the middle of the second batch, the groups before it are done
+	assert.Nil(t, s.replay())
+	assert.Equal(t, []string{"one\n", "two\n", "three\n"}, out.written())
+	assert.Equal(t, int64(2*recordHeaderSize+10), s.depth())
+	// the cursor is saved while replaying, not only when the output fails
+	assert.Equal(t, []string{"", fmt.Sprintf("1 %d\n", 2*recordHeaderSize+8)}, cursors)
+
+	out.failAfter(-1)
+	assert.Nil(t, s.replay())
+	assert.Equal(t, []string{"one\n", "two\n", "three\n", "four\n", "five\n"}, out.written())
+	assert.Equal(t, []int{2, 2, 2}, out.batches)
+}
+
+func TestSpool_segments(t *testing.T) {
+	configureMetrics(t)
+
+	dir := t.TempDir()
+	out := &recorder{fail: 0}
+	s, err := openSpool("http", spoolConfig{dir: dir, maxSize: 1024, segmentSize: 20}, out.write)
+	assert.Nil(t, err)
+	defer s.close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		assert.Nil(t, s.append([]byte(line)))
+	}
+	assert.Len(t, segmentFiles(t, dir), 2)
+
+	// replayed segments are removed as soon as they are done
+	out.failAfter(3)
+	assert.Nil(t, s.replay())
+	assert.Len(t, segmentFiles(t, dir), 1)
+
+	out.failAfter(-1)
+	assert.Nil(t, s.replay())
+	assert.Equal(t, []string{"one\n", "two\n", "three\n", "four\n"}, out.written())
+	assert.Empty(t, segmentFiles(t, dir))
+}
+
+func TestSpool_full(t *testing.T) {
+	configureMetrics(t)
+
+	s, err := openSpool("http", spoolConfig{dir: t.TempDir(), maxSize: 24, segmentSize: 1024}, (&recorder{}).write)
+	assert.Nil(t, err)
+	defer s.close()
+
+	assert.Nil(t, s.append([]byte("one\n")))
+	assert.Nil(t, s.append([]byte("two\n")))
+	assert.ErrorIs(t, s.append([]byte("three\n")), errSpoolFull)
+}
+
+func TestSpool_previousRun(t *testing.T) {
+	configureMetrics(t)
+
+	dir := t.TempDir()
+	out := &recorder{fail: 0}
+	s, err := openSpool("http", testSpoolConfig(dir), out.write)
+	assert.Nil(t, err)
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		assert.Nil(t, s.append([]byte(line)))
+	}
+	out.failAfter(1)
+	assert.Nil(t, s.replay())
+	assert.Nil(t, s.close())
+
+	// the next run carries on where the replay stopped and appends to a new segment
+	out.failAfter(-1)
+	s, err = openSpool("http", testSpoolConfig(dir), out.write)
+	assert.Nil(t, err)
+	defer s.close()
+
+	assert.True(t, s.pending())
+	assert.Nil(t, s.append([]byte("four\n")))
+	assert.Len(t, segmentFiles(t, dir), 2)
+	assert.Nil(t, s.replay())
+	assert.Equal(t, []string{"one\n", "two\n", "three\n", "four\n"}, out.written())
+	assert.False(t, s.pending())
+}
+
+func TestSpool_corrupt(t *testing.T) {
+	configureMetrics(t)
+
+	dir := t.TempDir()
+	out := &recorder{fail: 0}
+	s, err := openSpool("http", spoolConfig{dir: dir, maxSize: 1024, segmentSize: 20}, out.write)
+	assert.Nil(t, err)
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		assert.Nil(t, s.append([]byte(line)))
+	}
+	assert.Nil(t, s.close())
+
+	// flip a byte of the second group, the rest of its segment can not be trusted
+	files := segmentFiles(t, dir)
+	assert.Len(t, files, 2)
+	data, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	data[len(data)-2] ^= 0xff
+	assert.Nil(t, os.WriteFile(files[0], data, 0o600))
+
+	// a crash while appending leaves a partial record behind
+	f, err := os.OpenFile(files[1], os.O_WRONLY|os.O_APPEND, 0o600)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	out.failAfter(-1)
+	s, err = openSpool("http", spoolConfig{dir: dir, maxSize: 1024, segmentSize: 20}, out.write)
+	assert.Nil(t, err)
+	defer s.close()
+
+	assert.Nil(t, s.replay())
+	assert.Equal(t, []string{"one\n", "three\n"}, out.written())
+	assert.False(t, s.pending())
+}
+
+func TestSpool_expire(t *testing.T) {
+	configureMetrics(t)
+
+	dir := t.TempDir()
+	config := spoolConfig{dir: dir, maxSize: 1024, segmentSize: 10, maxAge: time.Hour}
+	out := &recorder{fail: 0}
+	s, err := openSpool("http", config, out.write)
+	assert.Nil(t, err)
+	assert.Nil(t, s.append([]byte("old\n")))
+	assert.Nil(t, s.append([]byte("new\n")))
+	assert.Nil(t, s.close())
+
+	files := segmentFiles(t, dir)
+	assert.Len(t, files, 2)
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(files[0], old, old))
+
+	out.failAfter(-1)
+	s, err = openSpool("http", config, out.write)
+	assert.Nil(t, err)
+	defer s.close()
+
+	assert.Nil(t, s.replay())
+	assert.Equal(t, []string{"new\n"}, out.written())
+}
+
+func TestSpool_shared(t *testing.T) {
+	configureMetrics(t)
+
+	dir := t.TempDir()
+	old := &recorder{fail: 0}
+	s, err := openSpool("http", testSpoolConfig(dir), old.write)
+	assert.Nil(t, err)
+	assert.Nil(t, s.append([]byte("one\n")))
+
+	// the writer created by a reload shares the spool and replays it
+	next := &recorder{fail: -1}
+	shared, err := openSpool("http", spoolConfig{dir: dir, maxSize: 2048, segmentSize: 1024}, next.write)
+	assert.Nil(t, err)
+	assert.Same(t, s, shared)
+	assert.Equal(t, int64(2048), shared.config.maxSize)
+
+	assert.Nil(t, s.close())
+	assert.Nil(t, shared.replay())
+	assert.Empty(t, old.written())
+	assert.Equal(t, []string{"one\n"}, next.written())
+
+	assert.Nil(t, shared.close())
+	reopened, err := openSpool("http", testSpoolConfig(dir), next.write)
+	assert.Nil(t, err)
+	assert.NotSame(t, s, reopened)
+	assert.Nil(t, reopened.close())
+}
+
+func TestSpool_openError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(dir, nil, 0o600))
+
+	_, err := openSpool("http", testSpoolConfig(dir), (&recorder{}).write)
+	assert.ErrorContains(t, err, "failed to create the spool directory for http")
+}
@@ -1,43 +1,122 @@
 package output
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
 	"github.com/pantheon-systems/pauditd/pkg/parser"
 )
 
+// ErrWriterClosed is returned by Write once the writer is closed. A group a replaced writer gives
+// back this way can be written to the writer that replaced it
+var ErrWriterClosed = errors.New("audit writer is closed")
+
 // AuditWriter is the class that encapsulates the io.Writer for output
 type AuditWriter struct {
-	w        io.Writer
-	attempts int
+	w         io.Writer
+	attempts  int
+	name      string  // the output the writer was created for
+	queueSize int     // groups queued for the output when it is one of several
+	fan       *fanOut // set instead of w when writing to several outputs
+	matcher   Matcher // when set only the groups it matches are written
+	onFailure FailurePolicy
+	spool     *spool        // holds the groups the output failed to write when onFailure is FailSpool
+	closing   chan struct{} // closed by Close, ends blocking
+	closeOnce sync.Once
+	spoolOnce sync.Once
+	closeLock sync.RWMutex // held for reading while a group is written, so Close waits for it
+	closed    bool
+	replaced  atomic.Bool // set once another writer took over, groups given back go there
+}
+
+// Matcher decides whether a group is written to an output
+type Matcher interface {
+	Match(msg *parser.AuditMessageGroup) bool
 }
 
 // NewAuditWriter creates a generic auditwriter which encapsulates a io.Writer
 func NewAuditWriter(w io.Writer, attempts int) *AuditWriter {
 	return &AuditWriter{
-		w:        w,
-		attempts: attempts,
+		w:         w,
+		attempts:  attempts,
+		onFailure: FailDefault,
+		closing:   make(chan struct{}),
 	}
 }
 
+// Name returns the name of the output the writer was created for, empty when it was not
+// created through CreateAuditWriter. A writer for several outputs returns all of their names
+func (a *AuditWriter) Name() string {
+	if a.fan != nil {
+		return a.fan.names()
+	}
+
+	return a.name
+}
+
+// SetMatcher limits the groups written to the output to the ones m matches, nil writes all of them
+func (a *AuditWriter) SetMatcher(m Matcher) {
+	a.matcher = m
+}
+
+// accepts reports whether the group was routed to the output and its matcher matches it
+func (a *AuditWriter) accepts(msg *parser.AuditMessageGroup) bool {
+	return msg.RoutedTo(a.name) && (a.matcher == nil || a.matcher.Match(msg))
+}
+
+// Write writes the group to the output unless it was routed to other outputs or the output does
+// not match it. Failing to write the group is handled by the failure policy of the output
 func (a *AuditWriter) Write(msg *parser.AuditMessageGroup) (err error) {
+	if a.fan != nil {
+		return a.fan.write(msg)
+	}
+
+	if !a.accepts(msg) {
+		metric.GetClient().Increment("messages.routed_away")
+		return nil
+	}
+
+	jsonBytes, err := marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	a.closeLock.RLock()
+	defer a.closeLock.RUnlock()
+
+	if a.closed {
+		return ErrWriterClosed
+	}
+
+	return a.deliver(jsonBytes)
+}
+
+func marshal(msg *parser.AuditMessageGroup) ([]byte, error) {
 	jsonBytes, err := json.Marshal(msg)
 	if err != nil {
-		return errors.New("unable to marshal JSON: " + err.Error())
+		return nil, errors.New("unable to marshal JSON: " + err.Error())
 	}
-	jsonBytes = append(jsonBytes, '\n') // Backwards compat with `(json.Encoder).Encode()`
+	return append(jsonBytes, '\n'), nil // Backwards compat with `(json.Encoder).Encode()`
+}
 
+// write hands the serialized group to the wrapped writer, retrying up to attempts times
+func (a *AuditWriter) write(jsonBytes []byte) (err error) {
 	for i := 0; i < a.attempts; i++ {
 		_, err = a.w.Write(jsonBytes)
-		if err == nil {
+		// a full buffer is left to the failure policy, retrying it would hold up the marshaller
+		if err == nil || errors.Is(err, errBufferFull) || errors.Is(err, errWriterClosed) {
 			break
 		}
 
-		if i != a.attempts {
+		if i < a.attempts-1 {
 			logger.Error("Failed to write message, retrying in 1 second. Error:", err)
 			time.Sleep(time.Second * 1)
 		}
@@ -45,3 +124,72 @@ func (a *AuditWriter) Write(msg *parser.AuditMessageGroup) (err error) {
 
 	return err
 }
+
+// drainCloser is implemented by writers that buffer messages and need time to send them
+type drainCloser interface {
+	Close(ctx context.Context) error
+}
+
+// releaser is implemented by writers whose writes can wait, release ends the waiting
+type releaser interface {
+	release()
+}
+
+// release ends blocking and waiting for the output, the groups it could not write are handled
+// by the failure policy from then on
+func (a *AuditWriter) release() {
+	a.closeOnce.Do(func() { close(a.closing) })
+
+	if r, ok := a.w.(releaser); ok {
+		r.release()
+	}
+}
+
+// Close flushes and closes the wrapped writer. Writers that buffer messages are given until
+// ctx is done to drain, stdout and stderr are left open. Writes that wait for the output are
+// ended first, Close then waits for the writes in progress
+func (a *AuditWriter) Close(ctx context.Context) error {
+	if a.fan != nil {
+		return a.fan.close(ctx)
+	}
+
+	a.release()
+
+	a.closeLock.Lock()
+	if a.closed {
+		a.closeLock.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.closeLock.Unlock()
+
+	err := a.closeOutput(ctx)
+
+	// draining may spool what the output could not send, so the spool is closed last
+	a.spoolOnce.Do(func() {
+		if a.spool != nil {
+			err = errors.Join(err, a.spool.close())
+		}
+	})
+
+	return err
+}
+
+func (a *AuditWriter) closeOutput(ctx context.Context) error {
+	switch w := a.w.(type) {
+	case drainCloser:
+		return w.Close(ctx)
+	case *os.File:
+		if w == os.Stdout || w == os.Stderr {
+			return nil
+		}
+		if err := w.Sync(); err != nil {
+			return err
+		}
+		return w.Close()
+	case io.Closer:
+		return w.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// matchFunc turns a function into a Matcher
+type matchFunc func(msg *parser.AuditMessageGroup) bool
+
+func (f matchFunc) Match(msg *parser.AuditMessageGroup) bool {
+	return f(msg)
+}
+
+func TestAuditWriter_SetMatcher(t *testing.T) {
+	configureMetrics(t)
+
+	buf := &bytes.Buffer{}
+	w := NewAuditWriter(buf, 1)
+	w.name = "file"
+	w.SetMatcher(matchFunc(func(msg *parser.AuditMessageGroup) bool {
+		return msg.RuleKey == "passwd-write-log"
+	}))
+
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 1, RuleKey: "execve"}))
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 2, RuleKey: "passwd-write-log"}))
+	// routing by filters still applies on top of the match
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 3, RuleKey: "passwd-write-log", Outputs: []string{"http"}}))
+
+	assert.NotContains(t, buf.String(), `"sequence":1,`)
+	assert.Contains(t, buf.String(), `"sequence":2,`)
+	assert.NotContains(t, buf.String(), `"sequence":3,`)
+
+	w.SetMatcher(nil)
+	assert.Nil(t, w.Write(&parser.AuditMessageGroup{Seq: 4, RuleKey: "execve"}))
+	assert.Contains(t, buf.String(), `"sequence":4,`)
+}
+
+func TestAuditWriter_Close(t *testing.T) {
+	// Plain writers have nothing to close
+	assert.Nil(t, NewAuditWriter(&bytes.Buffer{}, 1).Close(context.Background()))
+
+	// stdout stays open
+	assert.Nil(t, NewAuditWriter(os.Stdout, 1).Close(context.Background()))
+	_, err := os.Stdout.Stat()
+	assert.Nil(t, err)
+
+	f, err := os.Create(path.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, NewAuditWriter(f, 1).Close(context.Background()))
+	_, err = f.Write([]byte("test"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
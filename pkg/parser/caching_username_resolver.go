@@ -3,73 +3,210 @@
 package parser
 
 import (
-	"os"
-	"os/user"
+	"container/list"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+)
+
+const (
+	defaultCacheMaxSize     = 10000
+	defaultCacheTTL         = 10 * time.Minute
+	defaultCacheNegativeTTL = time.Minute
 )
 
-// CachingUsernameResolver is the caching based resolver
+// CachingUsernameResolverConfig holds the settings for the caching username resolver
+type CachingUsernameResolverConfig struct {
+	PasswdPath  string
+	GroupPath   string
+	MaxSize     int           // maximum number of uids held in the cache, least recently used are evicted first
+	TTL         time.Duration // how long a resolved username is cached
+	NegativeTTL time.Duration // how long an UNKNOWN_USER result is cached
+}
+
+// CachingUsernameResolver is the caching based resolver. The cache is bounded in size,
+// entries expire after a TTL and the whole cache is flushed when the passwd or group
+// files change on disk
 type CachingUsernameResolver struct {
-	cacheLock  *sync.Mutex
-	cache      map[string]string
-	lastFlush  time.Time
-	passwdPath string
+	cacheLock   *sync.Mutex
+	cache       map[string]*list.Element // { uid: *cacheEntry in lru }
+	lru         *list.List               // most recently used at the front
+	maxSize     int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	resolver    UsernameResolver
+	watcher     *fsnotify.Watcher
+}
+
+type cacheEntry struct {
+	uid     string
+	uname   string
+	expires time.Time
 }
 
 // NewCachingUsernameResolver constructs a new username resolver with caching
-func NewCachingUsernameResolver(passwdPath string) UsernameResolver {
+func NewCachingUsernameResolver(config CachingUsernameResolverConfig) UsernameResolver {
+	r := newCachingUsernameResolver(config)
+	r.watch(config.PasswdPath, config.GroupPath)
+	return r
+}
+
+func newCachingUsernameResolver(config CachingUsernameResolverConfig) *CachingUsernameResolver {
+	if config.MaxSize < 1 {
+		config.MaxSize = defaultCacheMaxSize
+	}
+
+	if config.TTL <= 0 {
+		config.TTL = defaultCacheTTL
+	}
+
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = defaultCacheNegativeTTL
+	}
+
 	return &CachingUsernameResolver{
-		cacheLock:  &sync.Mutex{},
-		cache:      make(map[string]string),
-		lastFlush:  time.Now(),
-		passwdPath: passwdPath,
+		cacheLock:   &sync.Mutex{},
+		cache:       make(map[string]*list.Element),
+		lru:         list.New(),
+		maxSize:     config.MaxSize,
+		ttl:         config.TTL,
+		negativeTTL: config.NegativeTTL,
+		resolver:    NewDefaultUsernameResolver(),
 	}
 }
 
 // Resolve takes a UID and resolves it to a username
 func (r *CachingUsernameResolver) Resolve(uid string) string {
-	uname := "UNKNOWN_USER"
-
-	if cacheValue, ok := r.cache[uid]; ok && r.checkCache() {
-		return cacheValue
-	}
-
-	luser, err := user.LookupId(uid)
-	if err == nil {
-		uname = luser.Username
+	if uname, ok := r.get(uid); ok {
+		metric.GetClient().Increment("parser.uid_cache.hit")
+		return uname
 	}
 
+	metric.GetClient().Increment("parser.uid_cache.miss")
+	uname := r.resolver.Resolve(uid)
 	r.save(uid, uname)
 
 	return uname
 }
 
-func (r *CachingUsernameResolver) checkCache() bool {
-	filestat, err := os.Stat(r.passwdPath)
-	if err == nil {
-		lastMod := filestat.ModTime()
-		if lastMod.After(r.lastFlush) {
-			// if the passwd file was modified after the last flush of the cache
-			// then flush the cache
-			r.flush()
-			return false
-		}
+// Close stops watching the passwd and group files for changes
+func (r *CachingUsernameResolver) Close() error {
+	if r.watcher == nil {
+		return nil
 	}
 
-	return true
+	return r.watcher.Close()
 }
 
-func (r *CachingUsernameResolver) flush() {
+func (r *CachingUsernameResolver) get(uid string) (string, bool) {
 	r.cacheLock.Lock()
 	defer r.cacheLock.Unlock()
 
-	r.cache = make(map[string]string)
-	r.lastFlush = time.Now()
+	elem, ok := r.cache[uid]
+	if !ok {
+		return "", false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		r.lru.Remove(elem)
+		delete(r.cache, uid)
+		return "", false
+	}
+
+	r.lru.MoveToFront(elem)
+	return entry.uname, true
 }
 
 func (r *CachingUsernameResolver) save(uid string, uname string) {
+	ttl := r.ttl
+	if uname == UnknownUsername {
+		// negative results are cached for a shorter time so new users show up quickly
+		ttl = r.negativeTTL
+	}
+
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	// uid may point into a pooled message buffer, take a copy before holding on to it
+	entry := &cacheEntry{uid: strings.Clone(uid), uname: uname, expires: time.Now().Add(ttl)}
+	if elem, ok := r.cache[uid]; ok {
+		elem.Value = entry
+		r.lru.MoveToFront(elem)
+		return
+	}
+
+	r.cache[entry.uid] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.maxSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*cacheEntry).uid)
+		metric.GetClient().Increment("parser.uid_cache.eviction")
+	}
+	metric.GetClient().Gauge("parser.uid_cache.size", r.lru.Len())
+}
+
+func (r *CachingUsernameResolver) flush() {
 	r.cacheLock.Lock()
 	defer r.cacheLock.Unlock()
-	r.cache[uid] = uname
+
+	r.cache = make(map[string]*list.Element)
+	r.lru.Init()
+	metric.GetClient().Increment("parser.uid_cache.flush")
+}
+
+// watch flushes the cache whenever one of the files changes. The parent directories are
+// watched rather than the files since tools like useradd and vipw replace the file
+// with a rename which would silently end a watch on the file itself
+func (r *CachingUsernameResolver) watch(paths ...string) {
+	watched := make(map[string]bool, len(paths))
+	dirs := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		watched[filepath.Clean(p)] = true
+		dirs[filepath.Dir(p)] = true
+	}
+
+	if len(watched) == 0 {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("Failed to watch the passwd file, uid cache entries will only expire after their TTL", "error", err)
+		return
+	}
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			logger.Error("Failed to watch the passwd file, uid cache entries will only expire after their TTL", "error", err, "path", dir)
+		}
+	}
+	r.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if watched[filepath.Clean(event.Name)] && event.Op != fsnotify.Chmod {
+					r.flush()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Error watching the passwd file", "error", err)
+			}
+		}
+	}()
 }
@@ -7,26 +7,33 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
-func Test_resolveCacheEnabled(t *testing.T) {
-	cachedValues := make(map[string]string)
-	resolver := &CachingUsernameResolver{
-		cacheLock: &sync.Mutex{},
-		cache:     cachedValues,
+func configureMetrics(t testing.TB) {
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Fatalf("Failed to configure metrics: %v", err)
 	}
+}
+
+func Test_resolveCacheEnabled(t *testing.T) {
+	configureMetrics(t)
+	resolver := newCachingUsernameResolver(CachingUsernameResolverConfig{})
 
 	assert.Equal(t, "root", resolver.Resolve("0"), "0 should be root you animal")
 	assert.Equal(t, "UNKNOWN_USER", resolver.Resolve("-1"), "Expected UNKNOWN_USER")
 
-	val, ok := cachedValues["0"]
+	val, ok := resolver.get("0")
 	if !ok {
 		t.Fatal("Expected the uid mapping to be cached")
 	}
 	assert.Equal(t, "root", val)
 
-	val, ok = cachedValues["-1"]
+	val, ok = resolver.get("-1")
 	if !ok {
 		t.Fatal("Expected the uid mapping to be cached")
 	}
@@ -39,107 +46,126 @@ func Test_resolveNotCached(t *testing.T) {
 	assert.Equal(t, "UNKNOWN_USER", resolver.Resolve("-1"), "Expected UNKNOWN_USER")
 }
 
-func Test_testCheckCache(t *testing.T) {
-	filepath := path.Join(os.TempDir(), "test-passwd")
-	f, _ := os.OpenFile(
-		filepath,
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600,
-	)
-	defer func() {
-		if err := f.Close(); err != nil {
-			t.Errorf("Failed to close file: %v", err)
-		}
-	}()
+func Test_cacheEviction(t *testing.T) {
+	configureMetrics(t)
+	resolver := newCachingUsernameResolver(CachingUsernameResolverConfig{MaxSize: 2})
 
-	// setup cache
-	resolver := &CachingUsernameResolver{
-		cacheLock: &sync.Mutex{},
-		cache: map[string]string{
-			"0":   "notroot",
-			"1":   "test2",
-			"856": "test3",
-		},
-		lastFlush:  time.Now(),
-		passwdPath: filepath,
-	}
+	resolver.save("1", "one")
+	resolver.save("2", "two")
 
-	// let time elapse
-	time.Sleep(5 * time.Second)
+	// touch 1 so 2 becomes the least recently used
+	_, ok := resolver.get("1")
+	assert.True(t, ok)
 
-	// test get cached value
-	result := resolver.checkCache()
-	assert.True(t, result)
-	assert.Equal(t, 3, len(resolver.cache))
+	resolver.save("3", "three")
+	assert.Equal(t, 2, resolver.lru.Len())
 
-	// modify file
-	if _, err := f.Write([]byte("update write")); err != nil {
-		t.Errorf("Failed to write to file: %v", err)
-	}
+	_, ok = resolver.get("2")
+	assert.False(t, ok, "least recently used entry should have been evicted")
+	_, ok = resolver.get("1")
+	assert.True(t, ok)
+	_, ok = resolver.get("3")
+	assert.True(t, ok)
+}
 
-	if err := f.Sync(); err != nil {
-		t.Errorf("Failed to sync file: %v", err)
-	}
+func Test_cacheOverwriteEviction(t *testing.T) {
+	configureMetrics(t)
+	resolver := newCachingUsernameResolver(CachingUsernameResolverConfig{MaxSize: 1})
+
+	// the uids point into a buffer that is reused, like the pooled message buffers
+	buf := []byte("1")
+	resolver.save(bytesToString(buf), "one")
+	resolver.save(bytesToString(buf), "uno")
+	buf[0] = '9'
+
+	resolver.save("2", "two")
+	assert.Equal(t, 1, resolver.lru.Len())
+	assert.Equal(t, 1, len(resolver.cache), "the overwritten entry should have been removed from the map on eviction")
+	_, ok := resolver.get("1")
+	assert.False(t, ok)
+	uname, ok := resolver.get("2")
+	assert.True(t, ok)
+	assert.Equal(t, "two", uname)
+}
 
-	// test cache is cleared
-	result = resolver.checkCache()
-	assert.False(t, result)
-	assert.Empty(t, resolver.cache)
+func Test_cacheTTL(t *testing.T) {
+	configureMetrics(t)
+	resolver := newCachingUsernameResolver(CachingUsernameResolverConfig{
+		TTL:         time.Hour,
+		NegativeTTL: time.Millisecond,
+	})
+
+	resolver.save("1", "one")
+	resolver.save("2", UnknownUsername)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := resolver.get("1")
+	assert.True(t, ok)
+	_, ok = resolver.get("2")
+	assert.False(t, ok, "negative results should expire after the negative ttl")
+	assert.Equal(t, 1, resolver.lru.Len())
 }
 
-func Test_rapid(t *testing.T) {
-	filepath := path.Join(os.TempDir(), "test-passwd")
-	f, _ := os.OpenFile(
-		filepath,
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600,
-	)
+func Test_cacheFlushOnPasswdChange(t *testing.T) {
+	configureMetrics(t)
+	passwdPath := path.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(passwdPath, []byte("root:x:0:0::/root:/bin/sh\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := NewCachingUsernameResolver(CachingUsernameResolverConfig{PasswdPath: passwdPath}).(*CachingUsernameResolver)
 	defer func() {
-		if err := f.Close(); err != nil {
-			t.Errorf("Failed to close file: %v", err)
+		if err := resolver.Close(); err != nil {
+			t.Errorf("Failed to close resolver: %v", err)
 		}
 	}()
 
-	// setup test fixture file
-	if _, err := f.Write([]byte{}); err != nil {
-		t.Errorf("Failed to write to file: %v", err)
-	}
+	resolver.save("0", "notroot")
+	resolver.save("1", "test2")
 
-	// prime cache with values for test
-	resolver := &CachingUsernameResolver{
-		cacheLock: &sync.Mutex{},
-		cache: map[string]string{
-			"0":   "notroot",
-			"1":   "test2",
-			"856": "test3",
-		},
-		lastFlush:  time.Now(),
-		passwdPath: filepath,
+	// an unrelated file in the same directory does not flush the cache
+	if err := os.WriteFile(path.Join(path.Dir(passwdPath), "shadow"), []byte("update write"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, ok := resolver.get("0")
+	assert.True(t, ok)
+
+	// replace the file the way useradd does
+	tmp := passwdPath + "+"
+	if err := os.WriteFile(tmp, []byte("update write"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, passwdPath); err != nil {
+		t.Fatal(err)
 	}
 
-	tests := map[string]string{}
-	fileModificationInterval := 4
+	assert.Eventually(t, func() bool {
+		_, ok := resolver.get("0")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func Test_rapid(t *testing.T) {
+	configureMetrics(t)
+	resolver := newCachingUsernameResolver(CachingUsernameResolverConfig{MaxSize: 2})
 
+	wg := &sync.WaitGroup{}
 	for i := 0; i < 3; i++ {
+		wg.Add(1)
 		go func() {
-			var result string
-			count := 0
-
-			for input, expectedOutput := range tests {
-				if count%fileModificationInterval == 0 {
-					// modify file
-					if _, err := f.Write([]byte("update write")); err != nil {
-						t.Errorf("Failed to write to file: %v", err)
-					}
-
-					if err := f.Sync(); err != nil {
-						t.Errorf("Failed to sync file: %v", err)
-					}
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				if n%4 == 0 {
+					resolver.flush()
 				}
-				// test method
-				result = resolver.Resolve(input)
-				assert.Equal(t, expectedOutput, result)
+				assert.Equal(t, "root", resolver.Resolve("0"))
+				assert.Equal(t, "UNKNOWN_USER", resolver.Resolve("-1"))
 			}
 		}()
 	}
+	wg.Wait()
 }
 
 func Benchmark_getUsernameNoCache(b *testing.B) {
@@ -150,7 +176,8 @@ func Benchmark_getUsernameNoCache(b *testing.B) {
 }
 
 func Benchmark_getUsernameCache(b *testing.B) {
-	resolver := NewCachingUsernameResolver("")
+	configureMetrics(b)
+	resolver := NewCachingUsernameResolver(CachingUsernameResolverConfig{})
 	for i := 0; i < b.N; i++ {
 		_ = resolver.Resolve("0")
 	}
@@ -0,0 +1,221 @@
+package parser
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProcPath = "/proc"
+	defaultHostRoot = "/"
+	// maxCachedNamespaces bounds the number of mount namespaces we hold parsed passwd and group files for
+	maxCachedNamespaces = 256
+	// namespaceCheckInterval is how often the passwd and group files of a namespace are checked for changes
+	namespaceCheckInterval = 10 * time.Second
+	// UnknownGroupname is the group name used when a gid can not be resolved
+	UnknownGroupname = "UNKNOWN_GROUP"
+)
+
+// NamespaceAwareUsernameResolver is implemented by resolvers that can resolve uids and gids
+// against the passwd and group files visible to a specific process
+type NamespaceAwareUsernameResolver interface {
+	UsernameResolver
+	// Namespace returns the mount namespace of the process with the given pid and loads its
+	// passwd and group files while the process is still around. ok is false when the process
+	// shares the host mount namespace or could not be inspected
+	Namespace(pid string) (ns string, ok bool)
+	// ResolveInNamespace resolves the uid against the passwd file of a namespace returned by Namespace
+	ResolveInNamespace(ns string, uid string) (uname string, ok bool)
+	// ResolveGroupInNamespace resolves the gid against the group file of a namespace returned by
+	// Namespace. host is the name of the group on the host
+	ResolveGroupInNamespace(ns string, gid string) (gname string, host string, ok bool)
+}
+
+// NamespaceUsernameResolver resolves uids with the wrapped host resolver and, for processes
+// running in a different mount namespace, against /proc/<pid>/root/etc/passwd and group
+type NamespaceUsernameResolver struct {
+	host     UsernameResolver
+	procPath string
+	hostRoot string
+	hostNs   string
+
+	cacheLock *sync.Mutex
+	cache     map[string]*namespaceFiles // { mount namespace: passwd and group }
+}
+
+type namespaceFiles struct {
+	checked      time.Time
+	passwdMod    time.Time
+	groupMod     time.Time
+	users        map[string]string // { uid: username }
+	groups       map[string]string // { gid: group name }
+	passwdLoaded bool
+}
+
+// NewNamespaceUsernameResolver constructs a resolver that resolves host uids with host
+// and container uids against the root filesystem of the process
+func NewNamespaceUsernameResolver(host UsernameResolver) UsernameResolver {
+	return newNamespaceUsernameResolver(host, defaultProcPath, defaultHostRoot)
+}
+
+func newNamespaceUsernameResolver(host UsernameResolver, procPath string, hostRoot string) *NamespaceUsernameResolver {
+	hostNs, _ := os.Readlink(path.Join(procPath, "self", "ns", "mnt"))
+
+	return &NamespaceUsernameResolver{
+		host:      host,
+		procPath:  procPath,
+		hostRoot:  hostRoot,
+		hostNs:    hostNs,
+		cacheLock: &sync.Mutex{},
+		cache:     make(map[string]*namespaceFiles),
+	}
+}
+
+// Resolve takes a UID and resolves it to a username on the host
+func (r *NamespaceUsernameResolver) Resolve(uid string) string {
+	return r.host.Resolve(uid)
+}
+
+// Namespace looks up the mount namespace of the process when its record is received. Short lived
+// processes are often gone by the time the group is complete, so the passwd and group files are
+// loaded now and the names are resolved from the cache later
+func (r *NamespaceUsernameResolver) Namespace(pid string) (string, bool) {
+	if pid == "" || r.hostNs == "" {
+		return "", false
+	}
+
+	procDir := path.Join(r.procPath, pid)
+	ns, err := os.Readlink(path.Join(procDir, "ns", "mnt"))
+	if err != nil || ns == r.hostNs {
+		return "", false
+	}
+
+	if files := r.load(ns, path.Join(procDir, "root"), time.Now()); files == nil {
+		return "", false
+	}
+
+	return ns, true
+}
+
+// ResolveInNamespace takes a mount namespace and UID and resolves it to a username inside the
+// namespace
+func (r *NamespaceUsernameResolver) ResolveInNamespace(ns string, uid string) (string, bool) {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	files, ok := r.cache[ns]
+	if !ok || !files.passwdLoaded {
+		return "", false
+	}
+
+	uname, ok := files.users[uid]
+	if !ok {
+		return UnknownUsername, true
+	}
+
+	return uname, true
+}
+
+// ResolveGroupInNamespace takes a mount namespace and GID and resolves it to a group name inside
+// the namespace and on the host
+func (r *NamespaceUsernameResolver) ResolveGroupInNamespace(ns string, gid string) (string, string, bool) {
+	hostFiles := r.load(r.hostNs, r.hostRoot, time.Now())
+
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	files, ok := r.cache[ns]
+	if !ok || files.groups == nil {
+		return "", "", false
+	}
+
+	gname, ok := files.groups[gid]
+	if !ok {
+		gname = UnknownGroupname
+	}
+
+	host := UnknownGroupname
+	if hostFiles != nil {
+		if name, ok := hostFiles.groups[gid]; ok {
+			host = name
+		}
+	}
+
+	return gname, host, true
+}
+
+// load returns the passwd and group files of the namespace below root, reading them again when
+// they changed since they were last checked. It is nil when neither file could be read
+func (r *NamespaceUsernameResolver) load(ns string, root string, now time.Time) *namespaceFiles {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+
+	files, ok := r.cache[ns]
+	if ok && now.Sub(files.checked) < namespaceCheckInterval {
+		return files
+	}
+
+	next := &namespaceFiles{checked: now}
+	if ok {
+		*next = *files
+		next.checked = now
+	}
+
+	passwdPath := path.Join(root, "etc", "passwd")
+	if stat, err := os.Stat(passwdPath); err == nil && (!next.passwdLoaded || !stat.ModTime().Equal(next.passwdMod)) {
+		if users, err := parseIDFile(passwdPath); err == nil {
+			next.users, next.passwdMod, next.passwdLoaded = users, stat.ModTime(), true
+		}
+	}
+
+	groupPath := path.Join(root, "etc", "group")
+	if stat, err := os.Stat(groupPath); err == nil && (next.groups == nil || !stat.ModTime().Equal(next.groupMod)) {
+		if groups, err := parseIDFile(groupPath); err == nil {
+			next.groups, next.groupMod = groups, stat.ModTime()
+		}
+	}
+
+	if !next.passwdLoaded && next.groups == nil {
+		return nil
+	}
+
+	if !ok && len(r.cache) >= maxCachedNamespaces {
+		// namespaces come and go with containers, start over rather than growing forever
+		r.cache = make(map[string]*namespaceFiles)
+	}
+	r.cache[ns] = next
+
+	return next
+}
+
+// parseIDFile reads a passwd(5) or group(5) formatted file into an id to name map, both carry
+// the name in the first and the id in the third field
+func parseIDFile(filePath string) (map[string]string, error) {
+	contents, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// passwd is name:password:uid:gid:gecos:home:shell, group is name:password:gid:members
+		fields := strings.SplitN(line, ":", 4)
+		if len(fields) < 3 {
+			continue
+		}
+
+		if _, ok := names[fields[2]]; !ok {
+			names[fields[2]] = fields[0]
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,131 @@
+package parser
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name string, contents string) {
+	if err := os.MkdirAll(path.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createFakeProc returns a proc directory with a container process 42 and a host root
+func createFakeProc(t *testing.T) (string, string) {
+	procPath := t.TempDir()
+
+	for pid, ns := range map[string]string{"self": "mnt:[4026531840]", "1": "mnt:[4026531840]", "42": "mnt:[4026532000]"} {
+		if err := os.MkdirAll(path.Join(procPath, pid, "ns"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(ns, path.Join(procPath, pid, "ns", "mnt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	etc := path.Join(procPath, "42", "root", "etc")
+	writeFile(t, path.Join(etc, "passwd"), "# container users\nroot:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n")
+	writeFile(t, path.Join(etc, "group"), "root:x:0:\napp:x:1000:\n")
+
+	hostRoot := t.TempDir()
+	writeFile(t, path.Join(hostRoot, "etc", "group"), "root:x:0:\nstaff:x:1000:hostuser\n")
+
+	return procPath, hostRoot
+}
+
+func TestNamespaceUsernameResolver_Namespace(t *testing.T) {
+	host := &TestUsernameResolver{fixtureUIDMap: map[string]string{"0": "root", "1000": "hostuser"}}
+	procPath, hostRoot := createFakeProc(t)
+	resolver := newNamespaceUsernameResolver(host, procPath, hostRoot)
+
+	assert.Equal(t, "hostuser", resolver.Resolve("1000"))
+
+	ns, ok := resolver.Namespace("42")
+	assert.True(t, ok)
+	assert.Equal(t, "mnt:[4026532000]", ns)
+
+	// the files were loaded when the namespace was looked up, the process may be gone by now
+	assert.Nil(t, os.RemoveAll(path.Join(procPath, "42")))
+
+	uname, ok := resolver.ResolveInNamespace(ns, "1000")
+	assert.True(t, ok)
+	assert.Equal(t, "app", uname)
+
+	uname, ok = resolver.ResolveInNamespace(ns, "2000")
+	assert.True(t, ok)
+	assert.Equal(t, "UNKNOWN_USER", uname)
+
+	gname, hostName, ok := resolver.ResolveGroupInNamespace(ns, "1000")
+	assert.True(t, ok)
+	assert.Equal(t, "app", gname)
+	assert.Equal(t, "staff", hostName)
+
+	gname, hostName, ok = resolver.ResolveGroupInNamespace(ns, "2000")
+	assert.True(t, ok)
+	assert.Equal(t, "UNKNOWN_GROUP", gname)
+	assert.Equal(t, "UNKNOWN_GROUP", hostName)
+
+	_, ok = resolver.ResolveInNamespace("mnt:[1]", "1000")
+	assert.False(t, ok)
+
+	// same mount namespace as the host
+	_, ok = resolver.Namespace("1")
+	assert.False(t, ok)
+
+	// process already exited
+	_, ok = resolver.Namespace("43")
+	assert.False(t, ok)
+}
+
+func TestNamespaceUsernameResolver_load(t *testing.T) {
+	procPath, hostRoot := createFakeProc(t)
+	resolver := newNamespaceUsernameResolver(&TestUsernameResolver{}, procPath, hostRoot)
+	root := path.Join(procPath, "42", "root")
+
+	now := time.Now()
+	files := resolver.load("mnt:[4026532000]", root, now)
+	assert.Equal(t, "app", files.users["1000"])
+
+	passwd := path.Join(root, "etc", "passwd")
+	writeFile(t, passwd, "renamed:x:1000:1000::/home/app:/bin/sh\n")
+	later := now.Add(time.Hour)
+	assert.Nil(t, os.Chtimes(passwd, later, later))
+
+	// the files are checked again once the interval passed
+	files = resolver.load("mnt:[4026532000]", root, now.Add(time.Second))
+	assert.Equal(t, "app", files.users["1000"])
+	files = resolver.load("mnt:[4026532000]", root, now.Add(namespaceCheckInterval))
+	assert.Equal(t, "renamed", files.users["1000"])
+	assert.Equal(t, "app", files.groups["1000"])
+
+	assert.Nil(t, resolver.load("mnt:[1]", t.TempDir(), now))
+}
+
+func TestAuditMessageGroup_mapperContainerUIDs(t *testing.T) {
+	host := &TestUsernameResolver{fixtureUIDMap: map[string]string{"0": "root", "1000": "hostuser"}}
+	procPath, hostRoot := createFakeProc(t)
+	ActiveUsernameResolver = newNamespaceUsernameResolver(host, procPath, hostRoot)
+	defer func() { ActiveUsernameResolver = &DefaultUsernameResolver{} }()
+
+	data := "arch=c000003e syscall=59 ppid=1 pid=42 auid=1000 uid=0 gid=0 egid=1000 key=(null)"
+	amg := &AuditMessageGroup{UIDMap: make(map[string]string)}
+	amg.AppendMessage(&AuditMessage{Type: AuditSyscall, Data: data})
+	assert.Equal(t, "42", amg.Pid)
+	assert.Equal(t, "mnt:[4026532000]", amg.MountNs)
+
+	// the process exited before the group was complete
+	assert.Nil(t, os.RemoveAll(path.Join(procPath, "42")))
+
+	amg.MapUIDs()
+	assert.Equal(t, map[string]string{"1000": "hostuser", "0": "root"}, amg.UIDMap)
+	assert.Equal(t, map[string]string{"1000": "app"}, amg.ContainerUIDMap)
+	assert.Equal(t, map[string]string{"1000": "app"}, amg.ContainerGIDMap)
+}
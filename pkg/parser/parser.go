@@ -2,13 +2,11 @@ package parser
 
 import (
 	"bytes"
-	"fmt"
-	"strconv"
+	"encoding/hex"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
-
-	"github.com/pantheon-systems/pauditd/pkg/metric"
 )
 
 const (
@@ -33,6 +31,10 @@ const (
 	AuditSockaddr = 1306
 	// TTYRuleKey is the rule key that will be used when TTY messages are detected
 	TTYRuleKey = "tty"
+	// NullRuleKey is the value the kernel logs for events that have no rule key
+	NullRuleKey = "(null)"
+	// RuleKeySeparator is the byte the kernel uses to join multiple `-k` keys in a single `key=` field
+	RuleKeySeparator = "\x01"
 )
 
 // This global is not great but since parser is a package with no specific construct
@@ -43,6 +45,7 @@ var (
 	headerEndChar          = []byte{")"[0]}
 	headerSepChar          = byte(':')
 	spaceChar              = byte(' ')
+	auditHeaderPrefix      = []byte("audit(")
 )
 
 func init() {
@@ -52,11 +55,15 @@ func init() {
 }
 
 // AuditMessage represents a single audit message.
+// Data and AuditTime point into a pooled buffer owned by the message, they are only valid
+// until the message (or the group holding it) is released. Use strings.Clone to keep them around
 type AuditMessage struct {
 	Type      uint16 `json:"type"`
 	Data      string `json:"data"`
 	Seq       int    `json:"-"`
 	AuditTime string `json:"-"`
+
+	buf []byte // backing storage for Data and AuditTime
 }
 
 // AuditMessageGroup represents a group of related audit messages.
@@ -66,114 +73,213 @@ type AuditMessageGroup struct {
 	CompleteAfter time.Time         `json:"-"`
 	Msgs          []*AuditMessage   `json:"messages"`
 	UIDMap        map[string]string `json:"uid_map"`
-	Syscall       string            `json:"-"`
-	RuleKey       string            `json:"rule_key"`
+	// ContainerUIDMap holds the usernames from the process' own mount namespace where they differ from UIDMap
+	ContainerUIDMap map[string]string `json:"container_uid_map,omitempty"`
+	// ContainerGIDMap holds the group names from the process' own mount namespace where they differ from the host
+	ContainerGIDMap map[string]string `json:"container_gid_map,omitempty"`
+	Pid             string            `json:"-"`
+	// MountNs is the mount namespace of the process when it differs from the host's, it is looked
+	// up when the syscall record arrives since the process may be gone once the group is complete
+	MountNs  string   `json:"-"`
+	Syscall  string   `json:"-"`
+	RuleKey  string   `json:"rule_key"`
+	RuleKeys []string `json:"rule_keys,omitempty"`
+	// Tags and Severity are added by filters
+	Tags     []string `json:"tags,omitempty"`
+	Severity string   `json:"severity,omitempty"`
+	// Outputs limits the outputs the group is written to, empty means every output
+	Outputs []string `json:"-"`
+	// DryRunFilters holds the IDs of the dry run filters that matched the group
+	DryRunFilters []string `json:"dry_run_filters,omitempty"`
+	// Count, FirstSeen, LastSeen and Seqs are set when the group stands in for several identical ones
+	Count     int    `json:"count,omitempty"`
+	FirstSeen string `json:"first_seen,omitempty"`
+	LastSeen  string `json:"last_seen,omitempty"`
+	Seqs      []int  `json:"seqs,omitempty"`
+	// Aggregated is set once the group went through aggregation, it is not filtered again
+	Aggregated bool `json:"-"`
+	// Encryption is set when fields of the messages are encrypted
+	Encryption *Envelope `json:"encryption,omitempty"`
+}
+
+// Envelope holds what is needed to decrypt the encrypted fields of a group
+type Envelope struct {
+	KeyID   string `json:"key_id"`   // identifies the public key the data key was encrypted with
+	DataKey string `json:"data_key"` // the encrypted key of the group, base64 encoded
 }
 
 // NewAuditMessageGroup creates a new message group from the details parsed from the message.
+// The group is taken from a pool and should be handed back with Release once it has been written
 func NewAuditMessageGroup(am *AuditMessage) *AuditMessageGroup {
-	// TODO: allocating 6 msgs per group is lame and we _should_ know ahead of time roughly how many we need
-	amg := &AuditMessageGroup{
-		Seq:           am.Seq,
-		AuditTime:     am.AuditTime,
-		CompleteAfter: time.Now().Add(CompleteAfter),
-		UIDMap:        make(map[string]string, 2), // Usually only 2 individual uids per execve
-		Msgs:          make([]*AuditMessage, 0, 6),
-	}
+	amg := NewUnmappedAuditMessageGroup(am)
+	amg.mapMessage(am)
+	return amg
+}
+
+// NewUnmappedAuditMessageGroup creates a new message group like NewAuditMessageGroup but leaves
+// resolving usernames to MapUIDs so it can happen once the group is complete
+func NewUnmappedAuditMessageGroup(am *AuditMessage) *AuditMessageGroup {
+	amg := groupPool.Get().(*AuditMessageGroup)
+	amg.Seq = am.Seq
+	amg.AuditTime = am.AuditTime
+	amg.CompleteAfter = time.Now().Add(CompleteAfter)
 
-	amg.AddMessage(am)
+	amg.AppendMessage(am)
 	return amg
 }
 
 // NewAuditMessage creates a new pauditd message from a netlink message.
+// The netlink data is copied so the receive buffer can be reused straight away
 func NewAuditMessage(nlm *syscall.NetlinkMessage) *AuditMessage {
-	aTime, seq := parseAuditHeader(nlm)
-	return &AuditMessage{
-		Type:      nlm.Header.Type,
-		Data:      string(nlm.Data),
-		Seq:       seq,
-		AuditTime: aTime,
-	}
+	am := messagePool.Get().(*AuditMessage)
+	am.Type = nlm.Header.Type
+	am.buf = append(am.buf[:0], nlm.Data...)
+
+	aTime, seq, dataStart := parseAuditHeader(am.buf)
+	am.AuditTime = bytesToString(aTime)
+	am.Seq = seq
+	am.Data = bytesToString(am.buf[dataStart:])
+
+	return am
 }
 
-// Gets the timestamp and audit sequence id from a netlink message
-func parseAuditHeader(msg *syscall.NetlinkMessage) (time string, seq int) {
-	headerStop := bytes.Index(msg.Data, headerEndChar)
+// Gets the timestamp, audit sequence id and the start of the message body from the raw netlink data
+func parseAuditHeader(data []byte) (time []byte, seq int, dataStart int) {
+	headerStop := bytes.Index(data, headerEndChar)
 	// If the position the header appears to stop is less than the minimum length of a header, bail out
 	if headerStop < HeaderMinLength {
 		return
 	}
 
-	header := string(msg.Data[:headerStop])
-	if header[:HeaderStartPos] == "audit(" {
-		// TODO: out of range check, possibly fully binary?
-		sep := strings.IndexByte(header, headerSepChar)
+	header := data[:headerStop]
+	if bytes.HasPrefix(header, auditHeaderPrefix) {
+		sep := bytes.IndexByte(header, headerSepChar)
+		if sep < HeaderStartPos {
+			return
+		}
+
 		time = header[HeaderStartPos:sep]
-		seq, _ = strconv.Atoi(header[sep+1:])
+		seq = atoi(header[sep+1:])
 
-		// Remove the header from data
-		msg.Data = msg.Data[headerStop+3:]
+		// Skip the header and the `: ` that follows it
+		dataStart = min(headerStop+3, len(data))
 	}
 
-	return time, seq
+	return time, seq, dataStart
 }
 
-// AddMessage adds a new message to the current message group.
+// AddMessage adds a new message to the current message group and maps its uids to usernames.
 func (amg *AuditMessageGroup) AddMessage(am *AuditMessage) {
-	parseTimer := metric.GetClient().NewTiming()
+	amg.AppendMessage(am)
+	amg.mapMessage(am)
+}
+
+// AppendMessage adds a new message to the current message group without resolving usernames,
+// call MapUIDs once the group is complete
+func (amg *AuditMessageGroup) AppendMessage(am *AuditMessage) {
 	amg.Msgs = append(amg.Msgs, am)
-	// TODO: need to find more message types that won't contain uids
 	switch am.Type {
-	case AuditExecve, AuditCwd, AuditSockaddr:
-		// Don't map uids here
 	case AuditSyscall:
 		amg.findSyscall(am)
 		amg.findRuleKey(am)
-		amg.mapper(am)
+		amg.findPid(am)
+		amg.findNamespace()
 	case AuditTTY:
 		// pam_tty_audit does not supply a rule key
 		amg.RuleKey = TTYRuleKey
-		amg.mapper(am)
+		amg.RuleKeys = append(amg.RuleKeys[:0], TTYRuleKey)
+	}
+}
+
+// AddTags adds the tags the group does not carry yet
+func (amg *AuditMessageGroup) AddTags(tags ...string) {
+	for _, tag := range tags {
+		if !slices.Contains(amg.Tags, tag) {
+			amg.Tags = append(amg.Tags, tag)
+		}
+	}
+}
+
+// AddDryRunFilter records that the dry run filter with the given ID matched the group
+func (amg *AuditMessageGroup) AddDryRunFilter(id string) {
+	if !slices.Contains(amg.DryRunFilters, id) {
+		amg.DryRunFilters = append(amg.DryRunFilters, id)
+	}
+}
+
+// RouteTo adds outputs the group should be written to, once routed the group is only written
+// to the outputs it was routed to
+func (amg *AuditMessageGroup) RouteTo(outputs ...string) {
+	for _, output := range outputs {
+		if !slices.Contains(amg.Outputs, output) {
+			amg.Outputs = append(amg.Outputs, output)
+		}
+	}
+}
+
+// RoutedTo reports whether the group should be written to the named output
+func (amg *AuditMessageGroup) RoutedTo(output string) bool {
+	return len(amg.Outputs) == 0 || slices.Contains(amg.Outputs, output)
+}
+
+// MapUIDs adds the username of every uid found in the group's messages to the UIDMap object
+func (amg *AuditMessageGroup) MapUIDs() {
+	for _, am := range amg.Msgs {
+		amg.mapMessage(am)
+	}
+}
+
+func (amg *AuditMessageGroup) mapMessage(am *AuditMessage) {
+	// TODO: need to find more message types that won't contain uids
+	switch am.Type {
+	case AuditExecve, AuditCwd, AuditSockaddr:
+		// Don't map uids here
 	default:
 		amg.mapper(am)
 	}
-	parseTimer.Send("parse")
 }
 
-// Mapper finds all `uid=` occurrences in a message and adds the username to the UIDMap object
+// Mapper finds all `uid=` occurrences in a message and adds the username to the UIDMap object.
+// For processes in another mount namespace the `gid=` occurrences are resolved as well
 func (amg *AuditMessageGroup) mapper(am *AuditMessage) {
-	data := am.Data
+	scanIDs(am.Data, "uid=", func(uid string) {
+		// Don't bother re-adding if the existing group already has the mapping
+		if _, ok := amg.UIDMap[uid]; !ok {
+			amg.UIDMap[uid] = ActiveUsernameResolver.Resolve(uid)
+			amg.mapContainerUID(uid)
+		}
+	})
+
+	if amg.MountNs != "" {
+		scanIDs(am.Data, "gid=", amg.mapContainerGID)
+	}
+}
+
+// scanIDs calls fn with the value of every field ending in name, like `uid=` for auid, euid and uid
+func scanIDs(data string, name string, fn func(id string)) {
 	start := 0
 	end := 0
 
-	uidCount := 0
-
 	for {
-		if start = strings.Index(data, "uid="); start < 0 {
+		if start = strings.Index(data, name); start < 0 {
 			break
 		}
 
 		// Progress the start point beyon the = sign
-		start += 4
+		start += len(name)
 		if end = strings.IndexByte(data[start:], spaceChar); end < 0 {
-			// There was no ending space, maybe the uid is at the end of the line
+			// There was no ending space, maybe the id is at the end of the line
 			end = len(data) - start
 
-			// If the end of the line is greater than 5 characters away (overflows a 16 bit uint) then it can't be a uid
+			// If the end of the line is greater than 5 characters away (overflows a 16 bit uint) then it can't be an id
 			if end > 5 {
 				break
 			}
 		}
 
-		uid := data[start : start+end]
+		fn(data[start : start+end])
 
-		// Don't bother re-adding if the existing group already has the mapping
-		if _, ok := amg.UIDMap[uid]; !ok {
-			amg.UIDMap[uid] = ActiveUsernameResolver.Resolve(data[start : start+end])
-			uidCount++
-		}
-
-		// Find the next uid= if we have space for one
+		// Find the next id if we have space for one
 		next := start + end + 1
 		if next >= len(data) {
 			break
@@ -183,26 +289,157 @@ func (amg *AuditMessageGroup) mapper(am *AuditMessage) {
 	}
 }
 
+// HasRuleKey reports whether any of the rule keys on the group is equal to key
+func (amg *AuditMessageGroup) HasRuleKey(key string) bool {
+	if amg.RuleKey == key {
+		return true
+	}
+
+	for _, k := range amg.RuleKeys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findNamespace records the mount namespace of the process if it differs from the host's
+func (amg *AuditMessageGroup) findNamespace() {
+	resolver, ok := ActiveUsernameResolver.(NamespaceAwareUsernameResolver)
+	if !ok || amg.Pid == "" {
+		return
+	}
+
+	if ns, ok := resolver.Namespace(amg.Pid); ok {
+		amg.MountNs = intern(ns)
+	}
+}
+
+// mapContainerUID records the username of the uid inside the process' mount namespace if it
+// differs from the one on the host
+func (amg *AuditMessageGroup) mapContainerUID(uid string) {
+	resolver, ok := ActiveUsernameResolver.(NamespaceAwareUsernameResolver)
+	if !ok || amg.MountNs == "" {
+		return
+	}
+
+	uname, ok := resolver.ResolveInNamespace(amg.MountNs, uid)
+	if !ok || uname == amg.UIDMap[uid] {
+		return
+	}
+
+	if amg.ContainerUIDMap == nil {
+		amg.ContainerUIDMap = make(map[string]string, 2)
+	}
+	amg.ContainerUIDMap[uid] = uname
+}
+
+// mapContainerGID records the group name of the gid inside the process' mount namespace if it
+// differs from the one on the host
+func (amg *AuditMessageGroup) mapContainerGID(gid string) {
+	if _, ok := amg.ContainerGIDMap[gid]; ok {
+		return
+	}
+
+	resolver, ok := ActiveUsernameResolver.(NamespaceAwareUsernameResolver)
+	if !ok {
+		return
+	}
+
+	gname, host, ok := resolver.ResolveGroupInNamespace(amg.MountNs, gid)
+	if !ok || gname == host {
+		return
+	}
+
+	if amg.ContainerGIDMap == nil {
+		amg.ContainerGIDMap = make(map[string]string, 2)
+	}
+	amg.ContainerGIDMap[gid] = gname
+}
+
+func (amg *AuditMessageGroup) findPid(am *AuditMessage) {
+	// `pid=` is also a suffix of `ppid=` so make sure we match the whole field name
+	data := am.Data
+	start := strings.Index(data, " pid=")
+	if start < 0 {
+		if !strings.HasPrefix(data, "pid=") {
+			return
+		}
+	} else {
+		data = data[start+1:]
+	}
+
+	// If the end of the line is greater than 10 characters away (overflows a 32 bit uint) then it can't be a pid
+	amg.Pid = amg.findDataField("pid", 10, data)
+}
+
 func (amg *AuditMessageGroup) findRuleKey(am *AuditMessage) {
-	ruleKey := amg.findDataField("key", MaxAuditRuleKeyLength, am.Data)
-	amg.RuleKey = strings.ReplaceAll(ruleKey, "\"", "")
+	// Multiple keys are hex encoded by the kernel which doubles the length of the value
+	ruleKey := amg.findDataField("key", MaxAuditRuleKeyLength*2, am.Data)
+	amg.RuleKeys = parseRuleKeys(amg.RuleKeys[:0], ruleKey)
+	if len(amg.RuleKeys) > 0 {
+		amg.RuleKey = amg.RuleKeys[0]
+		return
+	}
+
+	amg.RuleKey = intern(strings.ReplaceAll(ruleKey, "\"", ""))
+}
+
+// parseRuleKeys splits the raw value of a `key=` field into the individual rule keys and
+// appends them to keys. The kernel logs a single key quoted (key="foo") but when multiple
+// keys are present they are joined with \x01 and the whole value is hex encoded (key=666F6F01626172)
+func parseRuleKeys(keys []string, raw string) []string {
+	if raw == "" || raw == NullRuleKey {
+		return keys
+	}
+
+	value := strings.Trim(raw, "\"")
+	if !strings.HasPrefix(raw, "\"") {
+		if decoded, err := hex.DecodeString(raw); err == nil {
+			value = string(decoded)
+		}
+	}
+
+	for value != "" {
+		key := value
+		if end := strings.Index(value, RuleKeySeparator); end >= 0 {
+			key, value = value[:end], value[end+len(RuleKeySeparator):]
+		} else {
+			value = ""
+		}
+
+		if key != "" {
+			keys = append(keys, intern(key))
+		}
+	}
+
+	return keys
 }
 
 func (amg *AuditMessageGroup) findSyscall(am *AuditMessage) {
 	// If the end of the line is greater than 5 characters away (overflows a 16 bit uint) then it can't be a syscall id
-	amg.Syscall = amg.findDataField("syscall", 5, am.Data)
+	amg.Syscall = intern(amg.findDataField("syscall", 5, am.Data))
 }
 
 func (amg *AuditMessageGroup) findDataField(fieldName string, valueMaxLen int, data string) string {
 	start := 0
 	end := 0
 
-	if start = strings.Index(data, fmt.Sprintf("%s=", fieldName)); start < 0 {
-		return ""
+	// Look for `<fieldName>=` without building the needle, it would cost an allocation per call
+	for {
+		if end = strings.Index(data[start:], fieldName); end < 0 {
+			return ""
+		}
+
+		start += end + len(fieldName)
+		if start < len(data) && data[start] == '=' {
+			break
+		}
 	}
 
 	// Progress the start point beyond the = sign
-	start += (len(fieldName) + 1)
+	start++
 	if end = strings.IndexByte(data[start:], spaceChar); end < 0 {
 		// There was no ending space, maybe the syscall id is at the end of the line
 		end = len(data) - start
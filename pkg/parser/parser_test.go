@@ -159,3 +159,150 @@ func TestAuditMessageGroup_findDataFiles(t *testing.T) {
 	result = amg.findDataField("testfield", 128, "uid=0 1uid=1 2uid=2 3uid=3 not here 4uid=99999")
 	assert.Equal(t, "", result)
 }
+
+func TestAuditMessageGroup_findRuleKey(t *testing.T) {
+	amg := &AuditMessageGroup{}
+
+	// single quoted key
+	amg.findRuleKey(&AuditMessage{Data: `syscall=2 key="passwd-write-log"`})
+	assert.Equal(t, "passwd-write-log", amg.RuleKey)
+	assert.Equal(t, []string{"passwd-write-log"}, amg.RuleKeys)
+
+	// multiple keys are joined with \x01 and hex encoded: key1\x01key2
+	amg.findRuleKey(&AuditMessage{Data: "syscall=2 key=6B657931016B657932"})
+	assert.Equal(t, "key1", amg.RuleKey)
+	assert.Equal(t, []string{"key1", "key2"}, amg.RuleKeys)
+	assert.True(t, amg.HasRuleKey("key2"))
+	assert.False(t, amg.HasRuleKey("key3"))
+
+	// no key
+	amg.findRuleKey(&AuditMessage{Data: "syscall=2 key=(null)"})
+	assert.Equal(t, "(null)", amg.RuleKey)
+	assert.Empty(t, amg.RuleKeys)
+}
+
+func TestAuditMessageGroup_Release(t *testing.T) {
+	configureMetrics(t)
+	ActiveUsernameResolver = &TestUsernameResolver{fixtureUIDMap: map[string]string{"0": "root"}}
+
+	am := NewAuditMessage(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte(`audit(10000001:99): syscall=59 uid=0 key="testkey"`),
+	})
+	amg := NewAuditMessageGroup(am)
+	assert.Equal(t, "59", amg.Syscall)
+	assert.Equal(t, "testkey", amg.RuleKey)
+	assert.Equal(t, "root", amg.UIDMap["0"])
+
+	ruleKey := amg.RuleKey
+	amg.Release()
+
+	// interned values survive the group going back to the pool
+	assert.Equal(t, "testkey", ruleKey)
+	assert.Empty(t, amg.Msgs)
+	assert.Empty(t, amg.UIDMap)
+	assert.Empty(t, amg.RuleKeys)
+	assert.Equal(t, "", amg.RuleKey)
+}
+
+func TestAuditMessageGroup_Clone(t *testing.T) {
+	configureMetrics(t)
+	ActiveUsernameResolver = &TestUsernameResolver{fixtureUIDMap: map[string]string{"0": "root"}}
+
+	amg := NewAuditMessageGroup(NewAuditMessage(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte(`audit(10000001.000:99): syscall=59 uid=0 key="testkey"`),
+	}))
+	amg.AddTags("a")
+	amg.RouteTo("file")
+
+	c := amg.Clone()
+	amg.Release()
+
+	// the released group's buffers get reused, the clone keeps its own copy
+	NewAuditMessageGroup(NewAuditMessage(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte(`audit(10000002.000:100): syscall=2 uid=1 key="otherkey"`),
+	})).Release()
+
+	assert.Equal(t, 99, c.Seq)
+	assert.Equal(t, "10000001.000", c.AuditTime)
+	if assert.Len(t, c.Msgs, 1) {
+		assert.Equal(t, `syscall=59 uid=0 key="testkey"`, c.Msgs[0].Data)
+		assert.Equal(t, "10000001.000", c.Msgs[0].AuditTime)
+	}
+	assert.Equal(t, map[string]string{"0": "root"}, c.UIDMap)
+	assert.Equal(t, "testkey", c.RuleKey)
+	assert.Equal(t, "59", c.Syscall)
+	assert.Equal(t, []string{"a"}, c.Tags)
+	assert.Equal(t, []string{"file"}, c.Outputs)
+}
+
+func TestAuditMessageGroup_TagsAndRoutes(t *testing.T) {
+	amg := &AuditMessageGroup{}
+	assert.True(t, amg.RoutedTo("http"))
+
+	amg.AddTags("a", "b")
+	amg.AddTags("b", "c")
+	assert.Equal(t, []string{"a", "b", "c"}, amg.Tags)
+
+	amg.RouteTo("syslog")
+	amg.RouteTo("syslog", "file")
+	assert.Equal(t, []string{"syslog", "file"}, amg.Outputs)
+	assert.True(t, amg.RoutedTo("file"))
+	assert.False(t, amg.RoutedTo("http"))
+
+	amg.Severity = "high"
+	amg.Release()
+	assert.Empty(t, amg.Tags)
+	assert.Empty(t, amg.Outputs)
+	assert.Equal(t, "", amg.Severity)
+}
+
+// benchmarkRecords is a typical execve event as it comes off the netlink socket
+var benchmarkRecords = []struct {
+	mtype uint16
+	data  string
+}{
+	{1300, `audit(1459376866.885:1222763): arch=c000003e syscall=59 success=yes exit=0 a0=cc4e68 a1=d10bc8 a2=c69808 a3=7fff2a700900 items=2 ppid=11552 pid=11623 auid=1000 uid=1000 gid=1000 euid=1000 suid=1000 fsuid=1000 egid=1000 sgid=1000 fsgid=1000 tty=pts0 ses=35 comm="ls" exe="/bin/ls" key="exec"`},
+	{1309, `audit(1459376866.885:1222763): argc=3 a0="ls" a1="--color=auto" a2="-alF"`},
+	{1307, `audit(1459376866.885:1222763):  cwd="/home/ubuntu/src"`},
+	{1302, `audit(1459376866.885:1222763): item=0 name="/bin/ls" inode=262316 dev=ca:01 mode=0100755 ouid=0 ogid=0 rdev=00:00 nametype=NORMAL`},
+	{1302, `audit(1459376866.885:1222763): item=1 name="/lib64/ld-linux-x86-64.so.2" inode=396037 dev=ca:01 mode=0100755 ouid=0 ogid=0 rdev=00:00 nametype=NORMAL`},
+}
+
+func Benchmark_NewAuditMessage(b *testing.B) {
+	nlm := &syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: benchmarkRecords[0].mtype},
+		Data:   []byte(benchmarkRecords[0].data),
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewAuditMessage(nlm).Release()
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+}
+
+func Benchmark_AuditMessageGroup(b *testing.B) {
+	configureMetrics(b)
+	ActiveUsernameResolver = &TestUsernameResolver{fixtureUIDMap: map[string]string{"0": "root", "1000": "ubuntu"}}
+
+	nlms := make([]*syscall.NetlinkMessage, len(benchmarkRecords))
+	for i, r := range benchmarkRecords {
+		nlms[i] = &syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: r.mtype},
+			Data:   []byte(r.data),
+		}
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		amg := NewAuditMessageGroup(NewAuditMessage(nlms[0]))
+		for _, nlm := range nlms[1:] {
+			amg.AddMessage(NewAuditMessage(nlm))
+		}
+		amg.Release()
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "events/s")
+}
@@ -0,0 +1,194 @@
+package parser
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// maxPooledMessageSize keeps unusually large buffers from being held on to by the pool
+	maxPooledMessageSize = 16384
+	// maxPooledGroupSize keeps unusually large groups from being held on to by the pool
+	maxPooledGroupSize = 64
+	// maxInternedStrings bounds the intern table, rule keys and syscalls are a small set in practice
+	maxInternedStrings = 4096
+)
+
+var (
+	messagePool = sync.Pool{
+		New: func() any {
+			return &AuditMessage{}
+		},
+	}
+
+	groupPool = sync.Pool{
+		New: func() any {
+			return &AuditMessageGroup{
+				UIDMap: make(map[string]string, 2), // Usually only 2 individual uids per execve
+				Msgs:   make([]*AuditMessage, 0, 6),
+			}
+		},
+	}
+
+	internLock = &sync.RWMutex{}
+	interned   = make(map[string]string)
+)
+
+// Release hands the message back to the pool. The message, and any string taken from it,
+// must not be used afterwards
+func (am *AuditMessage) Release() {
+	buf := am.buf[:0]
+	if cap(buf) > maxPooledMessageSize {
+		buf = nil
+	}
+
+	*am = AuditMessage{buf: buf}
+	messagePool.Put(am)
+}
+
+// Release hands the group and all of its messages back to their pools. The group, and any
+// string taken from it, must not be used afterwards
+func (amg *AuditMessageGroup) Release() {
+	for _, am := range amg.Msgs {
+		am.Release()
+	}
+
+	msgs := amg.Msgs[:0]
+	clear(amg.Msgs[:cap(amg.Msgs)])
+	if cap(msgs) > maxPooledGroupSize || msgs == nil {
+		msgs = make([]*AuditMessage, 0, 6)
+	}
+
+	uidMap := amg.UIDMap
+	clear(uidMap)
+	if uidMap == nil {
+		uidMap = make(map[string]string, 2)
+	}
+
+	*amg = AuditMessageGroup{
+		Msgs:     msgs,
+		UIDMap:   uidMap,
+		RuleKeys: amg.RuleKeys[:0],
+		Tags:     amg.Tags[:0],
+		Outputs:  amg.Outputs[:0],
+		// keep the capacity of the slices for the next group
+		DryRunFilters: amg.DryRunFilters[:0],
+	}
+	groupPool.Put(amg)
+}
+
+// Clone returns a copy of the group that shares no memory with it, the copy can be kept after
+// the group was released
+func (amg *AuditMessageGroup) Clone() *AuditMessageGroup {
+	c := &AuditMessageGroup{
+		Seq:             amg.Seq,
+		AuditTime:       strings.Clone(amg.AuditTime),
+		CompleteAfter:   amg.CompleteAfter,
+		Msgs:            make([]*AuditMessage, len(amg.Msgs)),
+		UIDMap:          cloneMap(amg.UIDMap),
+		ContainerUIDMap: cloneMap(amg.ContainerUIDMap),
+		ContainerGIDMap: cloneMap(amg.ContainerGIDMap),
+		Pid:             strings.Clone(amg.Pid),
+		MountNs:         amg.MountNs,
+		Syscall:         strings.Clone(amg.Syscall),
+		RuleKey:         strings.Clone(amg.RuleKey),
+		RuleKeys:        cloneStrings(amg.RuleKeys),
+		Tags:            cloneStrings(amg.Tags),
+		Severity:        strings.Clone(amg.Severity),
+		Outputs:         cloneStrings(amg.Outputs),
+		DryRunFilters:   cloneStrings(amg.DryRunFilters),
+		Count:           amg.Count,
+		FirstSeen:       strings.Clone(amg.FirstSeen),
+		LastSeen:        strings.Clone(amg.LastSeen),
+		Seqs:            slices.Clone(amg.Seqs),
+		Aggregated:      amg.Aggregated,
+		Encryption:      amg.Encryption,
+	}
+
+	for i, am := range amg.Msgs {
+		c.Msgs[i] = &AuditMessage{
+			Type:      am.Type,
+			Data:      strings.Clone(am.Data),
+			Seq:       am.Seq,
+			AuditTime: strings.Clone(am.AuditTime),
+		}
+	}
+
+	return c
+}
+
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+
+	c := make([]string, len(s))
+	for i, v := range s {
+		c[i] = strings.Clone(v)
+	}
+	return c
+}
+
+func cloneMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[strings.Clone(k)] = strings.Clone(v)
+	}
+	return c
+}
+
+// bytesToString returns a string sharing the memory of b, b must not be modified while the
+// string is in use
+func bytesToString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
+
+// atoi parses a positive base 10 integer without going through a string, anything that is
+// not a digit ends the number
+func atoi(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			break
+		}
+		n = n*10 + int(c-'0')
+	}
+
+	return n
+}
+
+// intern returns a copy of s that is safe to keep after the message it came from is released.
+// Rule keys and syscalls repeat on every event so the copy is shared instead of allocated each time
+func intern(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	internLock.RLock()
+	v, ok := interned[s]
+	internLock.RUnlock()
+	if ok {
+		return v
+	}
+
+	internLock.Lock()
+	defer internLock.Unlock()
+
+	if len(interned) >= maxInternedStrings {
+		return strings.Clone(s)
+	}
+
+	v = strings.Clone(s)
+	interned[v] = v
+	return v
+}
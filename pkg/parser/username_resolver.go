@@ -4,7 +4,11 @@ import (
 	"os/user"
 )
 
-// UsernameResolver is the abstraction for ways to get usernames from uids
+// UnknownUsername is the username used when a uid can not be resolved
+const UnknownUsername = "UNKNOWN_USER"
+
+// UsernameResolver is the abstraction for ways to get usernames from uids. The uid passed
+// to Resolve is only valid for the duration of the call, copy it if it needs to be kept
 type UsernameResolver interface {
 	Resolve(uid string) string
 }
@@ -20,7 +24,7 @@ func NewDefaultUsernameResolver() UsernameResolver {
 
 // Resolve takes a UID and resolves it to a username
 func (r *DefaultUsernameResolver) Resolve(uid string) string {
-	uname := "UNKNOWN_USER"
+	uname := UnknownUsername
 	luser, err := user.LookupId(uid)
 	if err == nil {
 		uname = luser.Username
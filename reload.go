@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pantheon-systems/pauditd/pkg/logger"
+	"github.com/pantheon-systems/pauditd/pkg/marshaller"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/output"
+	"github.com/spf13/viper"
+)
+
+// reloadWatchDelay is how long the config file has to stay quiet before a watched change is
+// reloaded, editors and config management tend to write a file in several steps
+const reloadWatchDelay = 500 * time.Millisecond
+
+// restartOnlyKeys are the config sections that are only read at startup. A reload applies
+// everything else and warns when one of these changed
+var restartOnlyKeys = []string{"events", "message_tracking", "pipeline", "parser", "socket_buffer", "metrics", "shutdown", "reload"}
+
+// reloader applies changes to the config file to a running pauditd. Filters, rate limits,
+// aggregation, redaction, encryption, rules and the output are replaced together, a config that
+// fails validation leaves all of them untouched
+type reloader struct {
+	lock       sync.Mutex
+	configFile string
+	config     *viper.Viper
+	marshaller *marshaller.AuditMarshaller
+	writer     *output.AuditWriter
+	exec       executor
+	stopped    bool
+}
+
+func newReloader(configFile string, config *viper.Viper, m *marshaller.AuditMarshaller, writer *output.AuditWriter, e executor) *reloader {
+	return &reloader{
+		configFile: configFile,
+		config:     config,
+		marshaller: m,
+		writer:     writer,
+		exec:       e,
+	}
+}
+
+// Stop waits for a reload in progress, ignores any later one and returns the output in use so
+// it can be drained on shutdown
+func (r *reloader) Stop() *output.AuditWriter {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.stopped = true
+	return r.writer
+}
+
+// Reload reads the config file again and applies it, the outcome is logged
+func (r *reloader) Reload() {
+	if err := r.reload(); err != nil {
+		metric.GetClient().Increment("reload.failed")
+		logger.Error("Config reload rejected", "error", err, "config", r.configFile)
+		return
+	}
+	metric.GetClient().Increment("reload.succeeded")
+}
+
+func (r *reloader) reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.stopped {
+		return errors.New("shutting down")
+	}
+
+	config, err := loadConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+
+	// everything that can be checked without side effects goes first
+	filters, err := createFilters(config)
+	if err != nil {
+		return err
+	}
+
+	rateLimits, err := createRateLimits(config)
+	if err != nil {
+		return err
+	}
+
+	aggregation, err := createAggregation(config)
+	if err != nil {
+		return err
+	}
+
+	// the hmac key file is read again so the key can be rotated
+	redactor, err := createRedactor(config)
+	if err != nil {
+		return err
+	}
+
+	// as is the public key, so it can be rotated as well
+	encryptor, err := createEncryptor(config)
+	if err != nil {
+		return err
+	}
+
+	if len(normalizeRules(config.GetStringSlice("rules"))) == 0 {
+		return errors.New("no audit rules found")
+	}
+
+	// only the outputs that changed are created again, the others keep running with their queues
+	var writers []*output.AuditWriter
+	changedOutputs := outputChanges(r.config, config)
+	if len(changedOutputs) > 0 {
+		if !slices.ContainsFunc(output.GetAvailableAuditWriters(), func(name string) bool {
+			return config.GetBool("output." + name + ".enabled")
+		}) {
+			return errors.New("no outputs were configured")
+		}
+
+		if writers, err = createOutputWriters(config, changedOutputs); err != nil {
+			return err
+		}
+	}
+
+	rules, err := reconcileRules(r.config.GetStringSlice("rules"), config.GetStringSlice("rules"), r.exec)
+	if err != nil {
+		for _, w := range writers {
+			closeWriter(w, config.GetDuration("shutdown.timeout"))
+		}
+		logger.Error("Failed to apply the new audit rules, restoring the previous ones", "error", err)
+		if err := setRules(r.config, r.exec); err != nil {
+			logger.Error("Failed to restore the previous audit rules", "error", err)
+		}
+		return err
+	}
+
+	r.marshaller.SetFilters(filters)
+	r.marshaller.SetRedactor(redactor)
+	r.marshaller.SetEncryptor(encryptor)
+	// replacing rate limits refills their buckets and aggregation writes the groups it holds,
+	// both are left alone unless their config changed
+	if !reflect.DeepEqual(r.config.Get("rate_limits"), config.Get("rate_limits")) {
+		r.marshaller.SetRateLimits(rateLimits, config.GetDuration("rate_limits.summary_interval"))
+	}
+	if !reflect.DeepEqual(r.config.Get("aggregation"), config.Get("aggregation")) {
+		r.marshaller.SetAggregation(aggregation)
+	}
+	if len(changedOutputs) > 0 {
+		writer, retire := output.ReplaceOutputs(r.writer, changedOutputs, writers)
+		r.marshaller.SetWriter(writer)
+		retireOutputs(retire, changedOutputs, config.GetDuration("shutdown.timeout"))
+		r.writer = writer
+	}
+
+	for _, key := range restartOnlyKeys {
+		if !reflect.DeepEqual(r.config.Get(key), config.Get(key)) {
+			logger.Info("Config section changed but is only applied on restart", "section", key)
+		}
+	}
+
+	r.config = config
+	logger.Info("Config reloaded",
+		"filters", len(filters),
+		"rate_limits", len(rateLimits),
+		"rules_added", rules.added,
+		"rules_removed", rules.removed,
+		"rules_resynced", rules.resynced,
+		"outputs_recreated", strings.Join(changedOutputs, ","),
+	)
+
+	return nil
+}
+
+// closeWriter drains a writer that is no longer in use
+func closeWriter(w *output.AuditWriter, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := w.Close(ctx); err != nil {
+		logger.Error("Failed to drain the replaced output", "error", err, "output", w.Name())
+	}
+}
+
+// retireOutputs drains the replaced outputs once they are no longer in use
+func retireOutputs(retire func(ctx context.Context) error, names []string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := retire(ctx); err != nil {
+		logger.Error("Failed to drain the replaced output", "error", err, "output", strings.Join(names, ","))
+	}
+}
+
+// outputChanges returns the names of the outputs that were enabled, disabled or whose config
+// changed between the previous and the next config
+func outputChanges(previous, next *viper.Viper) []string {
+	var changed []string
+	for _, name := range output.GetAvailableAuditWriters() {
+		key := "output." + name
+		if previous.GetBool(key+".enabled") != next.GetBool(key+".enabled") ||
+			(next.GetBool(key+".enabled") && !reflect.DeepEqual(previous.Get(key), next.Get(key))) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
+
+type ruleChanges struct {
+	added    int
+	removed  int
+	resynced bool // all rules were flushed and added again
+}
+
+// reconcileRules brings the kernel audit rules from the previous to the next rule set. Rules in
+// both stay in place so nothing goes unaudited while reloading. Since auditctl appends rules, a
+// new rule in between existing ones or a change in their order flushes and adds all rules again
+func reconcileRules(previous, next []string, e executor) (ruleChanges, error) {
+	previous = normalizeRules(previous)
+	next = normalizeRules(next)
+
+	var added, removed, kept []string
+	for _, rule := range previous {
+		if slices.Contains(next, rule) {
+			kept = append(kept, rule)
+		} else {
+			removed = append(removed, rule)
+		}
+	}
+	for _, rule := range next {
+		if !slices.Contains(previous, rule) {
+			added = append(added, rule)
+		}
+	}
+
+	changes := ruleChanges{added: len(added), removed: len(removed)}
+	if slices.Equal(previous, next) {
+		return changes, nil
+	}
+
+	// the kept rules have to come first and in the same order for appending to work
+	if !slices.Equal(kept, next[:len(kept)]) {
+		changes.resynced = true
+		return changes, applyRules(next, e)
+	}
+
+	for _, rule := range removed {
+		args, ok := deleteRuleArgs(rule)
+		if !ok {
+			logger.Error("Audit rule was removed from the config but can not be undone until restart", "rule", rule)
+			continue
+		}
+		if err := e("auditctl", args...); err != nil {
+			return changes, fmt.Errorf("failed to delete rule `%s`. Error: %s", rule, err)
+		}
+	}
+
+	for _, rule := range added {
+		if err := e("auditctl", strings.Fields(rule)...); err != nil {
+			return changes, fmt.Errorf("failed to add rule `%s`. Error: %s", rule, err)
+		}
+	}
+
+	return changes, nil
+}
+
+// applyRules flushes the audit rules and adds rules
+func applyRules(rules []string, e executor) error {
+	if err := e("auditctl", "-D"); err != nil {
+		return fmt.Errorf("failed to flush existing audit rules. Error: %s", err)
+	}
+
+	for i, rule := range rules {
+		if err := e("auditctl", strings.Fields(rule)...); err != nil {
+			return fmt.Errorf("failed to add rule #%d. Error: %s", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// normalizeRules drops empty rules and collapses whitespace so formatting changes do not count
+// as a different rule
+func normalizeRules(rules []string) []string {
+	normalized := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		if fields := strings.Fields(rule); len(fields) > 0 {
+			normalized = append(normalized, strings.Join(fields, " "))
+		}
+	}
+
+	return normalized
+}
+
+// deleteRuleArgs returns the auditctl arguments that delete rule. Only syscall and watch rules
+// can be deleted, control rules like -b or -e stay in effect
+func deleteRuleArgs(rule string) ([]string, bool) {
+	args := strings.Fields(rule)
+	switch args[0] {
+	case "-a", "-A":
+		args[0] = "-d"
+	case "-w":
+		args[0] = "-W"
+	default:
+		return nil, false
+	}
+
+	return args, true
+}
+
+// watchConfig reloads whenever the config file changes. The directory is watched rather than
+// the file so the config can be replaced by a rename, as editors do. Kubernetes mounts the config
+// as a symlink through a `..data` symlink and swaps that one, no event names the config file then,
+// so the target the config resolves to is compared on every event in the directory as well
+func watchConfig(configFile string, reload func()) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	configFile = filepath.Clean(configFile)
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	target, _ := filepath.EvalSymlinks(configFile)
+
+	go func() {
+		var pending <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				resolved, _ := filepath.EvalSymlinks(configFile)
+				if filepath.Clean(event.Name) == configFile || resolved != target {
+					target = resolved
+					pending = time.After(reloadWatchDelay)
+				}
+			case <-pending:
+				pending = nil
+				logger.Info("Config file changed, reloading", "config", configFile)
+				reload()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Error watching the config file", "error", err)
+			}
+		}
+	}()
+
+	return watcher, nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/pauditd/pkg/marshaller"
+	"github.com/pantheon-systems/pauditd/pkg/metric"
+	"github.com/pantheon-systems/pauditd/pkg/parser"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordExec returns an executor that records every auditctl call
+func recordExec(calls *[]string, fail string) executor {
+	return func(_ string, a ...string) error {
+		call := strings.Join(a, " ")
+		*calls = append(*calls, call)
+		if fail != "" && call == fail {
+			return errors.New("testing")
+		}
+		return nil
+	}
+}
+
+func Test_reconcileRules(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	execve := "-a always,exit -F arch=b64 -S execve -k exec"
+	passwd := "-w /etc/passwd -p wa -k passwd"
+	shadow := "-w /etc/shadow -p wa -k shadow"
+
+	// nothing changed, formatting differences do not count
+	var calls []string
+	changes, err := reconcileRules([]string{execve, passwd}, []string{"-a  always,exit -F arch=b64 -S execve -k exec ", "", passwd}, recordExec(&calls, ""))
+	assert.Nil(t, err)
+	assert.Equal(t, ruleChanges{}, changes)
+	assert.Empty(t, calls)
+
+	// removed and appended rules are applied without touching the rest
+	calls = nil
+	changes, err = reconcileRules([]string{execve, passwd, "-b 8192"}, []string{execve, shadow}, recordExec(&calls, ""))
+	assert.Nil(t, err)
+	assert.Equal(t, ruleChanges{added: 1, removed: 2}, changes)
+	assert.Equal(t, []string{"-W /etc/passwd -p wa -k passwd", shadow}, calls)
+
+	// a rule added in front of existing ones needs all rules to be added again
+	calls = nil
+	changes, err = reconcileRules([]string{execve, passwd}, []string{shadow, execve, passwd}, recordExec(&calls, ""))
+	assert.Nil(t, err)
+	assert.Equal(t, ruleChanges{added: 1, resynced: true}, changes)
+	assert.Equal(t, []string{"-D", shadow, execve, passwd}, calls)
+
+	// reordered rules
+	calls = nil
+	changes, err = reconcileRules([]string{execve, passwd}, []string{passwd, execve}, recordExec(&calls, ""))
+	assert.Nil(t, err)
+	assert.Equal(t, ruleChanges{resynced: true}, changes)
+	assert.Equal(t, []string{"-D", passwd, execve}, calls)
+
+	// failures
+	calls = nil
+	_, err = reconcileRules([]string{execve}, []string{execve, shadow}, recordExec(&calls, shadow))
+	assert.EqualError(t, err, "failed to add rule `"+shadow+"`. Error: testing")
+
+	calls = nil
+	_, err = reconcileRules([]string{execve, passwd}, []string{execve}, recordExec(&calls, "-W /etc/passwd -p wa -k passwd"))
+	assert.EqualError(t, err, "failed to delete rule `"+passwd+"`. Error: testing")
+}
+
+func Test_deleteRuleArgs(t *testing.T) {
+	args, ok := deleteRuleArgs("-a always,exit -S execve -k exec")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"-d", "always,exit", "-S", "execve", "-k", "exec"}, args)
+
+	args, ok = deleteRuleArgs("-A exit,always -S open")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"-d", "exit,always", "-S", "open"}, args)
+
+	args, ok = deleteRuleArgs("-w /etc/passwd -p wa")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"-W", "/etc/passwd", "-p", "wa"}, args)
+
+	_, ok = deleteRuleArgs("-e 1")
+	assert.False(t, ok)
+}
+
+func Test_outputChanges(t *testing.T) {
+	previous := viper.New()
+	previous.Set("output.file.enabled", true)
+	previous.Set("output.file.path", "/var/log/a")
+	previous.Set("output.syslog.tag", "pauditd")
+
+	next := viper.New()
+	next.Set("output.file.enabled", true)
+	next.Set("output.file.path", "/var/log/a")
+	next.Set("output.syslog.tag", "other")
+	assert.Empty(t, outputChanges(previous, next), "disabled outputs are not recreated")
+
+	next.Set("output.file.path", "/var/log/b")
+	assert.Equal(t, []string{"file"}, outputChanges(previous, next))
+
+	next.Set("output.file.path", "/var/log/a")
+	next.Set("output.file.enabled", false)
+	next.Set("output.stdout.enabled", true)
+	changed := outputChanges(previous, next)
+	assert.ElementsMatch(t, []string{"file", "stdout"}, changed)
+}
+
+func Test_reloader(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	configFile := path.Join(dir, "pauditd.yaml")
+	writeConfig := func(rules, filters, logFile string) {
+		contents := "rules:\n" + rules +
+			"filters:\n" + filters +
+			"output:\n  file:\n    enabled: true\n    attempts: 1\n    mode: 0644\n" +
+			"    user: " + u.Username + "\n    group: " + g.Name + "\n    path: " + path.Join(dir, logFile) + "\n"
+		if err := os.WriteFile(configFile, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("  - -a always,exit -S execve -k exec\n", "  []\n", "a.log")
+	config, err := loadConfig(configFile)
+	assert.Nil(t, err)
+	writer, err := createOutput(config)
+	assert.Nil(t, err)
+
+	m := marshaller.NewAuditMarshaller(writer, 1300, 1399, false, false, 0, nil)
+	var calls []string
+	r := newReloader(configFile, config, m, writer, recordExec(&calls, ""))
+
+	// rules, filters and the output are swapped
+	writeConfig("  - -a always,exit -S execve -k exec\n  - -w /etc/passwd -p wa -k passwd\n", "  - key: exec\n    regex: bash\n", "b.log")
+	assert.Nil(t, r.reload())
+	assert.Equal(t, []string{"-w /etc/passwd -p wa -k passwd"}, calls)
+	assert.NotSame(t, writer, r.writer)
+	_, err = os.Stat(path.Join(dir, "b.log"))
+	assert.Nil(t, err)
+
+	// enabling another output keeps the file output running
+	fileWriter := r.writer
+	writeConfig("  - -a always,exit -S execve -k exec\n  - -w /etc/passwd -p wa -k passwd\n", "  - key: exec\n    regex: bash\n", "b.log")
+	f, err := os.OpenFile(configFile, os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteString("  stdout:\n    enabled: true\n    attempts: 1\n")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.Nil(t, r.reload())
+	hookLogger() // the stdout output moves the logger to stderr
+	assert.Equal(t, "file,stdout", r.writer.Name())
+	assert.Nil(t, r.writer.Write(&parser.AuditMessageGroup{Seq: 1, Outputs: []string{"file"}}))
+	assert.Eventually(t, func() bool {
+		contents, _ := os.ReadFile(path.Join(dir, "b.log"))
+		return strings.Contains(string(contents), `"sequence":1,`)
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, fileWriter.Write(&parser.AuditMessageGroup{Seq: 2}), "the kept output is not closed")
+
+	// a config that does not validate changes nothing
+	calls = nil
+	current := r.writer
+	writeConfig("  - -a always,exit -S open -k open\n", "  - key: exec\n    regex: bash\n    action: explode\n", "c.log")
+	assert.NotNil(t, r.reload())
+	assert.Empty(t, calls)
+	assert.Same(t, current, r.writer)
+	_, err = os.Stat(path.Join(dir, "c.log"))
+	assert.True(t, os.IsNotExist(err))
+
+	// failing rules are put back the way they were
+	writeConfig("  - -a always,exit -S open -k open\n", "  []\n", "b.log")
+	r.exec = recordExec(&calls, "-a always,exit -S open -k open")
+	assert.EqualError(t, r.reload(), "failed to add rule `-a always,exit -S open -k open`. Error: testing")
+	assert.Equal(t, []string{
+		"-d always,exit -S execve -k exec",
+		"-W /etc/passwd -p wa -k passwd",
+		"-a always,exit -S open -k open",
+		"-D",
+		"-a always,exit -S execve -k exec",
+		"-w /etc/passwd -p wa -k passwd",
+	}, calls)
+
+	// no reloads once stopped
+	assert.Same(t, current, r.Stop())
+	assert.EqualError(t, r.reload(), "shutting down")
+}
+
+func Test_watchConfig(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	dir := t.TempDir()
+	configFile := path.Join(dir, "pauditd.yaml")
+	if err := os.WriteFile(configFile, []byte("rules: []\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := make(chan struct{}, 10)
+	watcher, err := watchConfig(configFile, func() { reloaded <- struct{}{} })
+	assert.Nil(t, err)
+	defer func() {
+		if err := watcher.Close(); err != nil {
+			t.Errorf("Failed to close watcher: %v", err)
+		}
+	}()
+
+	// other files in the directory are ignored
+	if err := os.WriteFile(path.Join(dir, "other.yaml"), []byte("a: b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// replacing the config by a rename counts, several writes in a row reload once
+	for i := 0; i < 3; i++ {
+		tmp := path.Join(dir, "pauditd.yaml.tmp")
+		if err := os.WriteFile(tmp, []byte("rules: []\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, configFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config was not reloaded")
+	}
+
+	select {
+	case <-reloaded:
+		t.Fatal("config was reloaded more than once")
+	case <-time.After(2 * reloadWatchDelay):
+	}
+}
+
+func Test_watchConfigSymlinkSwap(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	// the layout kubernetes uses for config maps:
+	// pauditd.yaml -> ..data/pauditd.yaml, ..data -> ..2024_01_01
+	dir := t.TempDir()
+	for _, version := range []string{"..2024_01_01", "..2024_01_02"} {
+		if err := os.Mkdir(path.Join(dir, version), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, version, "pauditd.yaml"), []byte("rules: []\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("..2024_01_01", path.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	configFile := path.Join(dir, "pauditd.yaml")
+	if err := os.Symlink(path.Join("..data", "pauditd.yaml"), configFile); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := make(chan struct{}, 10)
+	watcher, err := watchConfig(configFile, func() { reloaded <- struct{}{} })
+	assert.Nil(t, err)
+	defer func() {
+		if err := watcher.Close(); err != nil {
+			t.Errorf("Failed to close watcher: %v", err)
+		}
+	}()
+
+	// kubernetes swaps ..data with a rename, the config file itself is never touched
+	if err := os.Symlink("..2024_01_02", path.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path.Join(dir, "..data_tmp"), path.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config was not reloaded")
+	}
+}
+
+func Test_reloaderBlockedWrite(t *testing.T) {
+	defer resetLogger()
+	hookLogger()
+
+	cfg := viper.New()
+	cfg.Set("metrics.enabled", false)
+	if err := metric.Configure(cfg); err != nil {
+		t.Errorf("Failed to configure metric: %v", err)
+	}
+
+	// the first service never answers, so the buffer fills up and the next write blocks
+	requested, release := make(chan struct{}, 1), make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer stuck.Close()
+	defer close(release)
+
+	var lock sync.Mutex
+	var bodies []string
+	working := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		bodies = append(bodies, string(body))
+	}))
+	defer working.Close()
+
+	dir := t.TempDir()
+	configFile := path.Join(dir, "pauditd.yaml")
+	writeConfig := func(url string) {
+		contents := "rules:\n  - -a always,exit -S execve -k exec\n" +
+			"shutdown:\n  timeout: 100ms\n" +
+			"output:\n  http:\n    enabled: true\n    attempts: 1\n    worker_count: 1\n    buffer_size: 1\n" +
+			"    backpressure: block\n    max_wait: 0s\n    on_failure: drop\n    url: " + url + "\n"
+		if err := os.WriteFile(configFile, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig(stuck.URL)
+	config, err := loadConfig(configFile)
+	assert.Nil(t, err)
+	writer, err := createOutput(config)
+	assert.Nil(t, err)
+
+	m := marshaller.NewAuditMarshaller(writer, 1300, 1399, false, false, 0, nil)
+	r := newReloader(configFile, config, m, writer, recordExec(&[]string{}, ""))
+
+	// one group is sent, one waits in the buffer and the last one waits for room
+	consumed := make(chan struct{})
+	go func() {
+		defer close(consumed)
+		for seq := 1; seq <= 3; seq++ {
+			id := "audit(10000001:" + strconv.Itoa(seq) + "): "
+			m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1300}, Data: []byte(id + "hi there")})
+			m.Consume(&syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: 1320}, Data: []byte(id)})
+		}
+	}()
+	<-requested
+	time.Sleep(50 * time.Millisecond)
+
+	// the reload does not wait for the blocked write, which goes to the new output instead
+	writeConfig(working.URL)
+	reloaded := make(chan error)
+	go func() { reloaded <- r.reload() }()
+	select {
+	case err := <-reloaded:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload waited for the blocked write")
+	}
+
+	<-consumed
+	assert.Nil(t, r.writer.Close(context.Background()))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Len(t, bodies, 1)
+	assert.Contains(t, strings.Join(bodies, ""), `"sequence":3,`)
+}